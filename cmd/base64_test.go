@@ -0,0 +1,47 @@
+package main
+
+import (
+	"ssh-plugin/compression"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+)
+
+func TestBase64RoundTrip(t *testing.T) {
+	devices := make([]models.Device, 20)
+	for i := range devices {
+		devices[i] = models.Device{ID: i + 1, IP: "10.0.0.1", Credentials: models.Credentials{Username: "admin"}}
+	}
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alphabet := range []string{"std", "url"} {
+		t.Run(alphabet, func(t *testing.T) {
+			cfg := sshtest.LoadConfig(t, serveTestConfig(`, "output": {"base64": "`+alphabet+`"}`))
+			key, err := cfg.EncryptionKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encoded, err := encodeResult(devices, key, codec, cfg.Base64Encoding())
+			if err != nil {
+				t.Fatalf("encodeResult: %v", err)
+			}
+			if alphabet == "url" && strings.ContainsAny(encoded, "+/") {
+				t.Errorf("url output %q contains characters of the standard alphabet", encoded)
+			}
+
+			// The same setting decodes the input, so output sealed with it reads back
+			decoded, err := decryptAndDecompress(strings.NewReader(encoded), cfg)
+			if err != nil {
+				t.Fatalf("decryptAndDecompress: %v", err)
+			}
+			if len(decoded) != len(devices) || decoded[len(decoded)-1].ID != len(devices) {
+				t.Errorf("got %d devices back, want %d", len(decoded), len(devices))
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"runtime/debug"
+	"ssh-plugin/compression"
+	"ssh-plugin/config"
+	"ssh-plugin/models"
+	"sync"
+	"time"
+)
+
+// batchJob tells runBatch how one mode processes a device and reports its result
+type batchJob[R any] struct {
+	mode      string                                                       // Mode named in the summary
+	process   func(ctx context.Context, device models.Device) R            // Handles one valid device on a worker
+	succeeded func(result R) bool                                          // Whether a result counts as a success
+	invalid   func(device models.Device, err error) R                      // Result of a device that fails validation
+	panicked  func(device models.Device, msg string) R                     // Result of a device whose worker panicked
+	cancelled func(ctx context.Context, device models.Device, result *R) R // Result of a device cut short by cancellation or the batch deadline, result is nil when it never started
+	encode    func(result R) (string, error)                               // Encodes a result as one output line
+}
+
+// runBatch processes devices concurrently with job and streams each encoded result to out
+// Devices still running or queued when ctx is cancelled or the batch deadline passes report job.cancelled
+// The returned summary counts the results, writing it is left to the caller
+func runBatch[R any](ctx context.Context, devices iter.Seq2[int, models.Device], cfg *config.Config, job batchJob[R], out io.Writer) models.BatchSummary {
+	start := time.Now()
+
+	// Devices still running or queued at the batch deadline are cancelled
+	ctx, cancel := withBatchDeadline(ctx, cfg)
+	defer cancel()
+
+	// Collectors use the batch's configuration even if it is reloaded meanwhile
+	ctx = config.NewContext(ctx, cfg)
+
+	// Channel to receive results
+	// Bounded so collectors block instead of queueing the whole batch when output is slow
+	resultChan := make(chan indexed[R], cfg.Output.Buffer)
+
+	var wg sync.WaitGroup
+	var outputWg sync.WaitGroup // WaitGroup for the output Goroutine
+	successes := 0              // Owned by the output Goroutine until outputWg is done
+
+	// Start a Goroutine to stream the encoded results
+	outputWg.Add(1)
+	go func() {
+		// Ensure the output Goroutine signals completion
+		defer outputWg.Done()
+		// Recover from panics in the output Goroutine
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Panic in output goroutine", "panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+
+		emitter := newResultEmitter(out, cfg.Output.Ordered)
+		defer emitter.flush()
+
+		for item := range resultChan {
+			if job.succeeded(item.result) {
+				successes++
+			}
+			encoded, err := job.encode(item.result)
+			if err != nil {
+				slog.Error("Error encoding result", "device_id", item.id, "error", err)
+			}
+			emitter.emit(item.index, encoded)
+		}
+	}()
+
+	// Bound the number of devices processed at once
+	sem := make(chan struct{}, cfg.SSH.MaxConcurrency)
+
+	// Process each device in a Goroutine as it is read
+	total := 0
+	for i, device := range devices {
+		total++
+
+		// Invalid devices are reported immediately instead of attempting a doomed dial
+		if err := device.Validate(); err != nil {
+			resultChan <- indexed[R]{i, device.ID, job.invalid(device, err)}
+			continue
+		}
+
+		// Stop waiting for a free worker once the batch is cancelled
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			resultChan <- indexed[R]{i, device.ID, job.cancelled(ctx, device, nil)}
+			continue
+		}
+		wg.Add(1)
+		go func(index int, dev models.Device) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Recover from panics in the processing Goroutine
+			defer func() {
+				if r := recover(); r != nil {
+					resultChan <- indexed[R]{index, dev.ID, job.panicked(dev, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))}
+				}
+			}()
+
+			result := job.process(ctx, dev)
+			// A failure caused by the deadline is reported as such rather than as the error it surfaced as
+			if !job.succeeded(result) && batchDeadlineExceeded(ctx) {
+				result = job.cancelled(ctx, dev, &result)
+			}
+			resultChan <- indexed[R]{index, dev.ID, result}
+		}(i, device)
+	}
+
+	// Wait for all device-processing Goroutines to complete
+	wg.Wait()
+
+	close(resultChan)
+	// Wait for the output Goroutine to finish printing
+	outputWg.Wait()
+
+	return models.NewBatchSummary(job.mode, total, successes, time.Since(start))
+}
+
+// writeSummary writes the summary line ending a batch, sealed like the results when key is set
+func writeSummary(out io.Writer, summary models.BatchSummary, key []byte, codec compression.Codec, enc *base64.Encoding) {
+	encoded, err := encodeResult(summary, key, codec, enc)
+	if err != nil {
+		slog.Error("Error encoding summary", "error", err)
+		return
+	}
+	if _, err := fmt.Fprintln(out, encoded); err != nil {
+		slog.Error("Error writing summary", "error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"ssh-plugin/compression"
+	"ssh-plugin/config"
+	"ssh-plugin/discovery"
+	"ssh-plugin/metrics"
+	"ssh-plugin/models"
+)
+
+// processBoth runs discovery on each device and collects metrics only from devices found reachable,
+// streaming one combined result per device to out, encoded like metrics results
+// Devices not finished when ctx is cancelled report a cancellation error
+// A summary line follows the last result and is also returned,
+// an unusable key or codec fails the batch with an error before any device is processed
+func processBoth(ctx context.Context, devices iter.Seq2[int, models.Device], cfg *config.Config, out io.Writer) (models.BatchSummary, error) {
+	// A nil key disables encryption and results are emitted as plain JSON
+	var key []byte
+	if cfg.EncryptionEnabled() {
+		var err error
+		key, err = cfg.EncryptionKey()
+		if err != nil {
+			return models.BatchSummary{}, fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+
+	codec, err := compression.GetCodec(cfg.Compression.Codec)
+	if err != nil {
+		return models.BatchSummary{}, fmt.Errorf("invalid compression codec: %w", err)
+	}
+	enc := cfg.Base64Encoding()
+
+	// Framed output seals groups of results, until then they are carried as plain JSON
+	resultOut, resultKey := io.Writer(out), key
+	var framer *frameWriter
+	if cfg.Output.FrameSize > 1 {
+		framer = newFrameWriter(out, cfg.Output.FrameSize, key, codec, enc)
+		resultOut, resultKey = framer, nil
+	}
+
+	// Devices of the same system type share a collector for the batch
+	collectors := metrics.NewCollectorSet()
+
+	summary := runBatch(ctx, devices, cfg, batchJob[models.CombinedResult]{
+		mode: "both",
+		process: func(ctx context.Context, dev models.Device) models.CombinedResult {
+			// Dispatch based on system type
+			performer := discovery.GetDiscoveryPerformer(dev.SystemType)
+			discoveryResult := performer.Perform(ctx, dev, cfg.DeviceTimeout(dev.TimeoutSec))
+			discoveryResult.IP = dev.IP
+
+			// Unreachable devices are not polled for metrics
+			if !discoveryResult.Success {
+				return models.NewCombinedResult(discoveryResult, nil)
+			}
+
+			collector := collectors.Get(dev.SystemType)
+			metricsResult := collector.Collect(ctx, dev, cfg.DeviceTimeout(dev.TimeoutSec))
+			metricsResult = metricsResult.SelectMetrics(cfg.Metrics.Include, cfg.Metrics.Exclude).PrefixMetrics(cfg.Metrics.KeyPrefix)
+			metricsResult.IP = dev.IP
+			return models.NewCombinedResult(discoveryResult, &metricsResult)
+		},
+		succeeded: func(result models.CombinedResult) bool { return result.Success },
+		invalid: func(dev models.Device, err error) models.CombinedResult {
+			return models.NewCombinedResult(invalidDiscovery(dev, err), nil)
+		},
+		panicked: func(dev models.Device, msg string) models.CombinedResult {
+			return models.NewCombinedResult(panickedDiscovery(dev, msg), nil)
+		},
+		cancelled: cancelledCombined,
+		encode: func(result models.CombinedResult) (string, error) {
+			return encodeResult(result, resultKey, codec, enc)
+		},
+	}, resultOut)
+
+	if framer != nil {
+		if err := framer.flush(); err != nil {
+			slog.Error("Error writing result frame", "error", err)
+		}
+	}
+	// Release state collectors kept during the batch, such as cached SSH clients
+	if err := collectors.Close(); err != nil {
+		slog.Error("Error closing metrics collectors", "error", err)
+	}
+
+	writeSummary(out, summary, key, codec, enc)
+	return summary, nil
+}
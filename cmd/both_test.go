@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"testing"
+)
+
+func TestProcessBothSkipsUnreachable(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "metrics": {"commands": {"hostname": "echo host1"}}}`)
+	devices := []models.Device{serverDevice(srv, 1), closedPortDevice(t, 2)}
+
+	var out bytes.Buffer
+	summary, err := processBoth(context.Background(), slices.All(devices), cfg, &out)
+	if err != nil {
+		t.Fatalf("processBoth: %v", err)
+	}
+	if summary.Successes != 1 || summary.Failures != 1 {
+		t.Errorf("got summary %+v, want one success and one failure", summary)
+	}
+
+	results := make(map[int]models.CombinedResult)
+	lines := outputLines(&out)
+	for _, line := range lines[:len(lines)-1] {
+		var result models.CombinedResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("invalid result line %q: %v", line, err)
+		}
+		results[result.ID] = result
+	}
+
+	reachable := results[1]
+	if !reachable.Success || !reachable.Discovery.Success || reachable.Metrics == nil {
+		t.Fatalf("got %+v, want discovery and metrics for the reachable device", reachable)
+	}
+	if got := reachable.Metrics.Metrics["hostname"]; got != "host1" {
+		t.Errorf("got hostname %q, want %q", got, "host1")
+	}
+
+	unreachable := results[2]
+	if unreachable.Success || unreachable.Discovery.Success {
+		t.Errorf("got %+v, want failed discovery for the unreachable device", unreachable)
+	}
+	if unreachable.Metrics != nil {
+		t.Errorf("got metrics %+v, metrics must be skipped when discovery fails", unreachable.Metrics)
+	}
+}
+
+func TestProcessBothNonLinuxDevice(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}}`)
+	// Raw devices are reached over SSH like linux ones, discovery must not reject them as unsupported
+	device := serverDevice(srv, 1)
+	device.SystemType = constants.SystemTypeRaw
+	device.CommandOverrides = map[string]string{"hostname": "echo host1"}
+
+	var out bytes.Buffer
+	summary, err := processBoth(context.Background(), slices.All([]models.Device{device}), cfg, &out)
+	if err != nil {
+		t.Fatalf("processBoth: %v", err)
+	}
+
+	var result models.CombinedResult
+	if err := json.Unmarshal([]byte(outputLines(&out)[0]), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Discovery.Success || result.Metrics == nil || result.Metrics.Metrics["hostname"] != "host1\n" {
+		t.Fatalf("got %+v, want discovery followed by metrics for the raw device", result)
+	}
+	if summary.Successes != 1 {
+		t.Errorf("got summary %+v, want one success", summary)
+	}
+}
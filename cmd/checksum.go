@@ -0,0 +1,17 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+)
+
+// checksumLine prefixes an output line with its length and CRC-32 as "<length>:<crc32>:<line>"
+// The length counts the bytes of the line without its newline and the CRC-32 (IEEE) is 8 hex digits,
+// so a consumer can tell a line truncated or corrupted in transit from a complete one
+func checksumLine(line []byte) []byte {
+	body := bytes.TrimSuffix(line, []byte("\n"))
+	prefixed := fmt.Appendf(nil, "%d:%08x:", len(body), crc32.ChecksumIEEE(body))
+	prefixed = append(prefixed, body...)
+	return append(prefixed, '\n')
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"ssh-plugin/internal/sshtest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// verifyChecksumLine checks a line written by checksumLine as a consumer would and returns its body
+func verifyChecksumLine(line string) (string, error) {
+	lengthField, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", fmt.Errorf("no length field")
+	}
+	crcField, body, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", fmt.Errorf("no checksum field")
+	}
+	length, err := strconv.Atoi(lengthField)
+	if err != nil {
+		return "", fmt.Errorf("bad length: %w", err)
+	}
+	if len(body) != length {
+		return "", fmt.Errorf("got %d bytes, line says %d", len(body), length)
+	}
+	if got := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))); got != crcField {
+		return "", fmt.Errorf("got checksum %s, line says %s", got, crcField)
+	}
+	return body, nil
+}
+
+func TestChecksumLineDetectsCorruption(t *testing.T) {
+	body := `{"id":1,"success":true,"metrics":{"hostname":"host1"}}`
+	line := strings.TrimSuffix(string(checksumLine([]byte(body+"\n"))), "\n")
+
+	if got, err := verifyChecksumLine(line); err != nil || got != body {
+		t.Fatalf("got %q, %v, want the intact line to verify", got, err)
+	}
+
+	// Flipping any single byte of the body is caught
+	prefix := len(line) - len(body)
+	for i := prefix; i < len(line); i++ {
+		corrupted := []byte(line)
+		corrupted[i] ^= 0x01
+		if _, err := verifyChecksumLine(string(corrupted)); err == nil {
+			t.Errorf("corrupting byte %d (%q) was not detected", i, line[i])
+		}
+	}
+
+	// So is a line cut short when the stream is split
+	if _, err := verifyChecksumLine(line[:len(line)-5]); err == nil {
+		t.Error("a truncated line was not detected")
+	}
+}
+
+func TestOutputChecksum(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, `{"output": {"checksum": true}}`)
+	path := filepath.Join(t.TempDir(), "results")
+
+	out, err := openOutput(path, cfg)
+	if err != nil {
+		t.Fatalf("openOutput: %v", err)
+	}
+	lines := []string{"first result", "second result"}
+	for _, line := range lines {
+		if _, err := out.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(written) != len(lines) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(written), len(lines), data)
+	}
+	for i, line := range written {
+		if got, err := verifyChecksumLine(line); err != nil || got != lines[i] {
+			t.Errorf("line %d: got %q, %v, want %q", i, got, err, lines[i])
+		}
+	}
+}
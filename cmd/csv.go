@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"ssh-plugin/compression"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+)
+
+// csvEncoder formats metrics results as CSV rows with a fixed header
+// Columns are id, success, polled_at, one column per known metric and a final "other" column
+// holding any remaining metrics as sorted name=value pairs, so the header can be written
+// before the first result and stays the same however devices differ
+type csvEncoder struct {
+	metrics []string
+	known   map[string]bool
+}
+
+// newCSVEncoder creates an encoder with a column for each of the metric names
+func newCSVEncoder(metricNames []string) *csvEncoder {
+	known := make(map[string]bool, len(metricNames))
+	for _, name := range metricNames {
+		known[name] = true
+	}
+	return &csvEncoder{metrics: metricNames, known: known}
+}
+
+// header returns the header row
+func (e *csvEncoder) header() ([]byte, error) {
+	record := append([]string{"id", "ip", "success", "polled_at"}, e.metrics...)
+	return e.encode(append(record, "other"))
+}
+
+// row returns the row for a result
+func (e *csvEncoder) row(result models.MetricsResult) ([]byte, error) {
+	record := []string{strconv.Itoa(result.ID), result.IP, strconv.FormatBool(result.Success), result.PolledAt}
+	for _, name := range e.metrics {
+		record = append(record, result.Metrics[name])
+	}
+
+	var other []string
+	for name, value := range result.Metrics {
+		if !e.known[name] {
+			other = append(other, name+"="+value)
+		}
+	}
+	sort.Strings(other)
+
+	return e.encode(append(record, strings.Join(other, ";")))
+}
+
+// encode renders one record without the trailing newline
+func (e *csvEncoder) encode(record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write(record); err != nil {
+		return nil, fmt.Errorf("csv error: %w", err)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("csv error: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// encodeCSVResult renders a result as a CSV row sealed like encodeResult
+func encodeCSVResult(encoder *csvEncoder, result models.MetricsResult, key []byte, codec compression.Codec, enc *base64.Encoding) (string, error) {
+	row, err := encoder.row(result)
+	if err != nil {
+		return "", err
+	}
+	return sealLine(row, key, codec, enc)
+}
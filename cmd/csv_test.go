@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"slices"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessMetricsCSV(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "output": {"format": "csv", "ordered": true}, "metrics": {"commands": {
+		"hostname": "echo host1", "uptime": "echo up 1 hour", "cpu": "echo 12.5", "memory": "echo 3", "disk": "echo 18G", "processes": "echo 42"}}}`)
+
+	withExtra := serverDevice(srv, 1)
+	withExtra.CommandOverrides = map[string]string{"kernel": "echo 6.1", "hostname": "echo 'host,1'"}
+	devices := []models.Device{withExtra, closedPortDevice(t, 2), serverDevice(srv, 3)}
+
+	var out bytes.Buffer
+	if _, err := processMetrics(context.Background(), slices.All(devices), cfg, &out); err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not CSV: %v\n%s", err, out.String())
+	}
+
+	want := [][]string{
+		{"id", "ip", "success", "polled_at", "cpu", "disk", "hostname", "if_in_octets", "if_out_octets", "memory", "processes", "uptime", "other"},
+		{"1", "127.0.0.1", "true", "", "12.5", "18G", "host,1", "", "", "3", "42", "up 1 hour", "kernel=6.1"},
+		{"2", "127.0.0.1", "false", "", "", "", "", "", "", "", "", "", "error=SSH connection error"},
+		{"3", "127.0.0.1", "true", "", "12.5", "18G", "host1", "", "", "3", "42", "up 1 hour", ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d rows, want a header and %d results:\n%s", len(records), len(want)-1, out.String())
+	}
+	for i, record := range records {
+		if i > 0 {
+			if _, err := time.Parse(time.RFC3339, record[3]); err != nil {
+				t.Errorf("row %d: polled_at %q is not a timestamp", i, record[3])
+			}
+			record[3] = ""
+		}
+		// Only the start of the connection error is stable
+		if last := len(record) - 1; strings.HasPrefix(want[i][last], "error=") && strings.HasPrefix(record[last], want[i][last]) {
+			record[last] = want[i][last]
+		}
+		if !slices.Equal(record, want[i]) {
+			t.Errorf("row %d:\ngot  %q\nwant %q", i, record, want[i])
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"time"
+)
+
+// errBatchDeadline is the cancellation cause of a batch that ran past batch.deadline_sec
+var errBatchDeadline = errors.New(constants.ErrBatchDeadline)
+
+// withBatchDeadline bounds a batch by batch.deadline_sec, ctx is returned unchanged when it is unset
+func withBatchDeadline(ctx context.Context, cfg *config.Config) (context.Context, context.CancelFunc) {
+	if cfg.Batch.DeadlineSec <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, time.Duration(cfg.Batch.DeadlineSec)*time.Second, errBatchDeadline)
+}
+
+// batchDeadlineExceeded reports whether ctx was cancelled by the batch deadline
+func batchDeadlineExceeded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errBatchDeadline)
+}
+
+// cancelledMetrics returns the result of a device cut short by cancellation or the batch deadline
+// A device that started, result is then what it got to, keeps its IP
+func cancelledMetrics(ctx context.Context, device models.Device, result *models.MetricsResult) models.MetricsResult {
+	cancelled := models.NewMetricsError(device.ID, constants.ErrCancelled)
+	if batchDeadlineExceeded(ctx) {
+		cancelled = models.NewMetricsError(device.ID, constants.ErrBatchDeadline)
+	}
+	if result != nil {
+		cancelled.IP = device.IP
+	}
+	return cancelled
+}
+
+// cancelledDiscovery returns the result of a device cut short by cancellation or the batch deadline
+// A device that started, result is then what it got to, keeps its IP
+func cancelledDiscovery(ctx context.Context, device models.Device, result *models.DiscoveryResult) models.DiscoveryResult {
+	cancelled := models.NewDiscoveryResult(device.ID, false, constants.DiscoveryCancelled, "cancelled")
+	if batchDeadlineExceeded(ctx) {
+		cancelled = models.NewDiscoveryResult(device.ID, false, constants.DiscoveryDeadlineExceeded, "batchDeadline")
+	}
+	if result != nil {
+		cancelled.IP = device.IP
+	}
+	return cancelled
+}
+
+// cancelledCombined returns the result of a device cut short in both mode
+// Discovery that succeeded is kept and only the metrics it went on to collect are cancelled
+func cancelledCombined(ctx context.Context, device models.Device, result *models.CombinedResult) models.CombinedResult {
+	if result != nil && result.Discovery.Success {
+		metrics := cancelledMetrics(ctx, device, result.Metrics)
+		return models.NewCombinedResult(result.Discovery, &metrics)
+	}
+	var discovery *models.DiscoveryResult
+	if result != nil {
+		discovery = &result.Discovery
+	}
+	return models.NewCombinedResult(cancelledDiscovery(ctx, device, discovery), nil)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"testing"
+	"time"
+)
+
+func TestProcessMetricsBatchDeadline(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"ssh": {"max_concurrency": 1}, "batch": {"deadline_sec": 1}, "encryption": {"enabled": false}, "output": {"ordered": true},
+		"metrics": {"commands": {"hostname": "echo host1"}}}`)
+
+	// Device 1 finishes well before the deadline, device 2 is still running at it and device 3 never starts
+	devices := []models.Device{serverDevice(srv, 1), serverDevice(srv, 2), serverDevice(srv, 3)}
+	for i := 1; i < len(devices); i++ {
+		devices[i].CommandOverrides = map[string]string{"hostname": "sleep 10; echo host1"}
+	}
+
+	start := time.Now()
+	var out bytes.Buffer
+	summary, err := processMetrics(context.Background(), slices.All(devices), cfg, &out)
+	if err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("batch took %s with a 1s deadline", elapsed)
+	}
+
+	results := parseResults(t, &out)
+	if len(results) != len(devices) {
+		t.Fatalf("got %d results, want %d", len(results), len(devices))
+	}
+	if !results[0].Success {
+		t.Errorf("device 1: got %+v, want it to finish before the deadline", results[0].Metrics)
+	}
+	for _, result := range results[1:] {
+		if result.Success || result.Metrics["error"] != constants.ErrBatchDeadline {
+			t.Errorf("device %d: got %+v, want %q", result.ID, result.Metrics, constants.ErrBatchDeadline)
+		}
+	}
+
+	if summary.Total != 3 || summary.Successes != 1 || summary.Failures != 2 {
+		t.Errorf("got summary %+v, want 1 success and 2 failures of 3", summary)
+	}
+	if emitted := parseSummary(t, &out); emitted.Total != 3 {
+		t.Errorf("got emitted summary %+v, want all 3 devices counted", emitted)
+	}
+}
+
+func TestProcessDiscoveryBatchDeadline(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"ssh": {"max_concurrency": 1}, "batch": {"deadline_sec": 1}, "encryption": {"enabled": false},
+		"discovery": {"test_command": "sleep 10"}}`)
+	devices := []models.Device{serverDevice(srv, 1), serverDevice(srv, 2)}
+
+	start := time.Now()
+	var out bytes.Buffer
+	summary := processDiscovery(context.Background(), slices.All(devices), cfg, &out)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("batch took %s with a 1s deadline", elapsed)
+	}
+	if summary.Total != 2 || summary.Failures != 2 {
+		t.Errorf("got summary %+v, want 2 failures", summary)
+	}
+
+	lines := outputLines(&out)
+	for _, line := range lines[:len(lines)-1] {
+		var result models.DiscoveryResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("bad result line %q: %v", line, err)
+		}
+		if result.Code != constants.DiscoveryDeadlineExceeded || result.Step != "batchDeadline" {
+			t.Errorf("device %d: got code %q step %q, want %s at batchDeadline", result.ID, result.Code, result.Step, constants.DiscoveryDeadlineExceeded)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"ssh-plugin/config"
+	"ssh-plugin/metrics"
+	"ssh-plugin/models"
+)
+
+// dryRunReport is the JSON document printed by dry-run mode
+type dryRunReport struct {
+	Config   config.Config     `json:"config"`
+	Commands map[string]string `json:"commands"` // System type -> command line that would be executed
+	Devices  int               `json:"devices"`
+	Invalid  map[int]string    `json:"invalid,omitempty"` // Device ID -> validation or dispatch error
+}
+
+// dryRun reports what metrics mode would execute for the parsed devices without opening any connection
+func dryRun(devices []models.Device, cfg *config.Config, out io.Writer) error {
+	report := dryRunReport{
+		Config:   *cfg,
+		Commands: make(map[string]string),
+		Devices:  len(devices),
+	}
+	// Never echo the key back
+	if report.Config.Encryption.Key != "" {
+		report.Config.Encryption.Key = "REDACTED"
+	}
+	if len(report.Config.Encryption.Keys) > 0 {
+		report.Config.Encryption.Keys = slices.Repeat([]string{"REDACTED"}, len(report.Config.Encryption.Keys))
+	}
+
+	for _, device := range devices {
+		if err := device.Validate(); err != nil {
+			if report.Invalid == nil {
+				report.Invalid = make(map[int]string)
+			}
+			report.Invalid[device.ID] = err.Error()
+			continue
+		}
+
+		if _, ok := report.Commands[device.SystemType]; ok {
+			continue
+		}
+		command, err := metrics.PlannedCommand(device.SystemType, cfg)
+		if err != nil {
+			if report.Invalid == nil {
+				report.Invalid = make(map[int]string)
+			}
+			report.Invalid[device.ID] = err.Error()
+			continue
+		}
+		report.Commands[device.SystemType] = command
+	}
+
+	return json.NewEncoder(out).Encode(report)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"ssh-plugin/internal/sshtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunDoesNotConnect(t *testing.T) {
+	listener := newCountingListener(t, 0)
+	cfg := sshtest.LoadConfig(t, serveTestConfig(""))
+
+	devices := listenerDevices(t, listener.Addr().String(), 2)
+	devices[1].SystemType = "plan9"
+
+	var out bytes.Buffer
+	if err := dryRun(devices, cfg, &out); err != nil {
+		t.Fatalf("dryRun: %v", err)
+	}
+
+	// Give a stray dial time to reach the listener
+	time.Sleep(100 * time.Millisecond)
+	if _, total := listener.stats(); total != 0 {
+		t.Errorf("dry run opened %d connections, want none", total)
+	}
+
+	var report struct {
+		Config struct {
+			Encryption struct {
+				Key string `json:"key"`
+			} `json:"encryption"`
+		} `json:"config"`
+		Commands map[string]string `json:"commands"`
+		Devices  int               `json:"devices"`
+		Invalid  map[int]string    `json:"invalid"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, out.String())
+	}
+	if report.Devices != 2 {
+		t.Errorf("got %d devices, want 2", report.Devices)
+	}
+	if !strings.Contains(report.Commands["linux"], "hostname") {
+		t.Errorf("got linux command %q, want the combined metric commands", report.Commands["linux"])
+	}
+	if _, ok := report.Invalid[devices[1].ID]; !ok {
+		t.Errorf("device with an unsupported system type is not reported invalid: %v", report.Invalid)
+	}
+	if report.Config.Encryption.Key != "REDACTED" {
+		t.Errorf("got encryption key %q in the report, want it redacted", report.Config.Encryption.Key)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// runMainEnv is set when the test binary is started by runMain to run main
+const runMainEnv = "SSH_PLUGIN_TEST_RUN_MAIN"
+
+// TestRunMain is not a test of its own, it runs main in a subprocess started by runMain
+// The arguments of main follow "--" on the command line
+func TestRunMain(t *testing.T) {
+	if os.Getenv(runMainEnv) == "" {
+		t.Skip("only runs main for runMain")
+	}
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	os.Args = append([]string{"ssh-plugin"}, args...)
+	main()
+}
+
+// runMain runs main with args in a subprocess and returns its exit code and stdout
+// The subprocess inherits the environment, including the config path set by sshtest.LoadConfig
+func runMain(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestRunMain$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stdout.String()
+	}
+	if err != nil {
+		t.Fatalf("running main: %v", err)
+	}
+	return 0, stdout.String()
+}
+
+func TestMainEmptyInput(t *testing.T) {
+	for _, allowEmpty := range []bool{false, true} {
+		extra := ""
+		if allowEmpty {
+			extra = `, "batch": {"allow_empty": true}`
+		}
+
+		for _, mode := range []string{"metrics", "discovery", "both"} {
+			t.Run(mode+map[bool]string{false: "", true: " allow_empty"}[allowEmpty], func(t *testing.T) {
+				cfg := sshtest.LoadConfig(t, serveTestConfig(extra))
+				input := filepath.Join(t.TempDir(), "devices.enc")
+				if err := os.WriteFile(input, []byte(sealDevices(t, cfg, []models.Device{})), 0o600); err != nil {
+					t.Fatal(err)
+				}
+
+				code, stdout := runMain(t, mode, input)
+				if !allowEmpty {
+					if code != constants.ExitError || stdout != "" {
+						t.Errorf("got exit code %d and output %q, want %d and no output", code, stdout, constants.ExitError)
+					}
+					return
+				}
+
+				if code != constants.ExitSuccess {
+					t.Errorf("got exit code %d, want %d", code, constants.ExitSuccess)
+				}
+				var out bytes.Buffer
+				out.WriteString(stdout)
+				lines := outputLines(&out)
+				summary := parseSummary(t, &out)
+				if len(lines) != 1 || summary.Mode != mode || summary.Total != 0 {
+					t.Errorf("got output %q, want only a summary of 0 %s devices", stdout, mode)
+				}
+			})
+		}
+	}
+}
+
+func TestCollectHandlerEmptyInput(t *testing.T) {
+	for _, allowEmpty := range []bool{false, true} {
+		extra := ""
+		wantStatus := http.StatusBadRequest
+		if allowEmpty {
+			extra = `, "batch": {"allow_empty": true}`
+			wantStatus = http.StatusOK
+		}
+		cfg := sshtest.LoadConfig(t, serveTestConfig(extra))
+
+		var current atomic.Pointer[config.Config]
+		current.Store(cfg)
+		server := httptest.NewServer(collectHandler(&current))
+
+		resp, err := http.Post(server.URL, "text/plain", strings.NewReader(sealDevices(t, cfg, []models.Device{})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != wantStatus {
+			t.Errorf("allow_empty %v: got status %d, want %d", allowEmpty, resp.StatusCode, wantStatus)
+		}
+		if allowEmpty {
+			if results := readResults(t, resp); len(results) != 0 {
+				t.Errorf("got results %+v for an empty request", results)
+			}
+		}
+		resp.Body.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"ssh-plugin/compression"
+)
+
+// frameWriter groups result lines into frames of up to size results, each sealed as one output line
+// A frame's plaintext is a JSON array of results, so consumers tell it from a single result
+// (a JSON object) once the line is opened, sealing many results at once saves the per-line nonce,
+// tag and base64 padding and lets the codec compress across results
+type frameWriter struct {
+	out   io.Writer
+	size  int
+	key   []byte
+	codec compression.Codec
+	enc   *base64.Encoding
+	lines [][]byte
+}
+
+// newFrameWriter creates a writer sealing frames of size results to out with key, codec and enc
+func newFrameWriter(out io.Writer, size int, key []byte, codec compression.Codec, enc *base64.Encoding) *frameWriter {
+	return &frameWriter{out: out, size: size, key: key, codec: codec, enc: enc}
+}
+
+// Write adds one plain JSON result line to the current frame, writing the frame once it is full
+func (f *frameWriter) Write(line []byte) (int, error) {
+	f.lines = append(f.lines, bytes.Clone(bytes.TrimSuffix(line, []byte("\n"))))
+	if len(f.lines) >= f.size {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(line), nil
+}
+
+// flush seals and writes the results of a partial frame, if any
+func (f *frameWriter) flush() error {
+	if len(f.lines) == 0 {
+		return nil
+	}
+
+	plaintext := append([]byte("["), bytes.Join(f.lines, []byte(","))...)
+	plaintext = append(plaintext, ']')
+	f.lines = nil
+
+	sealed, err := sealLine(plaintext, f.key, f.codec, f.enc)
+	if err != nil {
+		return fmt.Errorf("frame error: %w", err)
+	}
+	_, err = fmt.Fprintln(f.out, sealed)
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"ssh-plugin/compression"
+	"ssh-plugin/models"
+	"testing"
+)
+
+var frameTestKey = []byte("0123456789abcdef0123456789abcdef")
+
+// frameTestLines returns n plain JSON result lines like processMetrics writes them
+func frameTestLines(t testing.TB, n int) [][]byte {
+	t.Helper()
+	lines := make([][]byte, n)
+	for i := range lines {
+		result := models.NewMetricsSuccess(i, map[string]string{
+			"hostname": fmt.Sprintf("host-%d", i),
+			"cpu":      "12.5",
+			"memory":   "3",
+			"disk":     "18G",
+			"uptime":   "up 3 days, 2 hours",
+		})
+		line, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[i] = append(line, '\n')
+	}
+	return lines
+}
+
+// perLineSize returns the bytes written when every line is sealed on its own
+func perLineSize(t testing.TB, lines [][]byte, codec compression.Codec) int {
+	t.Helper()
+	size := 0
+	for _, line := range lines {
+		sealed, err := sealLine(bytes.TrimSuffix(line, []byte("\n")), frameTestKey, codec, base64.StdEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += len(sealed) + 1
+	}
+	return size
+}
+
+// framedOutput returns what a frameWriter of the given size writes for lines
+func framedOutput(t testing.TB, lines [][]byte, size int, codec compression.Codec) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	frames := newFrameWriter(&out, size, frameTestKey, codec, base64.StdEncoding)
+	for _, line := range lines {
+		if _, err := frames.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := frames.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestFrameWriterRoundTrip(t *testing.T) {
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := frameTestLines(t, 25)
+	output := framedOutput(t, lines, 10, codec)
+
+	var ids []int
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	frames := 0
+	for scanner.Scan() {
+		frames++
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := openGCM(frameTestKey, sealed, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := codec.Decode(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A frame opens to a JSON array, telling it apart from a single result
+		var results []models.MetricsResult
+		if err := json.Unmarshal(plaintext, &results); err != nil {
+			t.Fatalf("frame %d is not a JSON array: %v", frames, err)
+		}
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+	}
+
+	if frames != 3 {
+		t.Errorf("got %d frames, want 3", frames)
+	}
+	if len(ids) != len(lines) {
+		t.Fatalf("got %d results, want %d", len(ids), len(lines))
+	}
+	for i, id := range ids {
+		if id != i {
+			t.Errorf("result %d has id %d, results must keep their order", i, id)
+		}
+	}
+}
+
+func TestFrameWriterSmallerThanPerLine(t *testing.T) {
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := frameTestLines(t, 100)
+
+	perLine := perLineSize(t, lines, codec)
+	framed := len(framedOutput(t, lines, 50, codec))
+	if framed >= perLine {
+		t.Errorf("framed output is %d bytes, per-line output %d, framing should be smaller", framed, perLine)
+	}
+}
+
+func BenchmarkFrameWriter(b *testing.B) {
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := frameTestLines(b, 1000)
+
+	b.Run("per_line", func(b *testing.B) {
+		size := 0
+		for b.Loop() {
+			size = perLineSize(b, lines, codec)
+		}
+		b.ReportMetric(float64(size)/float64(len(lines)), "bytes/result")
+	})
+
+	for _, frameSize := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("frame_%d", frameSize), func(b *testing.B) {
+			size := 0
+			for b.Loop() {
+				size = len(framedOutput(b, lines, frameSize, codec))
+			}
+			b.ReportMetric(float64(size)/float64(len(lines)), "bytes/result")
+		})
+	}
+}
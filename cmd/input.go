@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"strings"
+	"sync"
+)
+
+// deviceStream yields the devices to process from the inputs named by a spec, in input order
+// A single input is decoded as it is ranged over so processing starts before it is fully parsed,
+// several inputs are read and merged by readInputs up front
+// CIDR devices are expanded and the tag filter applied as devices are yielded
+type deviceStream struct {
+	cfg     *config.Config
+	payload io.ReadCloser   // Decrypted payload of a single input
+	devices []models.Device // Merged devices of several inputs
+	err     error
+}
+
+// openDeviceStream opens the inputs named by spec as readInputs does
+// Unreadable or undecryptable inputs are reported here, malformed JSON only once ranged over
+func openDeviceStream(spec string, cfg *config.Config) (*deviceStream, error) {
+	path := spec
+	if spec != "-" {
+		paths, err := expandInputPaths(spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) > 1 {
+			devices, err := readInputs(spec, cfg)
+			if err != nil {
+				return nil, err
+			}
+			return &deviceStream{cfg: cfg, devices: devices}, nil
+		}
+		path = paths[0]
+	}
+
+	input := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		// The payload is decrypted in memory, the file is not needed once it is open
+		defer file.Close()
+		input = file
+	}
+
+	payload, err := openPayload(input, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceStream{cfg: cfg, payload: payload}, nil
+}
+
+// All yields every device with its position, it may only be ranged over once
+func (s *deviceStream) All() iter.Seq2[int, models.Device] {
+	return func(yield func(int, models.Device) bool) {
+		index, skipped := 0, 0
+		matchAll := s.cfg.Filter.Match == "all"
+		emit := func(device models.Device) bool {
+			expanded, err := models.ExpandCIDRDevices([]models.Device{device}, constants.MaxCIDRHosts)
+			if err != nil {
+				s.err = err
+				return false
+			}
+			for _, host := range expanded {
+				if !host.HasTags(s.cfg.Filter.Tags, matchAll) {
+					skipped++
+					continue
+				}
+				if !yield(index, host) {
+					return false
+				}
+				index++
+			}
+			return true
+		}
+
+		if s.payload != nil {
+			if err := decodeDevices(s.payload, emit); err != nil {
+				s.err = err
+			}
+		}
+		for _, device := range s.devices {
+			if !emit(device) {
+				break
+			}
+		}
+
+		if skipped > 0 {
+			slog.Info("Skipping devices not matching the tag filter", "skipped", skipped, "tags", s.cfg.Filter.Tags, "match", s.cfg.Filter.Match)
+		}
+	}
+}
+
+// Err returns the error that ended ranging over All early, if any
+func (s *deviceStream) Err() error {
+	return s.err
+}
+
+// Close releases the decrypted payload
+func (s *deviceStream) Close() error {
+	if s.payload == nil {
+		return nil
+	}
+	return s.payload.Close()
+}
+
+// peekDevices reports whether devices yields anything, returning a sequence that still yields every device
+func peekDevices(devices iter.Seq2[int, models.Device]) (iter.Seq2[int, models.Device], bool) {
+	next, stop := iter.Pull2(devices)
+	first, device, ok := next()
+	if !ok {
+		stop()
+		return nil, false
+	}
+
+	return func(yield func(int, models.Device) bool) {
+		defer stop()
+		for i, d := first, device; ok; i, d, ok = next() {
+			if !yield(i, d) {
+				return
+			}
+		}
+	}, true
+}
+
+// decodeDevices decodes devices from r one at a time, passing each to yield until it returns false
+// The input is either a JSON array of devices or newline-delimited device objects (NDJSON)
+func decodeDevices(r io.Reader, yield func(models.Device) bool) error {
+	reader := bufio.NewReader(r)
+	array, err := startsWithArray(reader)
+	if err != nil {
+		return fmt.Errorf("failed to decode devices: %w", err)
+	}
+
+	decoder := json.NewDecoder(reader)
+	if array {
+		// Consume the opening bracket, the closing one is checked after the last device
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to decode devices: %w", err)
+		}
+	}
+
+	for {
+		if array && !decoder.More() {
+			break
+		}
+		var device models.Device
+		if err := decoder.Decode(&device); err != nil {
+			if err == io.EOF && !array {
+				break
+			}
+			return fmt.Errorf("failed to decode devices: %w", err)
+		}
+		if !yield(device) {
+			return nil
+		}
+	}
+
+	if array {
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to decode devices: %w", err)
+		}
+	}
+	return nil
+}
+
+// startsWithArray reports whether the first non-space byte of r opens a JSON array, without consuming it
+// Empty input is neither an array nor an error
+func startsWithArray(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.Discard(1)
+		default:
+			return b[0] == '[', nil
+		}
+	}
+}
+
+// readInputs reads and merges the devices of every input named by spec
+// spec is "-" for stdin, or a comma-separated list of file paths and glob patterns
+// Files are read concurrently and merged in the order given, a device ID already seen
+// in an earlier file is reported and skipped
+func readInputs(spec string, cfg *config.Config) ([]models.Device, error) {
+	if spec == "-" {
+		return readDevices(spec, cfg)
+	}
+
+	paths, err := expandInputPaths(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 1 {
+		return readDevices(paths[0], cfg)
+	}
+
+	// Decrypt the shards concurrently, each goroutine owns one slot
+	shards := make([][]models.Device, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			shards[i], errs[i] = readDevices(path, cfg)
+		}(i, path)
+	}
+	wg.Wait()
+
+	var devices []models.Device
+	seenIn := make(map[int]string)
+	for i, path := range paths {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s: %w", path, errs[i])
+		}
+
+		// Duplicates within one file are kept, CIDR entries may legitimately share an ID
+		for _, device := range shards[i] {
+			if first, ok := seenIn[device.ID]; ok && first != path {
+				slog.Warn("Skipping duplicate device ID", "device_id", device.ID, "file", path, "first_file", first)
+				continue
+			}
+			seenIn[device.ID] = path
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+// expandInputPaths splits spec on commas and expands glob patterns
+// A pattern matching no file is an error, plain paths are returned as given
+func expandInputPaths(spec string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		matches := []string{part}
+		if strings.ContainsAny(part, "*?[") {
+			var err error
+			matches, err = filepath.Glob(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid input pattern %q: %w", part, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no input files match %q", part)
+			}
+		}
+
+		for _, path := range matches {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no input files given")
+	}
+	return paths, nil
+}
+
+// filterDevices keeps the devices selected by filter.tags, the others are skipped without a result
+func filterDevices(devices []models.Device, cfg *config.Config) []models.Device {
+	filtered := models.FilterByTags(devices, cfg.Filter.Tags, cfg.Filter.Match == "all")
+	if skipped := len(devices) - len(filtered); skipped > 0 {
+		slog.Info("Skipping devices not matching the tag filter", "skipped", skipped, "tags", cfg.Filter.Tags, "match", cfg.Filter.Match)
+	}
+	return filtered
+}
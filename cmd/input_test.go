@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+)
+
+// writeInput writes devices as an encrypted input file in dir and returns its path
+func writeInput(t *testing.T, cfg *config.Config, dir, name string, devices []models.Device) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(sealDevices(t, cfg, devices)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenDeviceStreamMergesFiles(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, serveTestConfig(`, "metrics": {"commands": {"hostname": "echo host1"}}`))
+
+	dir := t.TempDir()
+	first := writeInput(t, cfg, dir, "shard-1.enc", []models.Device{serverDevice(srv, 1), serverDevice(srv, 2)})
+	// Device 2 is also in the first shard, only that one is kept
+	second := writeInput(t, cfg, dir, "shard-2.enc", []models.Device{serverDevice(srv, 2), serverDevice(srv, 3)})
+
+	for name, spec := range map[string]string{
+		"list": first + "," + second,
+		"glob": filepath.Join(dir, "shard-*.enc"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			stream, err := openDeviceStream(spec, cfg)
+			if err != nil {
+				t.Fatalf("openDeviceStream: %v", err)
+			}
+			defer stream.Close()
+
+			var out bytes.Buffer
+			summary, err := processMetrics(context.Background(), stream.All(), cfg, &out)
+			if err != nil {
+				t.Fatalf("processMetrics: %v", err)
+			}
+			if summary.Total != 3 || summary.Successes != 3 {
+				t.Errorf("got summary %+v, want 3 successful devices", summary)
+			}
+
+			var ids []int
+			for _, result := range parseResults(t, &out) {
+				ids = append(ids, result.ID)
+			}
+			sort.Ints(ids)
+			if !slices.Equal(ids, []int{1, 2, 3}) {
+				t.Errorf("got results for devices %v, want 1, 2 and 3 once each", ids)
+			}
+		})
+	}
+}
+
+func TestExpandInputPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.enc", "b.enc"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := filepath.Join(dir, "a.enc"), filepath.Join(dir, "b.enc")
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{"single", a, []string{a}, false},
+		{"list", a + ", " + b, []string{a, b}, false},
+		{"glob", filepath.Join(dir, "*.enc"), []string{a, b}, false},
+		{"repeated", a + "," + filepath.Join(dir, "*.enc"), []string{a, b}, false},
+		{"glob without match", filepath.Join(dir, "*.json"), nil, true},
+		{"empty", " , ", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandInputPaths(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got paths %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandInputPaths: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got paths %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceStreamTagFilter(t *testing.T) {
+	devices := []models.Device{
+		{ID: 1, IP: "10.0.0.1", Tags: []string{"prod", "web"}},
+		{ID: 2, IP: "10.0.0.2", Tags: []string{"prod", "db"}},
+		{ID: 3, IP: "10.0.0.3", Tags: []string{"staging", "web"}},
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		want   []int
+	}{
+		{"any", `{"tags": ["db", "staging"]}`, []int{2, 3}},
+		{"all", `{"tags": ["prod", "web"], "match": "all"}`, []int{1}},
+		{"none", `{}`, []int{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := sshtest.LoadConfig(t, serveTestConfig(`, "filter": `+tt.filter))
+			path := writeInput(t, cfg, t.TempDir(), "devices.enc", devices)
+
+			stream, err := openDeviceStream(path, cfg)
+			if err != nil {
+				t.Fatalf("openDeviceStream: %v", err)
+			}
+			defer stream.Close()
+
+			var got []int
+			for _, device := range stream.All() {
+				got = append(got, device.ID)
+			}
+			if err := stream.Err(); err != nil {
+				t.Fatalf("stream: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got devices %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// generatedDevices is a reader producing count devices as JSON on the fly, so the input never exists in memory as a whole
+type generatedDevices struct {
+	count, next int
+	array       bool
+	buf         bytes.Buffer
+	read        int64
+}
+
+func (g *generatedDevices) Read(p []byte) (int, error) {
+	for g.buf.Len() < len(p) && g.next <= g.count {
+		switch {
+		case g.next == g.count:
+			if g.array {
+				g.buf.WriteString("]\n")
+			}
+		case g.array && g.next == 0:
+			g.buf.WriteString("[\n")
+			fallthrough
+		default:
+			if g.array && g.next > 0 {
+				g.buf.WriteString(",\n")
+			}
+			fmt.Fprintf(&g.buf, `{"id": %d, "ip": "10.%d.%d.%d", "port": 22, "system_type": "linux", "tags": ["prod", "rack-%d"], "credentials": {"username": "monitor", "password": "secret-%08d"}}`,
+				g.next+1, g.next>>16&255, g.next>>8&255, g.next&255, g.next%40, g.next)
+			if !g.array {
+				g.buf.WriteByte('\n')
+			}
+		}
+		g.next++
+	}
+	if g.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	n, _ := g.buf.Read(p)
+	g.read += int64(n)
+	return n, nil
+}
+
+func TestDecodeDevicesStreams(t *testing.T) {
+	const count = 100_000
+
+	for _, array := range []bool{false, true} {
+		name := "ndjson"
+		if array {
+			name = "array"
+		}
+		t.Run(name, func(t *testing.T) {
+			input := &generatedDevices{count: count, array: array}
+
+			runtime.GC()
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			baseline, peak := stats.HeapAlloc, stats.HeapAlloc
+
+			decoded := 0
+			var readAtFirst int64
+			err := decodeDevices(input, func(device models.Device) bool {
+				decoded++
+				if decoded == 1 {
+					readAtFirst = input.read
+				}
+				if device.ID != decoded {
+					t.Fatalf("got device %d at position %d", device.ID, decoded)
+				}
+				if decoded%5000 == 0 {
+					runtime.ReadMemStats(&stats)
+					peak = max(peak, stats.HeapAlloc)
+				}
+				return true
+			})
+			if err != nil {
+				t.Fatalf("decodeDevices: %v", err)
+			}
+			if decoded != count {
+				t.Fatalf("got %d devices, want %d", decoded, count)
+			}
+
+			// Processing starts long before the whole input is read
+			if readAtFirst > input.read/100 {
+				t.Errorf("first device yielded after %d of %d bytes were read", readAtFirst, input.read)
+			}
+			// Decoding the input as a whole would hold all of it, streaming keeps a small window
+			if grown := int64(peak - baseline); grown > input.read/2 {
+				t.Errorf("heap grew by %d bytes while streaming %d bytes of input", grown, input.read)
+			}
+		})
+	}
+}
+
+func TestDecodeDevicesStopsEarly(t *testing.T) {
+	input := &generatedDevices{count: 100_000}
+	decoded := 0
+	err := decodeDevices(input, func(models.Device) bool {
+		decoded++
+		return decoded < 10
+	})
+	if err != nil || decoded != 10 {
+		t.Errorf("got %d devices, %v, want decoding to stop after 10", decoded, err)
+	}
+	if input.next >= input.count {
+		t.Error("the whole input was generated after decoding stopped")
+	}
+}
+
+func TestDecodeDevicesMalformed(t *testing.T) {
+	var ids []int
+	err := decodeDevices(strings.NewReader("{\"id\": 1}\n{\"id\": 2}\n{\"id\": \n{\"id\": 4}\n"), func(device models.Device) bool {
+		ids = append(ids, device.ID)
+		return true
+	})
+	if err == nil {
+		t.Error("got no error for a malformed device")
+	}
+	if !slices.Equal(ids, []int{1, 2}) {
+		t.Errorf("got devices %v before the malformed one, want 1 and 2", ids)
+	}
+}
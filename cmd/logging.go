@@ -0,0 +1,12 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// newLogger returns a logger writing JSON lines with level and msg fields to stderr
+// Records below level are dropped
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"slices"
+	"ssh-plugin/internal/sshtest"
+	"testing"
+)
+
+// captureStderr redirects os.Stderr while fn runs and returns what was written
+func captureStderr(t *testing.T, fn func()) []byte {
+	t.Helper()
+	path := t.TempDir() + "/stderr"
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stderr := os.Stderr
+	os.Stderr = file
+	defer func() { os.Stderr = stderr }()
+	fn()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLoggerWritesJSON(t *testing.T) {
+	tests := []struct {
+		level    string
+		wantMsgs []string
+	}{
+		{"debug", []string{"checking device", "device failed"}},
+		{"error", []string{"device failed"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			cfg := sshtest.LoadConfig(t, `{"log": {"level": "`+tt.level+`"}}`)
+			level, err := cfg.LogLevel()
+			if err != nil {
+				t.Fatalf("LogLevel: %v", err)
+			}
+
+			stderr := captureStderr(t, func() {
+				logger := newLogger(level)
+				logger.Debug("checking device", "device_id", 7)
+				logger.Error("device failed", "device_id", 7)
+			})
+
+			var msgs []string
+			scanner := bufio.NewScanner(bytes.NewReader(stderr))
+			for scanner.Scan() {
+				var record struct {
+					Level    string `json:"level"`
+					Msg      string `json:"msg"`
+					DeviceID int    `json:"device_id"`
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					t.Fatalf("stderr line is not JSON: %v\n%s", err, scanner.Text())
+				}
+				if record.Level == "" || record.DeviceID != 7 {
+					t.Errorf("got record %+v, want level and device_id fields", record)
+				}
+				msgs = append(msgs, record.Msg)
+			}
+			if !slices.Equal(msgs, tt.wantMsgs) {
+				t.Errorf("got messages %q, want %q", msgs, tt.wantMsgs)
+			}
+		})
+	}
+}
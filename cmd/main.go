@@ -1,122 +1,285 @@
 package main
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"github.com/golang/snappy"
-	"log"
+	"io"
+	"iter"
+	"log/slog"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"slices"
+	"ssh-plugin/compression"
 	"ssh-plugin/discovery"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/random"
 	"ssh-plugin/metrics"
 	"ssh-plugin/models"
-	"sync"
+	"syscall"
 
 	"ssh-plugin/config"
 )
 
 // main is the entry point for the plugin
-// It reads JSON input from a file specified as a command-line argument,
+// It reads JSON input from the files specified as a command-line argument (or stdin when omitted or "-"),
+// several files are given as a comma-separated list of paths or glob patterns and merged,
 // processes devices concurrently based on mode and system type,
-// and streams JSON results to stdout as they arrive
+// and streams JSON results to stdout (or the output path given as third argument) as they arrive
+// Dry-run mode prints the metrics commands that would run without connecting to any device
+// In serve mode it instead keeps running and collects metrics per HTTP request
+// Selftest mode checks the configuration and prints a JSON report
 // Panics are caught to prevent process crashes
 func main() {
 
-	log.SetOutput(os.Stderr)
+	// Log JSON lines to stderr, the level is applied once the configuration is loaded
+	slog.SetDefault(newLogger(slog.LevelInfo))
 
 	// Recover from panics in main
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Fatal panic: %v, stack: %s\n", r, string(debug.Stack()))
-			os.Exit(1)
+			slog.Error("Fatal panic", "panic", r, "stack", string(debug.Stack()))
+			os.Exit(constants.ExitError)
 		}
 	}()
 
 	// Check command-line arguments
-	if len(os.Args) != 3 {
-		log.Printf("Usage: %s <mode> <file_path>\n", os.Args[0])
-		os.Exit(1)
+	if len(os.Args) < 2 || len(os.Args) > 4 {
+		slog.Error("Invalid arguments", "usage", fmt.Sprintf("%s <mode> [file_path[,file_path...]|glob|-] [output_path|-] | %s serve [listen_addr] | %s selftest [ssh_host:port]", os.Args[0], os.Args[0], os.Args[0]))
+		os.Exit(constants.ExitError)
 	}
 
 	mode := os.Args[1]
-	filePath := os.Args[2]
+	filePath := "-"
+	if len(os.Args) >= 3 {
+		filePath = os.Args[2]
+	}
+
+	// Self-test loads the configuration itself so a broken one is reported, not fatal
+	if mode == "selftest" {
+		sshAddr := ""
+		if len(os.Args) >= 3 {
+			sshAddr = os.Args[2]
+		}
+		if !selfTest(sshAddr, os.Stdout) {
+			os.Exit(constants.ExitError)
+		}
+		os.Exit(constants.ExitSuccess)
+	}
 
 	// Load configuration
 	cfg, err := config.LoadConfig()
 	if err != nil {
-		log.Printf("Failed to load configuration: %v\n", err)
-		os.Exit(1)
+		slog.Error("Failed to load configuration", "error", err)
+		os.Exit(constants.ExitError)
 	}
 
-	// Read devices from file
-	devices, err := decryptAndDecompressFile(filePath, cfg)
+	level, err := cfg.LogLevel()
 	if err != nil {
-		log.Printf("Error reading devices: %v\n", err)
-		os.Exit(1)
+		slog.Error("Invalid log level", "error", err)
+		os.Exit(constants.ExitError)
+	}
+	slog.SetDefault(newLogger(level))
+
+	// A deterministic build repeats its nonces across runs, it must never handle real data
+	if random.Deterministic {
+		slog.Warn("DETERMINISTIC TEST BUILD: nonces and tokens repeat across runs, encrypted output is not secure, do not use in production")
+	}
+
+	// Serve mode reads devices per request, the optional argument is the listen address
+	if mode == "serve" {
+		listenAddr := cfg.Serve.Addr
+		if len(os.Args) >= 3 {
+			listenAddr = os.Args[2]
+		}
+		if err := serve(listenAddr, cfg); err != nil {
+			slog.Error("Server error", "error", err)
+			os.Exit(constants.ExitError)
+		}
+		os.Exit(constants.ExitSuccess)
+	}
+
+	// Read devices from the input files or stdin, a single input is decoded while devices are processed
+	stream, err := openDeviceStream(filePath, cfg)
+	if err != nil {
+		slog.Error("Error reading devices", "error", err)
+		os.Exit(constants.ExitError)
 	}
 
 	// Validate input
-	if len(devices) == 0 {
-		log.Printf("No devices provided in input\n")
-		os.Exit(1)
+	devices, ok := peekDevices(stream.All())
+	if !ok {
+		if err := stream.Err(); err != nil {
+			slog.Error("Error reading devices", "error", err)
+			os.Exit(constants.ExitError)
+		}
+		if !cfg.Batch.AllowEmpty {
+			slog.Error("No devices provided in input")
+			os.Exit(constants.ExitError)
+		}
+		// An empty batch still writes its summary line
+		devices = slices.All([]models.Device(nil))
+	}
+
+	// Open the results destination, the command-line argument wins over config
+	outputPath := cfg.Output.Path
+	if len(os.Args) == 4 {
+		outputPath = os.Args[3]
+	}
+
+	out, err := openOutput(outputPath, cfg)
+	if err != nil {
+		slog.Error("Error opening output", "error", err)
+		os.Exit(constants.ExitError)
 	}
 
+	// Cancel in-flight work on SIGINT or SIGTERM so devices report an error instead of hanging
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Process devices and stream results
+	exitCode := constants.ExitSuccess
 	switch mode {
 	case "metrics":
-		processMetrics(devices, cfg)
+		exitCode = batchExitCode(processMetrics(ctx, devices, cfg, out))
 	case "discovery":
-		processDiscovery(devices, cfg)
+		exitCode = batchExitCode(processDiscovery(ctx, devices, cfg, out), nil)
+	case "both":
+		exitCode = batchExitCode(processBoth(ctx, devices, cfg, out))
+	case "dry-run":
+		var planned []models.Device
+		for _, device := range devices {
+			planned = append(planned, device)
+		}
+		if err := dryRun(planned, cfg, out); err != nil {
+			slog.Error("Error writing dry-run report", "error", err)
+		}
 	default:
-		log.Printf("Unknown mode: %s\n", mode)
-		os.Exit(1)
+		out.Close()
+		slog.Error("Unknown mode", "mode", mode)
+		os.Exit(constants.ExitError)
 	}
 
-	// Exit with success (0) unless a critical failure occurred
-	os.Exit(0)
+	if err := out.Close(); err != nil {
+		slog.Error("Error flushing output", "error", err)
+		os.Exit(constants.ExitError)
+	}
+
+	// A malformed device ends the input early, the devices before it were still processed
+	stream.Close()
+	if err := stream.Err(); err != nil {
+		slog.Error("Error reading devices", "error", err)
+		os.Exit(constants.ExitError)
+	}
+
+	// Exit code reflects the batch outcome, see constants.Exit*
+	os.Exit(exitCode)
 }
 
-// readDevicesFromFile reads devices from a file, handling compression and encryption
-func decryptAndDecompressFile(filePath string, cfg *config.Config) ([]models.Device, error) {
+// batchExitCode maps a batch summary to the process exit code
+func batchExitCode(summary models.BatchSummary, err error) int {
+	// A batch that could not start is a configuration or output problem, not a device failure
+	if err != nil {
+		slog.Error("Batch not processed", "error", err)
+		return constants.ExitError
+	}
+
+	switch {
+	case summary.Failures == 0:
+		return constants.ExitSuccess
+	case summary.Successes == 0:
+		return constants.ExitAllFailed
+	default:
+		return constants.ExitPartialFailure
+	}
+}
 
-	// Step 0: check if the key exists in config
-	keyHex := cfg.Encryption.Key
-	if keyHex == "" {
-		return nil, fmt.Errorf("encryption key not found in config")
+// readDevices reads devices from a file path, or from stdin when the path is "-"
+func readDevices(filePath string, cfg *config.Config) ([]models.Device, error) {
+	if filePath == "-" {
+		return decryptAndDecompress(os.Stdin, cfg)
 	}
 
-	// Step 1: Read Base64-encoded content
-	base64Content, err := os.ReadFile(filePath)
+	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
+	defer file.Close()
+
+	return decryptAndDecompress(file, cfg)
+}
+
+// decryptAndDecompress reads devices from r, handling compression and encryption
+// Empty input yields no devices rather than an error
+func decryptAndDecompress(r io.Reader, cfg *config.Config) ([]models.Device, error) {
+	payload, err := openPayload(r, cfg)
+	if err != nil || payload == nil {
+		return nil, err
+	}
+	defer payload.Close()
+
+	var devices []models.Device
+	err = decodeDevices(payload, func(device models.Device) bool {
+		devices = append(devices, device)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// openPayload decrypts the input read from r and returns a reader decompressing it
+// AES-GCM authenticates the whole payload, so it is decrypted before any of it is returned
+// Empty input returns a nil reader rather than an error
+func openPayload(r io.Reader, cfg *config.Config) (io.ReadCloser, error) {
+
+	// Step 0: check the keys exist in config and have a valid AES length
+	keys, err := cfg.DecryptionKeys()
+	if err != nil {
+		return nil, err
+	}
 
-	// Step 2: Decode Base64
-	decodedBytes, err := base64.StdEncoding.DecodeString(string(base64Content))
+	// Step 1: Read and decode the Base64 content
+	decodedBytes, err := io.ReadAll(base64.NewDecoder(cfg.Base64Encoding(), r))
 	if err != nil {
 		return nil, fmt.Errorf("base64 decode error: %w", err)
 	}
 
-	if len(decodedBytes) < 12 {
-		return nil, fmt.Errorf("data too short: missing nonce")
+	if len(decodedBytes) == 0 {
+		return nil, nil
 	}
 
-	// Step 3: Extract nonce and ciphertext
-	nonce := decodedBytes[:12]
-	ciphertext := decodedBytes[12:]
+	// Step 2: AES-GCM decryption, trying each key until one authenticates the payload
+	var compressed []byte
+	for i, key := range keys {
+		// Only the last attempt decrypts in place, a failed Open clears its output
+		last := i == len(keys)-1
+		compressed, err = openGCM(key, decodedBytes, last)
+		if err == nil || last {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// Step 4: Decode AES key
-	key, err := hex.DecodeString(keyHex)
+	// Step 3: Decompress with the codec the payload was written with
+	codec := compression.Detect(compressed)
+	payload, err := codec.NewReader(compressed)
 	if err != nil {
-		return nil, fmt.Errorf("invalid hex key: %w", err)
+		return nil, fmt.Errorf("%s decompress failed: %w", codec.Name(), err)
 	}
+	return payload, nil
+}
 
-	// Step 5: AES-GCM decryption
+// openGCM splits data into nonce and ciphertext and decrypts it with key
+// With inPlace the plaintext overwrites the ciphertext, saving a copy of the payload
+func openGCM(key []byte, data []byte, inPlace bool) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("AES cipher creation failed: %w", err)
@@ -127,158 +290,186 @@ func decryptAndDecompressFile(filePath string, cfg *config.Config) ([]models.Dev
 		return nil, fmt.Errorf("GCM mode failed: %w", err)
 	}
 
-	compressed, err := aesgcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("AES-GCM decryption failed: %w", err)
+	// The ciphertext holds at least the authentication tag
+	nonceSize := aesgcm.NonceSize()
+	if len(data) < nonceSize+aesgcm.Overhead() {
+		return nil, fmt.Errorf("data too short: %d bytes, expected a %d-byte nonce and a %d-byte tag", len(data), nonceSize, aesgcm.Overhead())
 	}
+	nonce := data[:nonceSize]
+	ciphertext := data[nonceSize:]
 
-	// Step 6: Snappy decompress
-	decompressed, err := snappy.Decode(nil, compressed)
-	if err != nil {
-		return nil, fmt.Errorf("snappy decompress failed: %w", err)
+	var dst []byte
+	if inPlace {
+		dst = ciphertext[:0]
 	}
-
-	// Step 7: Parse JSON
-	var devices []models.Device
-	if err := json.Unmarshal(decompressed, &devices); err != nil {
-		return nil, fmt.Errorf("JSON unmarshal failed: %w", err)
+	plaintext, err := aesgcm.Open(dst, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("AES-GCM decryption failed: %w", err)
 	}
-
-	return devices, nil
+	return plaintext, nil
 }
 
 // processMetrics processes devices concurrently for metrics collection,
-// dispatching based on system type and streaming results to stdout
-func processMetrics(devices []models.Device, cfg *config.Config) {
+// dispatching based on system type and streaming results to out
+// Devices not finished when ctx is cancelled report a cancellation error
+// A summary line follows the last result and is also returned,
+// an unusable key, codec or output fails the batch with an error before any device is processed
+func processMetrics(ctx context.Context, devices iter.Seq2[int, models.Device], cfg *config.Config, out io.Writer) (models.BatchSummary, error) {
+	// A nil key disables encryption and results are emitted as plain JSON
+	var key []byte
+	if cfg.EncryptionEnabled() {
+		var err error
+		key, err = cfg.EncryptionKey()
+		if err != nil {
+			return models.BatchSummary{}, fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
 
-	key, err := hex.DecodeString(cfg.Encryption.Key)
+	codec, err := compression.GetCodec(cfg.Compression.Codec)
 	if err != nil {
-		log.Printf("Invalid encryption key: %v\n", err)
-		return
+		return models.BatchSummary{}, fmt.Errorf("invalid compression codec: %w", err)
 	}
-
-	// Channel to receive results
-	resultChan := make(chan models.MetricsResult, len(devices))
-
-	var wg sync.WaitGroup
-	var outputWg sync.WaitGroup // WaitGroup for the output Goroutine
-
-	// Start a Goroutine to stream results as JSON
-	outputWg.Add(1)
-	go func() {
-		// Ensure the output Goroutine signals completion
-		defer outputWg.Done()
-		// Recover from panics in the output Goroutine
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Panic in output goroutine: %v, stack: %s\n", r, string(debug.Stack()))
+	enc := cfg.Base64Encoding()
+
+	// CSV output starts with a header row covering every metric the collectors know and the filters keep
+	// Column names carry the key prefix like the results do
+	var csvEnc *csvEncoder
+	if cfg.Output.Format == "csv" {
+		var columns []string
+		for _, name := range metrics.KnownMetricNames(cfg) {
+			if models.MetricAllowed(name, cfg.Metrics.Include, cfg.Metrics.Exclude) {
+				columns = append(columns, cfg.Metrics.KeyPrefix+name)
 			}
-		}()
-
-		for result := range resultChan {
-			encoded, err := encodeResult(result, key)
-			if err != nil {
-				log.Printf("Error encoding result for device %d: %v\n", result.ID, err)
-				continue
+		}
+		csvEnc = newCSVEncoder(columns)
+		header, err := csvEnc.header()
+		if err == nil {
+			var line string
+			line, err = sealLine(header, key, codec, enc)
+			if err == nil {
+				_, err = fmt.Fprintln(out, line)
 			}
-			fmt.Println(string(encoded))
 		}
-	}()
-
-	// Process each device in a Goroutine
-	for _, device := range devices {
-		wg.Add(1)
-		go func(dev models.Device) {
-			defer wg.Done()
-			// Recover from panics in the processing Goroutine
-			defer func() {
-				if r := recover(); r != nil {
-					resultChan <- models.NewMetricsError(dev.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
-				}
-			}()
-
-			// Dispatch based on system type
-			collector := metrics.GetMetricsCollector(dev.SystemType)
-			result := collector.Collect(dev, cfg.GetSSHTimeout())
-			resultChan <- result
-		}(device)
+		if err != nil {
+			return models.BatchSummary{}, fmt.Errorf("error writing CSV header: %w", err)
+		}
 	}
 
-	// Wait for all device-processing Goroutines to complete
-	wg.Wait()
+	// Framed output seals groups of results, until then they are carried as plain JSON
+	resultOut, resultKey := io.Writer(out), key
+	var framer *frameWriter
+	if cfg.Output.FrameSize > 1 && csvEnc == nil {
+		framer = newFrameWriter(out, cfg.Output.FrameSize, key, codec, enc)
+		resultOut, resultKey = framer, nil
+	}
 
-	close(resultChan)
-	// Wait for the output Goroutine to finish printing
-	outputWg.Wait()
-}
+	// Devices of the same system type share a collector for the batch
+	collectors := metrics.NewCollectorSet()
 
-// processDiscovery processes devices concurrently for SSH discovery,
-// dispatching based on system type and streaming results to stdout
-func processDiscovery(devices []models.Device, cfg *config.Config) {
-
-	// Channel to receive results
-	resultChan := make(chan models.DiscoveryResult, len(devices))
-
-	var wg sync.WaitGroup
-	var outputWg sync.WaitGroup // WaitGroup for the output Goroutine
-
-	// Start a Goroutine to stream results as JSON
-	outputWg.Add(1)
-	go func() {
-		// Ensure the output Goroutine signals completion
-		defer outputWg.Done()
-		// Recover from panics in the output Goroutine
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Panic in output goroutine: %v, stack: %s\n", r, string(debug.Stack()))
+	summary := runBatch(ctx, devices, cfg, batchJob[models.MetricsResult]{
+		mode: "metrics",
+		process: func(ctx context.Context, dev models.Device) models.MetricsResult {
+			// Dispatch based on system type
+			collector := collectors.Get(dev.SystemType)
+			result := collector.Collect(ctx, dev, cfg.DeviceTimeout(dev.TimeoutSec))
+			result = result.SelectMetrics(cfg.Metrics.Include, cfg.Metrics.Exclude).PrefixMetrics(cfg.Metrics.KeyPrefix)
+			result.IP = dev.IP
+			return result
+		},
+		succeeded: func(result models.MetricsResult) bool { return result.Success },
+		invalid: func(dev models.Device, err error) models.MetricsResult {
+			return models.NewMetricsError(dev.ID, err.Error())
+		},
+		panicked: func(dev models.Device, msg string) models.MetricsResult {
+			return models.NewMetricsError(dev.ID, msg)
+		},
+		cancelled: cancelledMetrics,
+		encode: func(result models.MetricsResult) (string, error) {
+			if csvEnc != nil {
+				return encodeCSVResult(csvEnc, result, key, codec, enc)
 			}
-		}()
+			return encodeResult(result, resultKey, codec, enc)
+		},
+	}, resultOut)
 
-		for result := range resultChan {
-			// Marshal the result to JSON
-			output, err := json.Marshal(result)
-			if err != nil {
-				log.Printf("Error encoding result for device %d: %v\n", result.ID, err)
-				continue
-			}
-			fmt.Println(string(output))
+	if framer != nil {
+		if err := framer.flush(); err != nil {
+			slog.Error("Error writing result frame", "error", err)
 		}
-	}()
+	}
+	// Release state collectors kept during the batch, such as cached SSH clients
+	if err := collectors.Close(); err != nil {
+		slog.Error("Error closing metrics collectors", "error", err)
+	}
 
-	// Process each device in a Goroutine
-	for _, device := range devices {
-		wg.Add(1)
-		go func(dev models.Device) {
-			defer wg.Done()
-			// Recover from panics in the processing Goroutine
-			defer func() {
-				if r := recover(); r != nil {
-					resultChan <- models.NewDiscoveryResult(dev.ID, false, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
-				}
-			}()
+	// A JSON summary line would break CSV output, it is logged instead
+	if csvEnc != nil {
+		slog.Info("Batch finished", "mode", summary.Mode, "total", summary.Total, "successes", summary.Successes, "failures", summary.Failures, "elapsed_ms", summary.ElapsedMs)
+		return summary, nil
+	}
+	writeSummary(out, summary, key, codec, enc)
+	return summary, nil
+}
 
+// processDiscovery processes devices concurrently for SSH discovery,
+// dispatching based on system type and streaming results to out
+// Devices not finished when ctx is cancelled report a cancellation error
+// A summary line follows the last result and is also returned
+func processDiscovery(ctx context.Context, devices iter.Seq2[int, models.Device], cfg *config.Config, out io.Writer) models.BatchSummary {
+	summary := runBatch(ctx, devices, cfg, batchJob[models.DiscoveryResult]{
+		mode: "discovery",
+		process: func(ctx context.Context, dev models.Device) models.DiscoveryResult {
 			// Dispatch based on system type
 			performer := discovery.GetDiscoveryPerformer(dev.SystemType)
-			result := performer.Perform(dev, cfg.GetSSHTimeout())
-			resultChan <- result
-		}(device)
-	}
+			result := performer.Perform(ctx, dev, cfg.DeviceTimeout(dev.TimeoutSec))
+			result.IP = dev.IP
+			return result
+		},
+		succeeded: func(result models.DiscoveryResult) bool { return result.Success },
+		invalid:   invalidDiscovery,
+		panicked:  panickedDiscovery,
+		cancelled: cancelledDiscovery,
+		encode: func(result models.DiscoveryResult) (string, error) {
+			output, err := json.Marshal(result)
+			return string(output), err
+		},
+	}, out)
+
+	// Discovery results are not encrypted, neither is their summary
+	writeSummary(out, summary, nil, nil, nil)
+	return summary
+}
 
-	// Wait for all device-processing Goroutines to complete
-	wg.Wait()
+// invalidDiscovery returns the discovery result of a device that fails validation
+func invalidDiscovery(device models.Device, err error) models.DiscoveryResult {
+	return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryInvalidDevice, err.Error())
+}
 
-	close(resultChan)
-	// Wait for the output Goroutine to finish printing
-	outputWg.Wait()
+// panickedDiscovery returns the discovery result of a device whose worker panicked
+func panickedDiscovery(device models.Device, msg string) models.DiscoveryResult {
+	return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryPanic, msg)
 }
 
-func encodeResult(result models.MetricsResult, key []byte) (string, error) {
+// encodeResult marshals a metrics result or summary and, when key is set, compresses, encrypts and base64-encodes it with enc
+func encodeResult(result any, key []byte, codec compression.Codec, enc *base64.Encoding) (string, error) {
 	plaintext, err := json.Marshal(result)
 	if err != nil {
 		return "", fmt.Errorf("marshal error: %w", err)
 	}
 
-	compressed := snappy.Encode(nil, plaintext)
+	return sealLine(plaintext, key, codec, enc)
+}
+
+// sealLine returns plaintext as an output line, compressed, encrypted and base64-encoded with enc when key is set
+func sealLine(plaintext []byte, key []byte, codec compression.Codec, enc *base64.Encoding) (string, error) {
+	if key == nil {
+		return string(plaintext), nil
+	}
+
+	compressed, err := codec.Encode(plaintext)
+	if err != nil {
+		return "", fmt.Errorf("compression error: %w", err)
+	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -290,14 +481,15 @@ func encodeResult(result models.MetricsResult, key []byte) (string, error) {
 		return "", fmt.Errorf("gcm error: %w", err)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return "", fmt.Errorf("nonce error: %w", err)
+	// Nonces come from a counter so they cannot repeat within the process, see nonceSource
+	nonce, err := nextResultNonce(gcm.NonceSize())
+	if err != nil {
+		return "", err
 	}
 
 	encrypted := gcm.Seal(nil, nonce, compressed, nil)
 
 	final := append(nonce, encrypted...) // prepend nonce
-	encoded := base64.StdEncoding.EncodeToString(final)
+	encoded := enc.EncodeToString(final)
 	return encoded, nil
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingListener accepts connections, holds each open for hold and counts how many were open at once
+type countingListener struct {
+	net.Listener
+	hold time.Duration
+
+	mu      sync.Mutex
+	open    int
+	maxOpen int
+	total   int
+}
+
+// newCountingListener starts a countingListener on a loopback port, it is closed when the test ends
+func newCountingListener(t *testing.T, hold time.Duration) *countingListener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingListener{Listener: listener, hold: hold}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go l.handle(conn)
+		}
+	}()
+	return l
+}
+
+// handle counts conn as open until it has been held, then closes it
+func (l *countingListener) handle(conn net.Conn) {
+	l.mu.Lock()
+	l.open++
+	l.total++
+	l.maxOpen = max(l.maxOpen, l.open)
+	l.mu.Unlock()
+
+	time.Sleep(l.hold)
+
+	// The count drops before the close, the client may start its next dial as soon as it sees it
+	l.mu.Lock()
+	l.open--
+	l.mu.Unlock()
+	conn.Close()
+}
+
+// stats returns the most connections open at once and the total accepted
+func (l *countingListener) stats() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxOpen, l.total
+}
+
+// listenerDevices returns n Linux devices connecting to addr
+func listenerDevices(t *testing.T, addr string, n int) []models.Device {
+	t.Helper()
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portText)
+
+	devices := make([]models.Device, n)
+	for i := range devices {
+		devices[i] = models.Device{
+			ID:          i + 1,
+			IP:          host,
+			Port:        port,
+			SystemType:  "linux",
+			Credentials: models.Credentials{Username: "test", Password: "pw"},
+		}
+	}
+	return devices
+}
+
+func TestProcessMetricsMaxConcurrency(t *testing.T) {
+	const limit = 3
+	listener := newCountingListener(t, 200*time.Millisecond)
+	cfg := sshtest.LoadConfig(t, `{"ssh": {"max_concurrency": 3}, "encryption": {"enabled": false}}`)
+	devices := listenerDevices(t, listener.Addr().String(), 12)
+
+	var out bytes.Buffer
+	summary, err := processMetrics(context.Background(), slices.All(devices), cfg, &out)
+	if err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+	if summary.Total != len(devices) {
+		t.Errorf("got %d results, want %d", summary.Total, len(devices))
+	}
+
+	maxOpen, total := listener.stats()
+	if total < len(devices) {
+		t.Errorf("got %d connection attempts, want at least %d", total, len(devices))
+	}
+	if maxOpen > limit {
+		t.Errorf("got %d connections at once, want at most %d", maxOpen, limit)
+	}
+	if maxOpen < 2 {
+		t.Errorf("got %d connections at once, devices should be processed concurrently", maxOpen)
+	}
+}
+
+// serverDevice returns a Linux device logging in to srv
+func serverDevice(srv *sshtest.Server, id int) models.Device {
+	return models.Device{
+		ID:          id,
+		IP:          srv.Host(),
+		Port:        srv.Port(),
+		SystemType:  "linux",
+		Credentials: models.Credentials{Username: "test", Password: "pw"},
+	}
+}
+
+// outputLines splits batch output into its lines
+func outputLines(out *bytes.Buffer) []string {
+	return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+}
+
+func TestProcessMetricsEncryptionDisabled(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "metrics": {"commands": {"hostname": "echo host1"}}}`)
+
+	var out bytes.Buffer
+	if _, err := processMetrics(context.Background(), slices.All([]models.Device{serverDevice(srv, 7)}), cfg, &out); err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+
+	lines := outputLines(&out)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want a result and a summary:\n%s", len(lines), out.String())
+	}
+
+	var result models.MetricsResult
+	if err := json.Unmarshal([]byte(lines[0]), &result); err != nil {
+		t.Fatalf("result line is not plain JSON: %v\n%s", err, lines[0])
+	}
+	if result.ID != 7 || !result.Success {
+		t.Errorf("got result %+v, want a successful result for device 7", result)
+	}
+	if got := result.Metrics["hostname"]; got != "host1" {
+		t.Errorf("got hostname %q, want %q", got, "host1")
+	}
+}
+
+// parseResults decodes plain JSON metrics result lines, the summary line is left out
+func parseResults(t *testing.T, out *bytes.Buffer) []models.MetricsResult {
+	t.Helper()
+	var results []models.MetricsResult
+	for _, line := range outputLines(out) {
+		if strings.Contains(line, `"summary":true`) {
+			continue
+		}
+		var result models.MetricsResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("invalid result line %q: %v", line, err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestProcessMetricsCancelMidBatch(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"ssh": {"max_concurrency": 1}, "encryption": {"enabled": false}, "metrics": {"commands": {"hostname": "sleep 10; echo host1"}}}`)
+
+	var devices []models.Device
+	for id := 1; id <= 5; id++ {
+		devices = append(devices, serverDevice(srv, id))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	start := time.Now()
+	var out bytes.Buffer
+	summary, err := processMetrics(ctx, slices.All(devices), cfg, &out)
+	if err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("batch took %s after being cancelled", elapsed)
+	}
+
+	results := parseResults(t, &out)
+	if len(results) != len(devices) || summary.Failures != len(devices) {
+		t.Fatalf("got %d results and %d failures, want %d of each", len(results), summary.Failures, len(devices))
+	}
+	for _, result := range results {
+		if result.Success || !strings.Contains(result.Metrics["error"], constants.ErrCancelled) {
+			t.Errorf("device %d: got %+v, want a cancellation error", result.ID, result.Metrics)
+		}
+	}
+}
+
+// closedPortDevice returns a Linux device whose port refuses connections
+func closedPortDevice(t *testing.T, id int) models.Device {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	device := listenerDevices(t, addr, 1)[0]
+	device.ID = id
+	return device
+}
+
+// parseSummary decodes the summary line ending plain JSON batch output
+func parseSummary(t *testing.T, out *bytes.Buffer) models.BatchSummary {
+	t.Helper()
+	lines := outputLines(out)
+	var summary models.BatchSummary
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil || !summary.Summary {
+		t.Fatalf("last line is not a summary: %q (%v)", lines[len(lines)-1], err)
+	}
+	return summary
+}
+
+func TestBatchSummaryCounts(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "metrics": {"commands": {"hostname": "echo host1"}}}`)
+	devices := []models.Device{serverDevice(srv, 1), closedPortDevice(t, 2), serverDevice(srv, 3)}
+
+	t.Run("metrics", func(t *testing.T) {
+		var out bytes.Buffer
+		returned, err := processMetrics(context.Background(), slices.All(devices), cfg, &out)
+		if err != nil {
+			t.Fatalf("processMetrics: %v", err)
+		}
+
+		successes := 0
+		results := parseResults(t, &out)
+		for _, result := range results {
+			if result.Success {
+				successes++
+			}
+		}
+		summary := parseSummary(t, &out)
+		if summary.Mode != "metrics" || summary.Total != len(results) || summary.Successes != successes || summary.Failures != len(results)-successes {
+			t.Errorf("got summary %+v for %d results with %d successes", summary, len(results), successes)
+		}
+		if successes != 2 {
+			t.Errorf("got %d successes, want 2", successes)
+		}
+		if returned.Total != summary.Total || returned.Successes != summary.Successes {
+			t.Errorf("returned summary %+v differs from the written one %+v", returned, summary)
+		}
+	})
+
+	t.Run("discovery", func(t *testing.T) {
+		var out bytes.Buffer
+		processDiscovery(context.Background(), slices.All(devices), cfg, &out)
+
+		lines := outputLines(&out)
+		successes := 0
+		for _, line := range lines[:len(lines)-1] {
+			var result models.DiscoveryResult
+			if err := json.Unmarshal([]byte(line), &result); err != nil {
+				t.Fatalf("invalid result line %q: %v", line, err)
+			}
+			if result.Success {
+				successes++
+			}
+		}
+		summary := parseSummary(t, &out)
+		if summary.Mode != "discovery" || summary.Total != len(lines)-1 || summary.Successes != successes || summary.Failures != len(lines)-1-successes {
+			t.Errorf("got summary %+v for %d results with %d successes", summary, len(lines)-1, successes)
+		}
+	})
+}
+
+func TestBatchExitCode(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "metrics": {"commands": {"hostname": "echo host1"}}}`)
+
+	tests := []struct {
+		name    string
+		devices []models.Device
+		want    int
+	}{
+		{"all succeed", []models.Device{serverDevice(srv, 1), serverDevice(srv, 2)}, constants.ExitSuccess},
+		{"some fail", []models.Device{serverDevice(srv, 1), closedPortDevice(t, 2)}, constants.ExitPartialFailure},
+		{"all fail", []models.Device{closedPortDevice(t, 1), closedPortDevice(t, 2)}, constants.ExitAllFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if got := batchExitCode(processMetrics(context.Background(), slices.All(tt.devices), cfg, &out)); got != tt.want {
+				t.Errorf("got exit code %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("batch not processed", func(t *testing.T) {
+		if got := batchExitCode(models.BatchSummary{}, errors.New("write failed")); got != constants.ExitError {
+			t.Errorf("got exit code %d, want %d", got, constants.ExitError)
+		}
+	})
+}
+
+func TestProcessMetricsDeviceTimeout(t *testing.T) {
+	// The server answers after the global timeout but within the device's own
+	srv := sshtest.NewServer(t, sshtest.Options{BannerDelay: 6 * time.Second})
+	cfg := sshtest.LoadConfig(t, `{"ssh": {"timeout": 5}, "encryption": {"enabled": false}, "metrics": {"commands": {"hostname": "echo host1"}}}`)
+
+	global := serverDevice(srv, 1)
+	override := serverDevice(srv, 2)
+	override.TimeoutSec = 10
+
+	var out bytes.Buffer
+	if _, err := processMetrics(context.Background(), slices.All([]models.Device{global, override}), cfg, &out); err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+
+	results := make(map[int]models.MetricsResult)
+	for _, result := range parseResults(t, &out) {
+		results[result.ID] = result
+	}
+	if results[1].Success || !strings.Contains(results[1].Metrics["error"], constants.ErrTimeout) {
+		t.Errorf("got %+v for device 1, want the global timeout to expire first", results[1])
+	}
+	if !results[2].Success || results[2].Metrics["hostname"] != "host1" {
+		t.Errorf("got %+v for device 2, want its longer timeout honored", results[2])
+	}
+}
+
+func TestProcessMetricsKeyPrefix(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "output": {"ordered": true},
+		"metrics": {"key_prefix": "ssh_", "commands": {"hostname": "echo host1", "cpu": "echo 12.5"}}}`)
+	devices := []models.Device{serverDevice(srv, 1), closedPortDevice(t, 2)}
+
+	var out bytes.Buffer
+	if _, err := processMetrics(context.Background(), slices.All(devices), cfg, &out); err != nil {
+		t.Fatalf("processMetrics: %v", err)
+	}
+
+	results := parseResults(t, &out)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if len(results[0].Metrics) == 0 {
+		t.Fatalf("got no metrics for device 1: %+v", results[0])
+	}
+	for name := range results[0].Metrics {
+		if !strings.HasPrefix(name, "ssh_") {
+			t.Errorf("metric %s is not prefixed", name)
+		}
+	}
+	if got := results[0].Metrics["ssh_hostname"]; got != "host1" {
+		t.Errorf("got ssh_hostname %q, want %q", got, "host1")
+	}
+	for name := range results[0].TypedMetrics {
+		if !strings.HasPrefix(name, "ssh_") {
+			t.Errorf("typed metric %s is not prefixed", name)
+		}
+	}
+
+	// The error of a failed device stays under the unprefixed key
+	if _, ok := results[1].Metrics["error"]; results[1].Success || !ok || len(results[1].Metrics) != 1 {
+		t.Errorf("got %+v for the failed device, want only an error key", results[1].Metrics)
+	}
+}
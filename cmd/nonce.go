@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"ssh-plugin/internal/random"
+	"sync"
+	"sync/atomic"
+)
+
+// nonceSource hands out AES-GCM nonces that never repeat within the process
+// Each nonce is a random per-process base XORed with a counter in its last 8 bytes,
+// so nonces are unique for the 2^64 results a process could encrypt, and the random base
+// keeps separate processes sharing the key as unlikely to collide as fully random nonces
+// Keys should still be rotated well before 2^32 results in total, the usual AES-GCM bound
+type nonceSource struct {
+	base    []byte
+	counter atomic.Uint64
+}
+
+// resultNonces generates the nonces of encodeResult, created on first use
+var (
+	resultNonces     *nonceSource
+	resultNoncesErr  error
+	resultNoncesOnce sync.Once
+)
+
+// newNonceSource creates a source of size-byte nonces with a random base
+func newNonceSource(size int) (*nonceSource, error) {
+	if size < 8 {
+		return nil, fmt.Errorf("nonce size %d is too small", size)
+	}
+
+	base := make([]byte, size)
+	n, err := random.Read(base)
+	if err != nil {
+		return nil, fmt.Errorf("nonce error: %w", err)
+	}
+	if n != size {
+		return nil, fmt.Errorf("nonce error: read %d of %d random bytes", n, size)
+	}
+
+	return &nonceSource{base: base}, nil
+}
+
+// next returns a nonce not handed out before
+func (s *nonceSource) next() []byte {
+	nonce := make([]byte, len(s.base))
+	copy(nonce, s.base)
+
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^s.counter.Add(1))
+	return nonce
+}
+
+// nextResultNonce returns the next nonce for an encrypted result
+func nextResultNonce(size int) ([]byte, error) {
+	resultNoncesOnce.Do(func() {
+		resultNonces, resultNoncesErr = newNonceSource(size)
+	})
+	if resultNoncesErr != nil {
+		return nil, resultNoncesErr
+	}
+	if len(resultNonces.base) != size {
+		return nil, fmt.Errorf("nonce size %d does not match %d", size, len(resultNonces.base))
+	}
+	return resultNonces.next(), nil
+}
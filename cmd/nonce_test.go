@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"ssh-plugin/compression"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+)
+
+func TestEncodeResultUniqueCiphertexts(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, serveTestConfig(""))
+	key, err := cfg.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := []models.Device{{ID: 1, IP: "10.0.0.1", Credentials: models.Credentials{Username: "admin"}}}
+
+	first, err := encodeResult(devices, key, codec, base64.StdEncoding)
+	if err != nil {
+		t.Fatalf("encodeResult: %v", err)
+	}
+	second, err := encodeResult(devices, key, codec, base64.StdEncoding)
+	if err != nil {
+		t.Fatalf("encodeResult: %v", err)
+	}
+	if first == second {
+		t.Fatal("two encodes of the same plaintext produced the same ciphertext")
+	}
+
+	// Both still decrypt to the same devices
+	for _, encoded := range []string{first, second} {
+		decoded, err := decryptAndDecompress(strings.NewReader(encoded), cfg)
+		if err != nil {
+			t.Fatalf("decryptAndDecompress: %v", err)
+		}
+		if len(decoded) != 1 || decoded[0].IP != "10.0.0.1" {
+			t.Errorf("got devices %+v, want the encoded one", decoded)
+		}
+	}
+}
+
+func TestNonceSourceUnique(t *testing.T) {
+	source, err := newNonceSource(12)
+	if err != nil {
+		t.Fatalf("newNonceSource: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for range 100000 {
+		nonce := source.next()
+		if len(nonce) != 12 {
+			t.Fatalf("got %d byte nonce, want 12", len(nonce))
+		}
+		if seen[string(nonce)] {
+			t.Fatalf("nonce %x repeated after %d nonces", nonce, len(seen))
+		}
+		seen[string(nonce)] = true
+	}
+	// The random base is shared, only the counter part changes
+	if first := source.next(); !bytes.Equal(first[:4], source.base[:4]) {
+		t.Errorf("nonce %x does not keep the base prefix %x", first, source.base[:4])
+	}
+}
+
+func TestNonceSourceSize(t *testing.T) {
+	if _, err := newNonceSource(7); err == nil {
+		t.Error("newNonceSource accepted a nonce too short for the counter")
+	}
+	if _, err := nextResultNonce(12); err != nil {
+		t.Fatalf("nextResultNonce: %v", err)
+	}
+	if _, err := nextResultNonce(16); err == nil {
+		t.Error("nextResultNonce returned a nonce of a different size than the source")
+	}
+}
+
+func TestDecryptStandardNonce(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, serveTestConfig(""))
+	key, err := cfg.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := codec.Encode([]byte(`[{"id": 3, "ip": "10.0.0.3"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sealed the way other producers do, with a random 12-byte nonce ahead of the ciphertext
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	sealed := gcm.Seal(nonce, nonce, compressed, nil)
+
+	devices, err := decryptAndDecompress(strings.NewReader(base64.StdEncoding.EncodeToString(sealed)), cfg)
+	if err != nil {
+		t.Fatalf("decryptAndDecompress: %v", err)
+	}
+	if len(devices) != 1 || devices[0].ID != 3 {
+		t.Errorf("got devices %+v, want the sealed one", devices)
+	}
+}
+
+func TestDecryptTooShort(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, serveTestConfig(""))
+
+	// A nonce and less than a full tag, which must not reach Open
+	for _, size := range []int{1, 12, 12 + 15} {
+		input := base64.StdEncoding.EncodeToString(make([]byte, size))
+		_, err := decryptAndDecompress(strings.NewReader(input), cfg)
+		if err == nil || !strings.Contains(err.Error(), "expected a 12-byte nonce and a 16-byte tag") {
+			t.Errorf("got error %v for %d bytes, want one stating the expected sizes", err, size)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"ssh-plugin/config"
+	"strings"
+)
+
+// lineWriter writes newline-delimited results to a destination
+// Every Write is treated as one complete line and is never split across flushes,
+// so a crash can only lose buffered lines, not corrupt lines already written
+type lineWriter struct {
+	buf       *bufio.Writer
+	flushEach bool      // Flush after every line to keep streaming behavior
+	checksum  bool      // Prefix every line with its length and CRC-32, see checksumLine
+	closer    io.Closer // Underlying file or connection, nil for stdout
+}
+
+// openOutput opens the results destination
+// An empty path or "-" streams to stdout, a tcp+tls:// address streams to a collector,
+// anything else is created (or truncated) as a file
+func openOutput(path string, cfg *config.Config) (*lineWriter, error) {
+	if path == "" || path == "-" {
+		return &lineWriter{buf: bufio.NewWriter(os.Stdout), flushEach: true, checksum: cfg.Output.Checksum}, nil
+	}
+
+	if addr, ok := strings.CutPrefix(path, tlsSinkScheme); ok {
+		sink, err := newTLSSink(addr, cfg.Output.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		return &lineWriter{buf: bufio.NewWriter(sink), flushEach: true, checksum: cfg.Output.Checksum, closer: sink}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output file: %w", err)
+	}
+
+	return &lineWriter{buf: bufio.NewWriterSize(file, 64*1024), checksum: cfg.Output.Checksum, closer: file}, nil
+}
+
+// Write buffers one line, flushing earlier lines first if it would not fit
+func (w *lineWriter) Write(line []byte) (int, error) {
+	n := len(line)
+	if w.checksum {
+		line = checksumLine(line)
+	}
+
+	if len(line) > w.buf.Available() && w.buf.Buffered() > 0 {
+		if err := w.buf.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := w.buf.Write(line); err != nil {
+		return 0, err
+	}
+
+	if w.flushEach {
+		return n, w.buf.Flush()
+	}
+	return n, nil
+}
+
+// Close flushes buffered lines and closes the underlying file
+func (w *lineWriter) Close() error {
+	err := w.buf.Flush()
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// indexed pairs a result with the input position and ID of its device
+type indexed[T any] struct {
+	index  int
+	id     int
+	result T
+}
+
+// resultEmitter writes encoded result lines to out
+// In ordered mode lines are held back until every earlier device has been written,
+// so results appear in input order regardless of completion order
+type resultEmitter struct {
+	out     io.Writer
+	ordered bool
+	next    int            // Index of the next line to write in ordered mode
+	pending map[int]string // Lines completed ahead of next, "" marks a result that produced no line
+}
+
+// newResultEmitter creates an emitter writing to out
+func newResultEmitter(out io.Writer, ordered bool) *resultEmitter {
+	return &resultEmitter{out: out, ordered: ordered, pending: make(map[int]string)}
+}
+
+// emit writes the line for the device at index, an empty line only advances the order
+func (e *resultEmitter) emit(index int, line string) {
+	if !e.ordered {
+		e.write(line)
+		return
+	}
+
+	e.pending[index] = line
+	for {
+		line, ok := e.pending[e.next]
+		if !ok {
+			return
+		}
+		delete(e.pending, e.next)
+		e.next++
+		e.write(line)
+	}
+}
+
+// flush writes lines still held back by a missing earlier result, in index order
+func (e *resultEmitter) flush() {
+	indexes := make([]int, 0, len(e.pending))
+	for index := range e.pending {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		e.write(e.pending[index])
+	}
+	e.pending = make(map[int]string)
+}
+
+// write writes one line, skipping empty ones
+func (e *resultEmitter) write(line string) {
+	if line == "" {
+		return
+	}
+	if _, err := fmt.Fprintln(e.out, line); err != nil {
+		slog.Error("Error writing result", "error", err)
+	}
+}
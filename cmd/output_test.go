@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"ssh-plugin/internal/random"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockedWriter blocks every write until released
+type blockedWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// countedDevices yields n invalid devices, which get a result without connecting, counting how many were read
+func countedDevices(n int, read *atomic.Int64) iter.Seq2[int, models.Device] {
+	return func(yield func(int, models.Device) bool) {
+		for i := range n {
+			read.Add(1)
+			if !yield(i, models.Device{ID: i + 1}) {
+				return
+			}
+		}
+	}
+}
+
+func TestProcessMetricsBackpressure(t *testing.T) {
+	const buffer, devices = 4, 10000
+	cfg := sshtest.LoadConfig(t, `{"encryption": {"enabled": false}, "output": {"buffer": 4}}`)
+
+	var read atomic.Int64
+	out := &blockedWriter{release: make(chan struct{})}
+	done := make(chan models.BatchSummary)
+	go func() {
+		summary, err := processMetrics(context.Background(), countedDevices(devices, &read), cfg, out)
+		if err != nil {
+			t.Errorf("processMetrics: %v", err)
+		}
+		done <- summary
+	}()
+
+	// While output is stuck, reading stops once the buffer is full
+	time.Sleep(200 * time.Millisecond)
+	// The buffered results, the one being written and the one waiting to be queued
+	if got := read.Load(); got > buffer+2 {
+		t.Errorf("read %d devices while output was blocked, want at most %d", got, buffer+2)
+	}
+
+	close(out.release)
+	summary := <-done
+	if summary.Total != devices {
+		t.Errorf("got %d results, want %d", summary.Total, devices)
+	}
+	if got := bytes.Count(out.buf.Bytes(), []byte("\n")); got != devices+1 {
+		t.Errorf("got %d lines, want %d results and a summary", got, devices)
+	}
+}
+
+func TestProcessMetricsOrdered(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	const n = 5
+
+	// Earlier devices take longer, so without ordering results arrive in reverse
+	var devices []models.Device
+	for id := 1; id <= n; id++ {
+		device := serverDevice(srv, id)
+		device.CommandOverrides = map[string]string{"hostname": fmt.Sprintf("sleep 0.%d; echo host%d", 2*(n-id), id)}
+		devices = append(devices, device)
+	}
+
+	tests := []struct {
+		name        string
+		ordered     bool
+		wantOrdered bool
+	}{
+		{"ordered", true, true},
+		// Deterministic builds order results regardless of the setting
+		{"streamed", false, random.Deterministic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := sshtest.LoadConfig(t, fmt.Sprintf(`{"encryption": {"enabled": false}, "output": {"ordered": %v}, "metrics": {"commands": {"hostname": "echo host"}}}`, tt.ordered))
+
+			var out bytes.Buffer
+			if _, err := processMetrics(context.Background(), slices.All(devices), cfg, &out); err != nil {
+				t.Fatalf("processMetrics: %v", err)
+			}
+
+			var ids []int
+			for _, result := range parseResults(t, &out) {
+				ids = append(ids, result.ID)
+			}
+			if len(ids) != n {
+				t.Fatalf("got results for devices %v, want %d", ids, n)
+			}
+			if inOrder := slices.IsSorted(ids); inOrder != tt.wantOrdered {
+				t.Errorf("got results for devices %v, in input order should be %v", ids, tt.wantOrdered)
+			}
+		})
+	}
+}
+
+func TestResultEmitter(t *testing.T) {
+	var out bytes.Buffer
+	emitter := newResultEmitter(&out, true)
+
+	// Index 3 produced no line, index 5 never arrives
+	for _, index := range []int{2, 0, 3, 6, 1, 4} {
+		line := ""
+		if index != 3 {
+			line = strconv.Itoa(index)
+		}
+		emitter.emit(index, line)
+		if index == 0 && out.String() != "0\n" {
+			t.Errorf("got %q after index 0, want it written at once", out.String())
+		}
+	}
+	if got := out.String(); got != "0\n1\n2\n4\n" {
+		t.Errorf("got %q, want lines up to the missing index", got)
+	}
+
+	emitter.flush()
+	if got := out.String(); got != "0\n1\n2\n4\n6\n" {
+		t.Errorf("got %q after flush, want the held back line", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"ssh-plugin/compression"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+)
+
+// Keys of the rotation tests, oldKeyHex is testKeyHex being rotated out
+const (
+	oldKeyHex   = testKeyHex
+	newKeyHex   = "101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+	otherKeyHex = "202122232425262728292a2b2c2d2e2f202122232425262728292a2b2c2d2e2f"
+)
+
+// keysConfig is a configuration whose encryption.keys lists keys in order
+func keysConfig(keys ...string) string {
+	return `{"encryption": {"keys": ["` + strings.Join(keys, `", "`) + `"]}}`
+}
+
+func TestDecryptSecondaryKey(t *testing.T) {
+	devices := []models.Device{{ID: 1, IP: "10.0.0.1", Credentials: models.Credentials{Username: "admin"}}}
+	input := sealDevices(t, sshtest.LoadConfig(t, serveTestConfig("")), devices)
+
+	cfg := sshtest.LoadConfig(t, keysConfig(newKeyHex, oldKeyHex))
+	decoded, err := decryptAndDecompress(strings.NewReader(input), cfg)
+	if err != nil {
+		t.Fatalf("decryptAndDecompress with the old key listed second: %v", err)
+	}
+	if len(decoded) != 1 || decoded[0].IP != "10.0.0.1" {
+		t.Errorf("got devices %+v, want the sealed one", decoded)
+	}
+
+	// Output is encrypted with the current, first key only
+	key, err := cfg.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := encodeResult(devices, key, codec, base64.StdEncoding)
+	if err != nil {
+		t.Fatalf("encodeResult: %v", err)
+	}
+	if _, err := decryptAndDecompress(strings.NewReader(output), sshtest.LoadConfig(t, keysConfig(newKeyHex))); err != nil {
+		t.Errorf("output does not decrypt with the new key: %v", err)
+	}
+	if _, err := decryptAndDecompress(strings.NewReader(output), sshtest.LoadConfig(t, keysConfig(oldKeyHex))); err == nil {
+		t.Error("output decrypts with the old key, want the new key used")
+	}
+}
+
+func TestDecryptNoKeyMatches(t *testing.T) {
+	devices := []models.Device{{ID: 1, IP: "10.0.0.1", Credentials: models.Credentials{Username: "admin"}}}
+	input := sealDevices(t, sshtest.LoadConfig(t, serveTestConfig("")), devices)
+
+	cfg := sshtest.LoadConfig(t, keysConfig(newKeyHex, otherKeyHex))
+	_, err := decryptAndDecompress(strings.NewReader(input), cfg)
+	if err == nil || !strings.Contains(err.Error(), "AES-GCM decryption failed") {
+		t.Errorf("got error %v, want decryption to fail with every key", err)
+	}
+}
+
+func TestDryRunRedactsKeys(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, keysConfig(newKeyHex, oldKeyHex))
+
+	var out bytes.Buffer
+	if err := dryRun(nil, cfg, &out); err != nil {
+		t.Fatalf("dryRun: %v", err)
+	}
+	var report struct {
+		Config struct {
+			Encryption struct {
+				Key  string   `json:"key"`
+				Keys []string `json:"keys"`
+			} `json:"encryption"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, out.String())
+	}
+	for _, keyHex := range []string{newKeyHex, oldKeyHex} {
+		if strings.Contains(out.String(), keyHex) {
+			t.Errorf("report contains key %s", keyHex)
+		}
+	}
+	if len(report.Config.Encryption.Keys) != 2 {
+		t.Errorf("got keys %q, want both listed redacted", report.Config.Encryption.Keys)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"ssh-plugin/compression"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"strings"
+	"time"
+)
+
+// selfTestCheck is the outcome of one self-test check
+type selfTestCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// selfTestReport is printed by selftest mode
+type selfTestReport struct {
+	OK     bool            `json:"ok"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+// add records a check, a non-nil err fails it and the report
+func (r *selfTestReport) add(name string, err error) {
+	check := selfTestCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// selfTest verifies the configuration without a device list and writes a JSON report to out
+// It checks the config loads, the encryption key and compression codec work for a full
+// encode and decode round trip, and, when sshAddr is set, that an SSH server answers there
+// It reports whether every check passed
+func selfTest(sshAddr string, out io.Writer) bool {
+	report := &selfTestReport{OK: true}
+	defer func() {
+		output, err := json.Marshal(report)
+		if err == nil {
+			fmt.Fprintln(out, string(output))
+		}
+	}()
+
+	cfg, err := config.LoadConfig()
+	report.add("config", err)
+	if err != nil {
+		return false
+	}
+
+	_, err = cfg.LogLevel()
+	report.add("log_level", err)
+
+	key, err := cfg.EncryptionKey()
+	report.add("encryption_key", err)
+
+	codec, err := compression.GetCodec(cfg.Compression.Codec)
+	report.add("compression", err)
+
+	if key != nil && codec != nil {
+		report.add("round_trip", selfTestRoundTrip(key, codec, cfg))
+	}
+
+	if sshAddr != "" {
+		report.add("ssh_dial", selfTestSSHDial(sshAddr, cfg.GetSSHTimeout()))
+	}
+
+	return report.OK
+}
+
+// selfTestRoundTrip encodes a sample device list and reads it back through the input pipeline
+func selfTestRoundTrip(key []byte, codec compression.Codec, cfg *config.Config) error {
+	sample := []models.Device{{ID: 1, IP: "127.0.0.1", SystemType: constants.SystemTypeLinux, Credentials: models.Credentials{Username: "selftest"}}}
+
+	encoded, err := encodeResult(sample, key, codec, cfg.Base64Encoding())
+	if err != nil {
+		return err
+	}
+
+	decoded, err := decryptAndDecompress(strings.NewReader(encoded), cfg)
+	if err != nil {
+		return err
+	}
+
+	want, _ := json.Marshal(sample)
+	got, _ := json.Marshal(decoded)
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("decoded devices differ from encoded ones")
+	}
+	return nil
+}
+
+// selfTestSSHDial connects to addr and checks the server sends an SSH identification line
+func selfTestSSHDial(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read server version: %w", err)
+	}
+	if !strings.HasPrefix(line, "SSH-") {
+		return fmt.Errorf("unexpected server version %q", strings.TrimSpace(line))
+	}
+	return nil
+}
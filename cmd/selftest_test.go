@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/sshtest"
+	"strconv"
+	"testing"
+)
+
+// runSelfTest runs selfTest with configJSON as the config file and decodes its report
+func runSelfTest(t *testing.T, configJSON string, sshAddr string) (bool, map[string]selfTestCheck) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(configJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(config.ConfigPathEnv, path)
+
+	var out bytes.Buffer
+	ok := selfTest(sshAddr, &out)
+
+	var report selfTestReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, out.String())
+	}
+	if report.OK != ok {
+		t.Errorf("report says ok=%v, selfTest returned %v", report.OK, ok)
+	}
+	checks := make(map[string]selfTestCheck)
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	return ok, checks
+}
+
+func TestSelfTestGoodConfig(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	ok, checks := runSelfTest(t, `{"encryption": {"key": "`+testKeyHex+`"}, "compression": {"codec": "gzip"}}`, srv.Addr)
+
+	if !ok {
+		t.Errorf("self-test failed: %+v", checks)
+	}
+	for _, name := range []string{"config", "log_level", "encryption_key", "compression", "round_trip", "ssh_dial"} {
+		if check, found := checks[name]; !found || !check.OK {
+			t.Errorf("check %s: got %+v, want it passed", name, check)
+		}
+	}
+}
+
+func TestSelfTestBadConfig(t *testing.T) {
+	closed := closedPortDevice(t, 1)
+	closedAddr := net.JoinHostPort(closed.IP, strconv.Itoa(closed.Port))
+
+	tests := []struct {
+		name      string
+		config    string
+		sshAddr   string
+		wantCheck string
+	}{
+		{"unreadable config", `{"encryption": `, "", "config"},
+		{"invalid key length", `{"encryption": {"key": "0011"}}`, "", "config"},
+		{"missing key", `{}`, "", "encryption_key"},
+		{"unknown codec", `{"encryption": {"key": "` + testKeyHex + `"}, "compression": {"codec": "lz9"}}`, "", "compression"},
+		{"no SSH server", `{"encryption": {"key": "` + testKeyHex + `"}}`, closedAddr, "ssh_dial"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, checks := runSelfTest(t, tt.config, tt.sshAddr)
+			if ok {
+				t.Fatalf("self-test passed: %+v", checks)
+			}
+			if check := checks[tt.wantCheck]; check.OK || check.Error == "" {
+				t.Errorf("check %s: got %+v, want it failed with an error", tt.wantCheck, check)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/metrics"
+	"ssh-plugin/models"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests may run after SIGTERM
+const shutdownTimeout = 30 * time.Second
+
+// serve runs an HTTP server exposing POST /collect until SIGINT or SIGTERM
+// SIGHUP reloads the configuration for later requests, the listen address stays the same
+// In-flight requests are allowed to finish before it returns
+func serve(addr string, cfg *config.Config) error {
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /collect", collectHandler(&current))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go func() {
+		for range hangup {
+			reloadConfig(&current)
+		}
+	}()
+
+	errChan := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", addr)
+		errChan <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errChan; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// reloadConfig loads the configuration again and makes it current if it is usable
+// Requests already running keep the configuration they started with
+// A change to the ssh section or the secrets closes the pooled SSH clients
+func reloadConfig(current *atomic.Pointer[config.Config]) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+	level, err := cfg.LogLevel()
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+
+	slog.SetDefault(newLogger(level))
+	previous := current.Swap(cfg)
+	// Pooled clients were dialled with the old host keys, algorithms or credentials
+	if previous != nil && !previous.SameSSH(cfg) {
+		metrics.CloseClients()
+		slog.Info("SSH settings changed, pooled connections closed")
+	}
+	slog.Info("Configuration reloaded")
+}
+
+// collectHandler accepts the same encrypted device blob as the file input
+// and streams the metrics results back as the response body
+// Each request uses the configuration current when it arrives
+func collectHandler(current *atomic.Pointer[config.Config]) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := current.Load()
+
+		// The whole blob is held in memory to be decrypted, so its size is bounded
+		body := http.MaxBytesReader(w, r.Body, constants.MaxRequestBytes)
+		devices, err := decryptAndDecompress(body, cfg)
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, "Error reading devices: "+err.Error(), status)
+			return
+		}
+
+		devices, err = models.ExpandCIDRDevices(devices, constants.MaxCIDRHosts)
+		if err != nil {
+			http.Error(w, "Error expanding devices: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		devices = filterDevices(devices, cfg)
+
+		if len(devices) == 0 && !cfg.Batch.AllowEmpty {
+			http.Error(w, "No devices provided in input", http.StatusBadRequest)
+			return
+		}
+
+		contentType := "application/x-ndjson"
+		if cfg.Output.Format == "csv" {
+			contentType = "text/csv"
+		}
+		w.Header().Set("Content-Type", contentType)
+		out := &flushWriter{w: w, rc: http.NewResponseController(w), checksum: cfg.Output.Checksum}
+		if _, err := processMetrics(r.Context(), slices.All(devices), cfg, out); err != nil {
+			slog.Error("Batch not processed", "error", err)
+			reportBatchError(w, out, err)
+		}
+	})
+}
+
+// batchError is the last line of a collect response whose batch failed after output started
+type batchError struct {
+	Error string `json:"error"`
+}
+
+// reportBatchError tells the client a batch failed
+// Once a line was written the status is already sent, the error then ends the payload instead
+func reportBatchError(w http.ResponseWriter, out *flushWriter, err error) {
+	msg := "Batch not processed: " + err.Error()
+	if !out.started {
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	line, err := json.Marshal(batchError{Error: msg})
+	if err == nil {
+		_, err = fmt.Fprintln(out, string(line))
+	}
+	if err != nil {
+		slog.Error("Error writing batch error", "error", err)
+	}
+}
+
+// flushWriter flushes every result line to the client as soon as it is written
+type flushWriter struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	checksum bool // Prefix every line with its length and CRC-32, see checksumLine
+	started  bool // Set by the first write, the response status is sent from then on
+}
+
+// Write sends one line and flushes it
+func (f *flushWriter) Write(line []byte) (int, error) {
+	n := len(line)
+	if f.checksum {
+		line = checksumLine(line)
+	}
+
+	f.started = true
+	if _, err := f.w.Write(line); err != nil {
+		return 0, err
+	}
+	return n, f.rc.Flush()
+}
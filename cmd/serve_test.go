@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"ssh-plugin/compression"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testKeyHex is the encryption key of the serve test configurations
+const testKeyHex = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+
+// serveTestConfig is a serve mode configuration with plain JSON results
+func serveTestConfig(extra string) string {
+	return `{"encryption": {"key": "` + testKeyHex + `", "enabled": false}` + extra + `}`
+}
+
+// sealDevices encodes devices as the encrypted input blob accepted by decryptAndDecompress
+func sealDevices(t *testing.T, cfg *config.Config, devices []models.Device) string {
+	t.Helper()
+	plaintext, err := json.Marshal(devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := cfg.EncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := compression.GetCodec(compression.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := sealLine(plaintext, key, codec, cfg.Base64Encoding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+// readResults decodes the result lines of a collect response, the summary line is left out
+func readResults(t *testing.T, resp *http.Response) []models.MetricsResult {
+	t.Helper()
+	var results []models.MetricsResult
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), `"summary":true`) {
+			continue
+		}
+		var result models.MetricsResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("invalid result line %q: %v", scanner.Text(), err)
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestCollectHandler(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, serveTestConfig(`, "metrics": {"commands": {"hostname": "echo host1"}}`))
+
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
+	server := httptest.NewServer(collectHandler(&current))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader(sealDevices(t, cfg, []models.Device{serverDevice(srv, 3)})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("got content type %q, want application/x-ndjson", got)
+	}
+	results := readResults(t, resp)
+	if len(results) != 1 || results[0].ID != 3 || results[0].Metrics["hostname"] != "host1" {
+		t.Errorf("got results %+v, want hostname host1 for device 3", results)
+	}
+}
+
+func TestCollectHandlerBadInput(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, serveTestConfig(""))
+
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
+	server := httptest.NewServer(collectHandler(&current))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader("bm90IGVuY3J5cHRlZA=="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestReportBatchError(t *testing.T) {
+	// Nothing streamed yet, the error is still sent as the status
+	rec := httptest.NewRecorder()
+	reportBatchError(rec, &flushWriter{w: rec, rc: http.NewResponseController(rec)}, errors.New("boom"))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "boom") {
+		t.Errorf("got status %d body %q, want 500 naming the error", rec.Code, rec.Body.String())
+	}
+
+	// Rows already streamed, the error ends the payload under the status already sent
+	rec = httptest.NewRecorder()
+	out := &flushWriter{w: rec, rc: http.NewResponseController(rec)}
+	if _, err := out.Write([]byte("{\"id\":1}\n")); err != nil {
+		t.Fatal(err)
+	}
+	reportBatchError(rec, out, errors.New("boom"))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	var last batchError
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatalf("last line %q is not an error line: %v", lines[len(lines)-1], err)
+	}
+	if rec.Code != http.StatusOK || len(lines) != 2 || !strings.Contains(last.Error, "boom") {
+		t.Errorf("got status %d body %q, want 200 with the row and a trailing error line", rec.Code, rec.Body.String())
+	}
+}
+
+// freeAddr returns a loopback address with a port nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// waitListening waits until addr accepts connections
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not listening", addr)
+}
+
+// signalSelf sends sig to the test process, serve must already be handling it
+func signalSelf(t *testing.T, sig os.Signal) {
+	t.Helper()
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(sig); err != nil {
+		t.Skipf("cannot signal the test process: %v", err)
+	}
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, serveTestConfig(`, "metrics": {"commands": {"hostname": "sleep 1; echo host1"}}`))
+	addr := freeAddr(t)
+
+	served := make(chan error, 1)
+	go func() { served <- serve(addr, cfg) }()
+	waitListening(t, addr)
+
+	// A request in flight at SIGTERM still gets its results
+	responded := make(chan []models.MetricsResult, 1)
+	go func() {
+		resp, err := http.Post("http://"+addr+"/collect", "text/plain", strings.NewReader(sealDevices(t, cfg, []models.Device{serverDevice(srv, 1)})))
+		if err != nil {
+			t.Error(err)
+			responded <- nil
+			return
+		}
+		defer resp.Body.Close()
+		responded <- readResults(t, resp)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	signalSelf(t, syscall.SIGTERM)
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve returned %v, want nil after SIGTERM", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve did not return after SIGTERM")
+	}
+
+	results := <-responded
+	if len(results) != 1 || results[0].Metrics["hostname"] != "host1" {
+		t.Errorf("got results %+v, the in-flight request should finish", results)
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+// collectOnce posts devices to the serve mode server at addr and returns the results
+func collectOnce(t *testing.T, addr string, blob string) []models.MetricsResult {
+	t.Helper()
+	resp, err := http.Post("http://"+addr+"/collect", "text/plain", strings.NewReader(blob))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	defer resp.Body.Close()
+	return readResults(t, resp)
+}
+
+func TestServeReloadOnSIGHUP(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	cfg := sshtest.LoadConfig(t, serveTestConfig(`, "metrics": {"commands": {"hostname": "sleep 1; echo before"}}`))
+	blob := sealDevices(t, cfg, []models.Device{serverDevice(srv, 1)})
+	addr := freeAddr(t)
+
+	served := make(chan error, 1)
+	go func() { served <- serve(addr, cfg) }()
+	waitListening(t, addr)
+	defer func() {
+		signalSelf(t, syscall.SIGTERM)
+		select {
+		case <-served:
+		case <-time.After(10 * time.Second):
+			t.Error("serve did not return after SIGTERM")
+		}
+	}()
+
+	// A request in flight at SIGHUP finishes with the configuration it started with
+	inFlight := make(chan []models.MetricsResult, 1)
+	go func() { inFlight <- collectOnce(t, addr, blob) }()
+	time.Sleep(300 * time.Millisecond)
+
+	sshtest.LoadConfig(t, serveTestConfig(`, "metrics": {"commands": {"hostname": "echo after"}}`))
+	signalSelf(t, syscall.SIGHUP)
+
+	if results := <-inFlight; len(results) != 1 || results[0].Metrics["hostname"] != "before" {
+		t.Errorf("got in-flight results %+v, want the command it started with", results)
+	}
+
+	// The reload happens in the background, later requests pick up the changed command
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		results := collectOnce(t, addr, blob)
+		if len(results) == 1 && results[0].Metrics["hostname"] == "after" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got results %+v after SIGHUP, want the changed command", results)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestServeReloadKeepsConfigOnError(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, serveTestConfig(`, "metrics": {"commands": {"hostname": "echo before"}}`))
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
+
+	// An unusable configuration is reported and the current one stays in place
+	path := os.Getenv(config.ConfigPathEnv)
+	if err := os.WriteFile(path, []byte(`{"encryption": {"key": "short"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(&current)
+	if current.Load() != cfg {
+		t.Error("a failed reload replaced the configuration")
+	}
+
+	if err := os.WriteFile(path, []byte(serveTestConfig(`, "metrics": {"commands": {"hostname": "echo after"}}`)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(&current)
+	if got := current.Load().Metrics.Commands["hostname"]; got != "echo after" {
+		t.Errorf("got hostname command %q after reload, want %q", got, "echo after")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"ssh-plugin/internal/constants"
+	"time"
+)
+
+// tlsSinkScheme prefixes an output path naming a TLS collector
+const tlsSinkScheme = "tcp+tls://"
+
+// tlsSink writes result lines to a collector over TLS
+// The connection is opened on the first write and reopened when a write fails,
+// a write is given up on after constants.OutputReconnectAttempts connections
+// A line cut short by a broken connection is sent again whole on the next one
+// Lines accepted by the connection just before the collector hangs up can still be lost,
+// there is no acknowledgement to resend them from
+type tlsSink struct {
+	addr   string
+	config *tls.Config
+	conn   net.Conn
+	hungUp chan struct{} // Closed once the collector closes the current connection
+}
+
+// newTLSSink creates a sink for the collector at addr (host:port)
+// caFile, if set, names a PEM file of CAs trusted instead of the system roots
+func newTLSSink(addr string, caFile string) (*tlsSink, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output address %q: %w", addr, err)
+	}
+
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read output CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in output CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return &tlsSink{addr: addr, config: config}, nil
+}
+
+// Write sends p, reconnecting and resending it whole if the connection fails
+func (s *tlsSink) Write(p []byte) (int, error) {
+	var err error
+	for attempt := 0; attempt < constants.OutputReconnectAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		// A collector that hung up would silently swallow the next write
+		if s.conn != nil {
+			select {
+			case <-s.hungUp:
+				s.conn.Close()
+				s.conn = nil
+			default:
+			}
+		}
+
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				slog.Warn("Output collector unreachable", "addr", s.addr, "attempt", attempt+1, "error", err)
+				continue
+			}
+		}
+
+		if _, err = s.conn.Write(p); err == nil {
+			return len(p), nil
+		}
+		slog.Warn("Output collector write failed, reconnecting", "addr", s.addr, "attempt", attempt+1, "error", err)
+		s.conn.Close()
+		s.conn = nil
+	}
+	return 0, fmt.Errorf("output collector %s: %w", s.addr, err)
+}
+
+// connect opens a new TLS connection to the collector
+func (s *tlsSink) connect() error {
+	dialer := &net.Dialer{Timeout: constants.OutputDialTimeout * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", s.addr, s.config)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+
+	// The collector never sends anything, a read only returns once it closes the connection
+	hungUp := make(chan struct{})
+	go func() {
+		defer close(hungUp)
+		io.Copy(io.Discard, conn)
+	}()
+	s.hungUp = hungUp
+	return nil
+}
+
+// Close closes the connection, sending the TLS close notification after the last line
+func (s *tlsSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
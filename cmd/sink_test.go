@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"ssh-plugin/internal/sshtest"
+	"testing"
+	"time"
+)
+
+// tlsCollector is a local TLS listener receiving result lines
+type tlsCollector struct {
+	Addr   string
+	CAFile string        // PEM file holding the collector's self-signed certificate
+	Lines  chan string   // Lines received, in order
+	Conns  chan net.Conn // Connections accepted
+	hangUp bool          // Close each connection after its first line
+}
+
+// newTLSCollector starts a collector on a loopback port, it is stopped when the test ends
+func newTLSCollector(t *testing.T, hangUp bool) *tlsCollector {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "collector"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "collector.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	c := &tlsCollector{Addr: listener.Addr().String(), CAFile: caFile, Lines: make(chan string, 100), Conns: make(chan net.Conn, 100), hangUp: hangUp}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.Conns <- conn
+			go c.serve(conn)
+		}
+	}()
+	return c
+}
+
+// serve reads the lines of one connection
+func (c *tlsCollector) serve(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		c.Lines <- scanner.Text()
+		if c.hangUp {
+			return
+		}
+	}
+}
+
+// receive waits for the next n lines
+func (c *tlsCollector) receive(t *testing.T, n int) []string {
+	t.Helper()
+	var lines []string
+	for range n {
+		select {
+		case line := <-c.Lines:
+			lines = append(lines, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got lines %q, timed out waiting for %d", lines, n)
+		}
+	}
+	return lines
+}
+
+func TestTLSSinkDeliversLines(t *testing.T) {
+	collector := newTLSCollector(t, false)
+	cfg := sshtest.LoadConfig(t, fmt.Sprintf(`{"output": {"tls_ca": %q}}`, collector.CAFile))
+
+	out, err := openOutput(tlsSinkScheme+collector.Addr, cfg)
+	if err != nil {
+		t.Fatalf("openOutput: %v", err)
+	}
+	want := []string{"first", "second", "third"}
+	for _, line := range want {
+		if _, err := out.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := collector.receive(t, len(want)); !slices.Equal(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+	if got := len(collector.Conns); got != 1 {
+		t.Errorf("got %d connections, want every line on one", got)
+	}
+}
+
+func TestTLSSinkReconnects(t *testing.T) {
+	collector := newTLSCollector(t, true)
+	cfg := sshtest.LoadConfig(t, fmt.Sprintf(`{"output": {"tls_ca": %q}}`, collector.CAFile))
+
+	out, err := openOutput(tlsSinkScheme+collector.Addr, cfg)
+	if err != nil {
+		t.Fatalf("openOutput: %v", err)
+	}
+	defer out.Close()
+	sink := out.closer.(*tlsSink)
+
+	for _, line := range []string{"first", "second"} {
+		if _, err := out.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if got := collector.receive(t, 1); got[0] != line {
+			t.Errorf("got line %q, want %q", got[0], line)
+		}
+		// The collector hung up, the next line goes over a new connection
+		select {
+		case <-sink.hungUp:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the sink did not notice the collector hanging up")
+		}
+	}
+	if got := len(collector.Conns); got != 2 {
+		t.Errorf("got %d connections, want one per line", got)
+	}
+}
+
+func TestTLSSinkUntrustedCollector(t *testing.T) {
+	collector := newTLSCollector(t, false)
+	// Without the collector's CA its self-signed certificate is rejected
+	sink, err := newTLSSink(collector.Addr, "")
+	if err != nil {
+		t.Fatalf("newTLSSink: %v", err)
+	}
+	if err := sink.connect(); err == nil {
+		sink.Close()
+		t.Error("connected to a collector with an untrusted certificate")
+	}
+
+	if _, err := newTLSSink(collector.Addr, filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("got no error for a missing CA file")
+	}
+}
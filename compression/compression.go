@@ -0,0 +1,108 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// Codec compresses and decompresses result and device payloads
+type Codec interface {
+	Name() string
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+	NewReader(data []byte) (io.ReadCloser, error) // Decompresses data as it is read, where the format allows
+}
+
+// Supported codec names
+const (
+	Snappy = "snappy"
+	Gzip   = "gzip"
+)
+
+// gzipMagic starts every gzip stream, it lets Detect tell gzip payloads from snappy ones
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// GetCodec returns the codec with the given name, an empty name selects snappy
+func GetCodec(name string) (Codec, error) {
+	switch name {
+	case "", Snappy:
+		return SnappyCodec{}, nil
+	case Gzip:
+		return GzipCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", name)
+	}
+}
+
+// Detect returns the codec a payload was compressed with
+// gzip streams are recognised by their header, anything else is treated as snappy
+func Detect(data []byte) Codec {
+	if bytes.HasPrefix(data, gzipMagic) {
+		return GzipCodec{}
+	}
+	return SnappyCodec{}
+}
+
+// SnappyCodec implements Codec using the snappy block format
+type SnappyCodec struct{}
+
+// Name returns "snappy"
+func (SnappyCodec) Name() string { return Snappy }
+
+// Encode compresses data with snappy
+func (SnappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Decode decompresses snappy data
+func (SnappyCodec) Decode(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// NewReader returns a reader over the decompressed data
+// The snappy block format cannot be decoded incrementally, data is decoded up front
+func (c SnappyCodec) NewReader(data []byte) (io.ReadCloser, error) {
+	decoded, err := c.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(decoded)), nil
+}
+
+// GzipCodec implements Codec using gzip
+type GzipCodec struct{}
+
+// Name returns "gzip"
+func (GzipCodec) Name() string { return Gzip }
+
+// Encode compresses data with gzip
+func (GzipCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses gzip data
+func (c GzipCodec) Decode(data []byte) ([]byte, error) {
+	reader, err := c.NewReader(data)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// NewReader returns a reader decompressing data as it is read
+func (GzipCodec) NewReader(data []byte) (io.ReadCloser, error) {
+	return gzip.NewReader(bytes.NewReader(data))
+}
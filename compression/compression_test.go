@@ -0,0 +1,72 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":      {},
+		"json":       []byte(`[{"id":1,"ip":"10.0.0.1","credentials":{"username":"admin","password":"pw"}}]`),
+		"repetitive": []byte(strings.Repeat("metrics ", 10000)),
+		"binary":     {0x00, 0x1f, 0x8b, 0xff, 0x10},
+	}
+
+	for _, name := range []string{Snappy, Gzip} {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec.Name() != name {
+			t.Errorf("GetCodec(%q) returned codec %q", name, codec.Name())
+		}
+
+		for inputName, input := range inputs {
+			t.Run(name+"/"+inputName, func(t *testing.T) {
+				encoded, err := codec.Encode(input)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+
+				decoded, err := codec.Decode(encoded)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				if !bytes.Equal(decoded, input) {
+					t.Errorf("Decode returned %d bytes that differ from the %d encoded", len(decoded), len(input))
+				}
+
+				reader, err := codec.NewReader(encoded)
+				if err != nil {
+					t.Fatalf("NewReader: %v", err)
+				}
+				defer reader.Close()
+				streamed, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("reading NewReader: %v", err)
+				}
+				if !bytes.Equal(streamed, input) {
+					t.Errorf("NewReader returned %d bytes that differ from the %d encoded", len(streamed), len(input))
+				}
+
+				// Payloads are decompressed with the codec detected from their header
+				if detected := Detect(encoded); detected.Name() != name {
+					t.Errorf("Detect returned %q for a %s payload", detected.Name(), name)
+				}
+			})
+		}
+	}
+}
+
+func TestGetCodec(t *testing.T) {
+	codec, err := GetCodec("")
+	if err != nil || codec.Name() != Snappy {
+		t.Errorf("GetCodec(\"\") = %v, %v, want snappy", codec, err)
+	}
+	if _, err := GetCodec("lz4"); err == nil {
+		t.Error("GetCodec succeeded for an unknown codec")
+	}
+}
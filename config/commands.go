@@ -0,0 +1,63 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// commandSpec is a metric command written as an object, carrying its own timeout
+type commandSpec struct {
+	Cmd       string `json:"cmd"`
+	TimeoutMs int    `json:"timeout_ms"` // Replaces the command timeout for this command in parallel mode
+}
+
+// decodeCommandSpecs decodes metric commands given either as command strings or as {"cmd": ..., "timeout_ms": ...}
+// and returns the commands by name along with the timeouts of those that set one
+func decodeCommandSpecs(raw map[string]json.RawMessage) (map[string]string, map[string]int, error) {
+	commands := make(map[string]string, len(raw))
+	timeouts := make(map[string]int)
+	for name, value := range raw {
+		var cmd string
+		if err := json.Unmarshal(value, &cmd); err == nil {
+			commands[name] = cmd
+			continue
+		}
+
+		var spec commandSpec
+		if err := json.Unmarshal(value, &spec); err != nil {
+			return nil, nil, fmt.Errorf("command %s is neither a string nor an object with cmd: %w", name, err)
+		}
+		commands[name] = spec.Cmd
+		if spec.TimeoutMs > 0 {
+			timeouts[name] = spec.TimeoutMs
+		}
+	}
+	return commands, timeouts, nil
+}
+
+// splitCommandSpecs rewrites the object-form commands of a metrics section to command strings,
+// so the section decodes into Config, and returns their timeouts by name
+func splitCommandSpecs(section json.RawMessage) (json.RawMessage, map[string]int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(section, &fields); err != nil {
+		return nil, nil, err
+	}
+	if fields["commands"] == nil {
+		return section, nil, nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(fields["commands"], &raw); err != nil {
+		return nil, nil, err
+	}
+	commands, timeouts, err := decodeCommandSpecs(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fields["commands"], err = json.Marshal(commands); err != nil {
+		return nil, nil, err
+	}
+	section, err = json.Marshal(fields)
+	return section, timeouts, err
+}
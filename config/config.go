@@ -1,79 +1,691 @@
 package config
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/random"
+	"strings"
+	"sync"
 	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigPathEnv names the environment variable holding the config file path
+	ConfigPathEnv = "SSH_PLUGIN_CONFIG"
+	// DefaultConfigPath is used when ConfigPathEnv is not set
+	DefaultConfigPath = "config.json"
 )
 
 // Config represents the application configuration
 type Config struct {
 	SSH struct {
-		Timeout int `json:"timeout"` // Timeout in seconds
+		Timeout           int               `json:"timeout"`                 // Timeout in seconds
+		KnownHosts        string            `json:"known_hosts"`             // Path to a known_hosts file, empty disables host key checking
+		MaxConcurrency    int               `json:"max_concurrency"`         // Maximum number of devices processed at once
+		MaxSessions       int               `json:"max_sessions_per_device"` // Maximum number of sessions opened at once on a device, below the server's MaxSessions
+		Retries           int               `json:"retries"`                 // Extra connection attempts on transient failures
+		RetryBackoffMs    int               `json:"retry_backoff_ms"`        // Base backoff between attempts in milliseconds
+		KeepaliveInterval int               `json:"keepalive_interval"`      // Seconds between TCP and SSH keepalives
+		Ciphers           []string          `json:"ciphers"`                 // Allowed ciphers, empty uses the Go defaults
+		KeyExchanges      []string          `json:"kex"`                     // Allowed key exchange algorithms, empty uses the Go defaults
+		MACs              []string          `json:"macs"`                    // Allowed MAC algorithms, empty uses the Go defaults
+		ConnectRatePerSec int               `json:"connect_rate_per_sec"`    // New connections opened per second, 0 disables the limit
+		AuthMethods       []string          `json:"auth_methods"`            // Auth methods offered in order: "publickey", "password", "keyboard-interactive"
+		Env               map[string]string `json:"env"`                     // Environment variables set for metric commands, e.g. {"LANG": "C"}
+		ConnectTimeout    int               `json:"connect_timeout"`         // Seconds allowed for the TCP connect, 0 uses the device timeout
+		HandshakeTimeout  int               `json:"handshake_timeout"`       // Seconds allowed from the TCP connection to a logged-in SSH client, 0 uses the device timeout
+		SecretsFile       string            `json:"secrets_file"`            // JSON file of name to password entries, resolving the password_ref of device credentials
+		SOCKS5            struct {
+			Address  string `json:"address"`  // host:port of the proxy, empty dials devices directly
+			Username string `json:"username"` // Optional proxy username
+			Password string `json:"password"` // Optional proxy password
+		} `json:"socks5"`
 	} `json:"ssh"`
 	Metrics struct {
-		Commands map[string]string `json:"commands"`
+		Commands       map[string]string `json:"commands"`         // Metric name to command, or to {"cmd": ..., "timeout_ms": ...} to set the command's timeout
+		CommandsFile   string            `json:"commands_file"`    // JSON or YAML file of name to command entries, may add commands, overridden by commands
+		Parallel       bool              `json:"parallel"`         // Run each command in its own session instead of one combined command
+		Sudo           []string          `json:"sudo"`             // Names of commands run with sudo
+		Order          []string          `json:"order"`            // Command names in execution order, unlisted commands run after in name order
+		Groups         [][]string        `json:"groups"`           // Commands run one after another in a single session in parallel mode, a group runs under the longest timeouts_ms of its commands so a slow member holds up the rest
+		PTY            bool              `json:"pty"`              // Request a PTY for every command
+		PTYCommands    []string          `json:"pty_commands"`     // Names of commands run with a PTY
+		Vars           map[string]string `json:"vars"`             // Values for ${VAR} placeholders in commands, checked before the environment
+		Include        []string          `json:"include"`          // Metrics kept in results, empty keeps all
+		Exclude        []string          `json:"exclude"`          // Metrics removed from results, wins over include
+		MaxOutputBytes int64             `json:"max_output_bytes"` // Bytes of output a session may produce before it is stopped, covers all commands when they run combined
+		KeyPrefix      string            `json:"key_prefix"`       // Namespace prepended to every metric name in results, e.g. "ssh_"
+		TimeoutsMs     map[string]int    `json:"timeouts_ms"`      // Milliseconds each named command may run in parallel mode, replacing the command timeout, grouped commands share the longest one in their group
+		Systemd        bool              `json:"systemd"`          // Add the failed_units and journal_errors metrics on Linux, the host must run systemd
+		Docker         bool              `json:"docker"`           // Add per-container CPU and memory from docker stats on Linux as the result's containers
+		DebugRaw       bool              `json:"debug_raw"`        // Attach the combined output of each device to its result as _raw, for debugging parsers, parallel mode has none
+		UploadScript   bool              `json:"upload_script"`    // Run the combined commands as a script uploaded to /tmp instead of one long command line, parallel mode is unaffected
 	} `json:"metrics"`
+	Discovery struct {
+		TestCommand string `json:"test_command"` // Command that must succeed for a device to be discovered
+	} `json:"discovery"`
+	Filter struct {
+		Tags  []string `json:"tags"`  // Only devices carrying these tags are processed, empty processes all
+		Match string   `json:"match"` // "any" (default) or "all" of the tags must be present
+	} `json:"filter"`
 	Encryption struct {
-		Key string `json:"key"` // Hex-encoded AES key
+		Key     string   `json:"key"`     // Hex-encoded AES key
+		Keys    []string `json:"keys"`    // Hex-encoded AES keys input is decrypted with in order, the first encrypts output, excludes key
+		Enabled *bool    `json:"enabled"` // Encrypt metrics output, defaults to true
 	} `json:"encryption"`
+	Compression struct {
+		Codec string `json:"codec"` // "snappy" or "gzip"
+	} `json:"compression"`
+	Output struct {
+		Path      string `json:"path"`       // File results are written to, empty or "-" means stdout, tcp+tls://host:port sends them to a collector
+		Buffer    int    `json:"buffer"`     // Results queued for output before collectors block
+		Ordered   bool   `json:"ordered"`    // Emit results in input order instead of as they complete
+		Format    string `json:"format"`     // "json" (default) or "csv", csv applies to metrics mode
+		TLSCA     string `json:"tls_ca"`     // PEM file of CAs trusted for a tcp+tls collector, empty uses the system roots
+		FrameSize int    `json:"frame_size"` // Metrics results sealed together as one JSON array line, 0 or 1 seals each result alone
+		Checksum  bool   `json:"checksum"`   // Prefix every output line with its length and CRC-32 to detect truncation
+		Base64    string `json:"base64"`     // Alphabet of sealed lines and of the encrypted input, "std" (default) or "url"
+	} `json:"output"`
+	Batch struct {
+		DeadlineSec int  `json:"deadline_sec"` // Seconds a whole batch may run before unfinished devices are cancelled, 0 disables
+		AllowEmpty  bool `json:"allow_empty"`  // An input without devices emits an empty summary and succeeds instead of failing
+	} `json:"batch"`
+	Serve struct {
+		Addr string `json:"addr"` // Listen address for serve mode
+	} `json:"serve"`
+	Log struct {
+		Level string `json:"level"` // "debug", "info", "warn" or "error"
+	} `json:"log"`
+
+	secrets map[string]string // Passwords read from SSH.SecretsFile once per load
 }
 
-// LoadConfig loads configuration from config.json with safe defaults
+// LoadConfig loads configuration from $SSH_PLUGIN_CONFIG or ./config.json with safe defaults
+// Malformed or invalid settings fall back to their defaults with a warning, except where a default
+// would weaken security: an unparseable file, a malformed ssh section or an unknown auth method is an error,
+// as is an unusable secrets file or encryption key, or an unreadable explicit config file
 func LoadConfig() (*Config, error) {
 	// Set default configuration
 	defaultConfig := &Config{}
-	defaultConfig.SSH.Timeout = 5 // 5 seconds default
-	defaultConfig.Metrics.Commands = map[string]string{
-		"hostname":  "hostname",
-		"uptime":    "uptime -p",
-		"cpu":       "top -bn1 | grep 'Cpu(s)' | awk '{print $2 + $4}'",
-		"memory":    "free -g | awk '/Mem:/ {print $3}'",
-		"disk":      "df -BG / | awk 'NR==2 {print $3}'",
-		"processes": "ps aux | wc -l",
-	}
+	defaultConfig.SSH.Timeout = 5          // 5 seconds default
+	defaultConfig.SSH.MaxConcurrency = 100 // 100 devices at once by default
+	defaultConfig.SSH.MaxSessions = constants.MaxSessions
+	defaultConfig.SSH.RetryBackoffMs = 500 // Doubled on every retry
+	defaultConfig.SSH.KeepaliveInterval = 30
+	defaultConfig.Metrics.Commands = defaultMetricCommands()
+	defaultConfig.Metrics.MaxOutputBytes = constants.MaxOutputBytes
+	defaultConfig.Discovery.TestCommand = constants.DefaultDiscoveryTestCommand
+	defaultConfig.Filter.Match = "any"
 	defaultConfig.Encryption.Key = "" // No default key for security
+	defaultConfig.Compression.Codec = "snappy"
+	defaultConfig.Output.Buffer = 256
+	defaultConfig.Output.Format = "json"
+	defaultConfig.Output.Base64 = "std"
+	defaultConfig.Serve.Addr = "127.0.0.1:8080"
+	defaultConfig.Log.Level = "info"
+
+	// An explicit path from the environment must exist,
+	// otherwise fall back to ./config.json and then to defaults
+	configPath, explicit := os.LookupEnv(ConfigPathEnv)
+	if !explicit || configPath == "" {
+		configPath, explicit = DefaultConfigPath, false
+	}
 
-	// If config.json does not exist, return defaults
-	configFile, err := os.Open("/home/purvik/IdeaProjectsUltimate/nms-main/go/config.json")
+	configFile, err := os.Open(configPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return defaultConfig, nil
+		if os.IsNotExist(err) && !explicit {
+			return deterministic(defaultConfig), nil
 		}
 		return nil, err
 	}
 	defer configFile.Close()
 
-	// Decode config.json into temp struct
+	// Decode config.json section by section so one bad section only loses its own settings
+	// A file that does not parse at all is an error, falling back to defaults would drop ssh.known_hosts
+	var sections map[string]json.RawMessage
+	if err := json.NewDecoder(configFile).Decode(&sections); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", configPath, err)
+	}
+
 	userConfig := &Config{}
-	decoder := json.NewDecoder(configFile)
-	if err := decoder.Decode(userConfig); err != nil {
+	if err := decodeSections(userConfig, sections); err != nil {
 		return nil, err
 	}
 
 	// Merge userConfig over defaultConfig safely
 	if userConfig.SSH.Timeout > 0 {
-		defaultConfig.SSH.Timeout = userConfig.SSH.Timeout
+		defaultConfig.SSH.Timeout = clampSSHTimeout(userConfig.SSH.Timeout)
+	} else if userConfig.SSH.Timeout < 0 {
+		warnOnce("SSH timeout is invalid, using default", "timeout", userConfig.SSH.Timeout, "default", defaultConfig.SSH.Timeout)
+	}
+
+	if userConfig.SSH.ConnectTimeout > 0 {
+		defaultConfig.SSH.ConnectTimeout = clampSSHTimeout(userConfig.SSH.ConnectTimeout)
+	}
+	if userConfig.SSH.HandshakeTimeout > 0 {
+		defaultConfig.SSH.HandshakeTimeout = clampSSHTimeout(userConfig.SSH.HandshakeTimeout)
+	}
+
+	if userConfig.SSH.MaxConcurrency > 0 {
+		defaultConfig.SSH.MaxConcurrency = userConfig.SSH.MaxConcurrency
+	}
+
+	if userConfig.SSH.MaxSessions > 0 {
+		defaultConfig.SSH.MaxSessions = userConfig.SSH.MaxSessions
+	}
+
+	if userConfig.SSH.Retries > 0 {
+		defaultConfig.SSH.Retries = userConfig.SSH.Retries
+	}
+
+	if userConfig.SSH.RetryBackoffMs > 0 {
+		defaultConfig.SSH.RetryBackoffMs = userConfig.SSH.RetryBackoffMs
+	}
+
+	if userConfig.SSH.KeepaliveInterval > 0 {
+		defaultConfig.SSH.KeepaliveInterval = userConfig.SSH.KeepaliveInterval
+	}
+
+	defaultConfig.SSH.Ciphers = userConfig.SSH.Ciphers
+	defaultConfig.SSH.KeyExchanges = userConfig.SSH.KeyExchanges
+	defaultConfig.SSH.MACs = userConfig.SSH.MACs
+
+	if userConfig.SSH.ConnectRatePerSec > 0 {
+		defaultConfig.SSH.ConnectRatePerSec = userConfig.SSH.ConnectRatePerSec
+	}
+
+	// Falling back to the default methods could re-enable password auth, an unknown method is an error
+	for _, method := range userConfig.SSH.AuthMethods {
+		if !authMethods[method] {
+			return nil, fmt.Errorf("unsupported ssh auth method %q", method)
+		}
+	}
+	defaultConfig.SSH.AuthMethods = userConfig.SSH.AuthMethods
+
+	for name, value := range userConfig.SSH.Env {
+		if !envNamePattern.MatchString(name) {
+			warnOnce("Ignoring invalid ssh env variable name", "name", name)
+			continue
+		}
+		if defaultConfig.SSH.Env == nil {
+			defaultConfig.SSH.Env = make(map[string]string)
+		}
+		defaultConfig.SSH.Env[name] = value
+	}
+
+	if userConfig.SSH.SOCKS5.Address != "" {
+		defaultConfig.SSH.SOCKS5 = userConfig.SSH.SOCKS5
+	}
+
+	if userConfig.SSH.KnownHosts != "" {
+		defaultConfig.SSH.KnownHosts = userConfig.SSH.KnownHosts
+	}
+
+	// Without the file every device referring to a secret would fail with a misleading error
+	if userConfig.SSH.SecretsFile != "" {
+		secrets, err := loadSecretsFile(userConfig.SSH.SecretsFile)
+		if err != nil {
+			return nil, err
+		}
+		defaultConfig.SSH.SecretsFile = userConfig.SSH.SecretsFile
+		defaultConfig.secrets = secrets
+	}
+
+	// Commands from the commands file apply first so inline commands take precedence
+	timeoutsMs := make(map[string]int)
+	if userConfig.Metrics.CommandsFile != "" {
+		fileCommands, fileTimeouts, err := loadCommandsFile(userConfig.Metrics.CommandsFile)
+		if err != nil {
+			warnOnce("Ignoring commands file", "error", err)
+		} else {
+			addFileCommands(defaultConfig.Metrics.Commands, fileCommands)
+			maps.Copy(timeoutsMs, fileTimeouts)
+			defaultConfig.Metrics.CommandsFile = userConfig.Metrics.CommandsFile
+		}
+	}
+	for name, ms := range userConfig.Metrics.TimeoutsMs {
+		if ms > 0 {
+			timeoutsMs[name] = ms
+		}
+	}
+	if len(timeoutsMs) > 0 {
+		defaultConfig.Metrics.TimeoutsMs = timeoutsMs
 	}
 
 	if userConfig.Metrics.Commands != nil {
-		for key, defaultCmd := range defaultConfig.Metrics.Commands {
-			if userCmd, exists := userConfig.Metrics.Commands[key]; exists && userCmd != "" {
-				defaultConfig.Metrics.Commands[key] = userCmd
-			} else {
-				defaultConfig.Metrics.Commands[key] = defaultCmd
-			}
+		mergeUserCommands(defaultConfig.Metrics.Commands, userConfig.Metrics.Commands)
+	}
+
+	if err := substituteCommandVars(defaultConfig.Metrics.Commands, userConfig.Metrics.Vars); err != nil {
+		return nil, err
+	}
+	defaultConfig.Metrics.Vars = userConfig.Metrics.Vars
+
+	defaultConfig.Metrics.Parallel = userConfig.Metrics.Parallel
+	defaultConfig.Metrics.Sudo = userConfig.Metrics.Sudo
+	defaultConfig.Metrics.PTY = userConfig.Metrics.PTY
+	defaultConfig.Metrics.PTYCommands = userConfig.Metrics.PTYCommands
+	defaultConfig.Metrics.Order = userConfig.Metrics.Order
+	defaultConfig.Metrics.Groups = userConfig.Metrics.Groups
+	defaultConfig.Metrics.Include = userConfig.Metrics.Include
+	defaultConfig.Metrics.Exclude = userConfig.Metrics.Exclude
+	defaultConfig.Metrics.KeyPrefix = userConfig.Metrics.KeyPrefix
+	defaultConfig.Metrics.UploadScript = userConfig.Metrics.UploadScript
+	defaultConfig.Metrics.Systemd = userConfig.Metrics.Systemd
+	defaultConfig.Metrics.Docker = userConfig.Metrics.Docker
+	defaultConfig.Metrics.DebugRaw = userConfig.Metrics.DebugRaw
+
+	if userConfig.Metrics.MaxOutputBytes > 0 {
+		defaultConfig.Metrics.MaxOutputBytes = userConfig.Metrics.MaxOutputBytes
+	}
+
+	if userConfig.Discovery.TestCommand != "" {
+		defaultConfig.Discovery.TestCommand = userConfig.Discovery.TestCommand
+	}
+
+	defaultConfig.Filter.Tags = userConfig.Filter.Tags
+	if userConfig.Filter.Match != "" {
+		if userConfig.Filter.Match == "any" || userConfig.Filter.Match == "all" {
+			defaultConfig.Filter.Match = userConfig.Filter.Match
+		} else {
+			warnOnce("Invalid filter match, using default", "match", userConfig.Filter.Match, "default", defaultConfig.Filter.Match)
 		}
 	}
 
+	// With both set it would be unclear which key output is encrypted with
+	if userConfig.Encryption.Key != "" && len(userConfig.Encryption.Keys) > 0 {
+		return nil, fmt.Errorf("encryption.key and encryption.keys are both set, list the current key first in encryption.keys instead")
+	}
+
 	if userConfig.Encryption.Key != "" {
+		if _, err := DecodeEncryptionKey(userConfig.Encryption.Key); err != nil {
+			return nil, err
+		}
 		defaultConfig.Encryption.Key = userConfig.Encryption.Key
 	}
 
-	return defaultConfig, nil
+	// During a key rotation input may still be encrypted with an older key, output always uses the current, first one
+	for _, keyHex := range userConfig.Encryption.Keys {
+		if _, err := DecodeEncryptionKey(keyHex); err != nil {
+			return nil, fmt.Errorf("encryption.keys: %w", err)
+		}
+	}
+	defaultConfig.Encryption.Keys = userConfig.Encryption.Keys
+	if len(userConfig.Encryption.Keys) > 0 {
+		defaultConfig.Encryption.Key = userConfig.Encryption.Keys[0]
+	}
+
+	if userConfig.Encryption.Enabled != nil {
+		defaultConfig.Encryption.Enabled = userConfig.Encryption.Enabled
+	}
+
+	if userConfig.Compression.Codec != "" {
+		defaultConfig.Compression.Codec = userConfig.Compression.Codec
+	}
+
+	if userConfig.Output.Path != "" {
+		defaultConfig.Output.Path = userConfig.Output.Path
+	}
+
+	if userConfig.Output.Buffer > 0 {
+		defaultConfig.Output.Buffer = userConfig.Output.Buffer
+	}
+
+	defaultConfig.Output.Ordered = userConfig.Output.Ordered
+	defaultConfig.Output.TLSCA = userConfig.Output.TLSCA
+	defaultConfig.Output.Checksum = userConfig.Output.Checksum
+
+	if userConfig.Output.FrameSize > 0 {
+		defaultConfig.Output.FrameSize = userConfig.Output.FrameSize
+	}
+
+	if userConfig.Output.Format != "" {
+		if userConfig.Output.Format == "json" || userConfig.Output.Format == "csv" {
+			defaultConfig.Output.Format = userConfig.Output.Format
+		} else {
+			warnOnce("Invalid output format, using default", "format", userConfig.Output.Format, "default", defaultConfig.Output.Format)
+		}
+	}
+
+	if userConfig.Output.Base64 != "" {
+		if userConfig.Output.Base64 == "std" || userConfig.Output.Base64 == "url" {
+			defaultConfig.Output.Base64 = userConfig.Output.Base64
+		} else {
+			warnOnce("Invalid output base64 encoding, using default", "base64", userConfig.Output.Base64, "default", defaultConfig.Output.Base64)
+		}
+	}
+
+	if userConfig.Batch.DeadlineSec > 0 {
+		defaultConfig.Batch.DeadlineSec = userConfig.Batch.DeadlineSec
+	}
+	defaultConfig.Batch.AllowEmpty = userConfig.Batch.AllowEmpty
+
+	if userConfig.Serve.Addr != "" {
+		defaultConfig.Serve.Addr = userConfig.Serve.Addr
+	}
+
+	if userConfig.Log.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(userConfig.Log.Level)); err != nil {
+			warnOnce("Invalid log level, using default", "level", userConfig.Log.Level, "default", defaultConfig.Log.Level)
+		} else {
+			defaultConfig.Log.Level = userConfig.Log.Level
+		}
+	}
+
+	return deterministic(defaultConfig), nil
+}
+
+// clampSSHTimeout limits a timeout in seconds to [MinSSHTimeout, MaxSSHTimeout], logging when it is adjusted
+func clampSSHTimeout(timeout int) int {
+	if timeout < constants.MinSSHTimeout {
+		warnOnce("SSH timeout is below minimum, clamping", "timeout", timeout, "min", constants.MinSSHTimeout)
+		return constants.MinSSHTimeout
+	}
+	if timeout > constants.MaxSSHTimeout {
+		warnOnce("SSH timeout is above maximum, clamping", "timeout", timeout, "max", constants.MaxSSHTimeout)
+		return constants.MaxSSHTimeout
+	}
+	return timeout
+}
+
+// DecodeEncryptionKey decodes a hex AES key and checks it is 16, 24 or 32 bytes long
+func DecodeEncryptionKey(keyHex string) ([]byte, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex encryption key: %w", err)
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid encryption key length %d bytes, expected 16, 24 or 32 bytes (32, 48 or 64 hex characters)", len(key))
+	}
+}
+
+// EncryptionKey returns the decoded AES key from the configuration
+func (c *Config) EncryptionKey() ([]byte, error) {
+	if c.Encryption.Key == "" {
+		return nil, fmt.Errorf("encryption key not found in config")
+	}
+	return DecodeEncryptionKey(c.Encryption.Key)
+}
+
+// DecryptionKeys returns the decoded AES keys input may be encrypted with, the current key first
+func (c *Config) DecryptionKeys() ([][]byte, error) {
+	current, err := c.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{current}
+	for _, keyHex := range c.Encryption.Keys {
+		key, err := DecodeEncryptionKey(keyHex)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// LogLevel returns the configured minimum log level
+func (c *Config) LogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return level, fmt.Errorf("invalid log level %q: %w", c.Log.Level, err)
+	}
+	return level, nil
+}
+
+// Base64Encoding returns the base64 alphabet selected by output.base64, URL-safe for "url"
+func (c *Config) Base64Encoding() *base64.Encoding {
+	if c.Output.Base64 == "url" {
+		return base64.URLEncoding
+	}
+	return base64.StdEncoding
+}
+
+// EncryptionEnabled reports whether metrics output should be encrypted
+func (c *Config) EncryptionEnabled() bool {
+	return c.Encryption.Enabled == nil || *c.Encryption.Enabled
+}
+
+// deterministic makes a build tagged deterministic run the commands of a device one at a time in order
+// and emit results in input order so its output is reproducible, other builds get cfg unchanged
+func deterministic(cfg *Config) *Config {
+	if random.Deterministic {
+		cfg.SSH.MaxSessions = 1
+		cfg.Output.Ordered = true
+	}
+	return cfg
+}
+
+// SameSSH reports whether c and other connect the same way, with equal ssh sections and secrets
+// Clients dialled under one can then be reused under the other
+func (c *Config) SameSSH(other *Config) bool {
+	return reflect.DeepEqual(c.SSH, other.SSH) && maps.Equal(c.secrets, other.secrets)
+}
+
+// authMethods lists the accepted ssh.auth_methods entries
+var authMethods = map[string]bool{
+	"publickey":            true,
+	"password":             true,
+	"keyboard-interactive": true,
+}
+
+// decodeSections decodes each top-level config section into userConfig
+// A section that fails to decode is left empty, so its defaults apply, and a warning is logged
+// The ssh and encryption sections are the exception, defaults there could turn off host key checking
+// or restricted auth methods, and without a usable key no input can be read
+func decodeSections(userConfig *Config, sections map[string]json.RawMessage) error {
+	targets := map[string]any{
+		"ssh":         &userConfig.SSH,
+		"metrics":     &userConfig.Metrics,
+		"discovery":   &userConfig.Discovery,
+		"filter":      &userConfig.Filter,
+		"encryption":  &userConfig.Encryption,
+		"compression": &userConfig.Compression,
+		"output":      &userConfig.Output,
+		"batch":       &userConfig.Batch,
+		"serve":       &userConfig.Serve,
+		"log":         &userConfig.Log,
+	}
+
+	for name, raw := range sections {
+		target, ok := targets[name]
+		if !ok {
+			continue
+		}
+
+		// Commands with their own timeout are objects, their timeouts join metrics.timeouts_ms
+		var specTimeouts map[string]int
+		var err error
+		if name == "metrics" {
+			raw, specTimeouts, err = splitCommandSpecs(raw)
+		}
+		if err == nil {
+			err = json.Unmarshal(raw, target)
+		}
+		if err != nil {
+			if name == "ssh" || name == "encryption" {
+				return fmt.Errorf("invalid %s section: %w", name, err)
+			}
+			warnOnce("Config section is malformed, using defaults", "section", name, "error", err)
+			reflect.ValueOf(target).Elem().SetZero()
+			continue
+		}
+
+		if len(specTimeouts) > 0 {
+			if userConfig.Metrics.TimeoutsMs == nil {
+				userConfig.Metrics.TimeoutsMs = make(map[string]int)
+			}
+			maps.Copy(userConfig.Metrics.TimeoutsMs, specTimeouts)
+		}
+	}
+	return nil
+}
+
+// defaultMetricCommands returns the built-in Linux metric commands
+func defaultMetricCommands() map[string]string {
+	return map[string]string{
+		"hostname":  "hostname",
+		"uptime":    "uptime -p",
+		"cpu":       "top -bn1 | grep 'Cpu(s)' | awk '{print $2 + $4}'",
+		"memory":    "free -b | awk '/Mem:/ {print $3 \"B\"}'",
+		"disk":      "df -B1 --output=used / | awk 'NR==2 {print $1 \"B\"}'",
+		"processes": "ps aux | wc -l",
+	}
+}
+
+// mergeUserCommands replaces the known commands with the non-empty user ones of the same name
+func mergeUserCommands(commands map[string]string, userCommands map[string]string) {
+	for key := range commands {
+		if userCmd, exists := userCommands[key]; exists && userCmd != "" {
+			commands[key] = userCmd
+		}
+	}
+}
+
+// addFileCommands sets every non-empty command from the commands file, including names
+// the defaults do not have
+func addFileCommands(commands map[string]string, fileCommands map[string]string) {
+	for name, cmd := range fileCommands {
+		if cmd != "" {
+			commands[name] = cmd
+		}
+	}
+}
+
+// loadCommandsFile reads an object mapping metric names to commands, written like metrics.commands,
+// and returns the commands along with the timeouts set for them
+// Files ending in .yaml or .yml are read as YAML, any other as JSON
+func loadCommandsFile(path string) (map[string]string, map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read commands file: %w", err)
+	}
+
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, nil, fmt.Errorf("invalid commands file %s: %w", path, err)
+		}
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid commands file %s: %w", path, err)
+	}
+	commands, timeouts, err := decodeCommandSpecs(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid commands file %s: %w", path, err)
+	}
+	return commands, timeouts, nil
+}
+
+// yamlToJSON converts a YAML document to JSON so it decodes like the JSON form
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// envNamePattern matches an environment variable name a POSIX shell can export
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// commandVarPattern matches a ${VAR} placeholder, plain $VAR is left to the remote shell
+var commandVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// substituteCommandVars replaces ${VAR} placeholders in commands with the value from vars or the environment
+// A placeholder that resolves to neither is an error
+func substituteCommandVars(commands map[string]string, vars map[string]string) error {
+	for name, cmd := range commands {
+		var missing []string
+		commands[name] = commandVarPattern.ReplaceAllStringFunc(cmd, func(placeholder string) string {
+			key := commandVarPattern.FindStringSubmatch(placeholder)[1]
+			if value, ok := vars[key]; ok {
+				return value
+			}
+			if value, ok := os.LookupEnv(key); ok {
+				return value
+			}
+			missing = append(missing, key)
+			return placeholder
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("metric command %s: unresolved variables %s", name, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// GetRetryBackoff returns the base retry backoff as a time.Duration
+func (c *Config) GetRetryBackoff() time.Duration {
+	return time.Duration(c.SSH.RetryBackoffMs) * time.Millisecond
+}
+
+// GetKeepaliveInterval returns the keepalive interval as a time.Duration
+func (c *Config) GetKeepaliveInterval() time.Duration {
+	return time.Duration(c.SSH.KeepaliveInterval) * time.Second
+}
+
+// DeviceTimeout returns the SSH timeout for a device with the given timeout_sec override
+// A zero override uses ssh.timeout, others are clamped like it
+func (c *Config) DeviceTimeout(timeoutSec int) time.Duration {
+	if timeoutSec <= 0 {
+		return c.GetSSHTimeout()
+	}
+	return time.Duration(clampSSHTimeout(timeoutSec)) * time.Second
+}
+
+// ConnectTimeout returns the time allowed for the TCP connect, deviceTimeout unless ssh.connect_timeout is set
+func (c *Config) ConnectTimeout(deviceTimeout time.Duration) time.Duration {
+	if c.SSH.ConnectTimeout <= 0 {
+		return deviceTimeout
+	}
+	return time.Duration(c.SSH.ConnectTimeout) * time.Second
+}
+
+// HandshakeTimeout returns the time allowed for the SSH handshake and authentication,
+// deviceTimeout unless ssh.handshake_timeout is set
+func (c *Config) HandshakeTimeout(deviceTimeout time.Duration) time.Duration {
+	if c.SSH.HandshakeTimeout <= 0 {
+		return deviceTimeout
+	}
+	return time.Duration(c.SSH.HandshakeTimeout) * time.Second
 }
 
 // GetSSHTimeout returns the SSH timeout as a time.Duration
 func (c *Config) GetSSHTimeout() time.Duration {
 	return time.Duration(c.SSH.Timeout) * time.Second
 }
+
+// warned holds the config warnings already logged, LoadConfig runs again on every serve reload
+// and for each call to FromContext without a config, which would otherwise repeat every warning
+var warned sync.Map
+
+// warnOnce logs a warning the first time the same message and attributes are seen
+func warnOnce(msg string, args ...any) {
+	key := fmt.Sprint(append([]any{msg}, args...)...)
+	if _, loaded := warned.LoadOrStore(key, struct{}{}); !loaded {
+		slog.Warn(msg, args...)
+	}
+}
@@ -0,0 +1,442 @@
+package config
+
+import (
+	"encoding/base64"
+	"maps"
+	"os"
+	"path/filepath"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/random"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a temporary config file and points ConfigPathEnv at it
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ConfigPathEnv, path)
+	return path
+}
+
+// loadTestConfig loads content as the config file
+func loadTestConfig(t *testing.T, content string) *Config {
+	t.Helper()
+	writeConfig(t, content)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+func TestClampSSHTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout int
+		want    int
+	}{
+		{"below minimum", constants.MinSSHTimeout - 4, constants.MinSSHTimeout},
+		{"at minimum", constants.MinSSHTimeout, constants.MinSSHTimeout},
+		{"in range", 20, 20},
+		{"at maximum", constants.MaxSSHTimeout, constants.MaxSSHTimeout},
+		{"above maximum", constants.MaxSSHTimeout + 1, constants.MaxSSHTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampSSHTimeout(tt.timeout); got != tt.want {
+				t.Errorf("clampSSHTimeout(%d) = %d, want %d", tt.timeout, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSSHTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   int
+	}{
+		{"below minimum", `{"ssh": {"timeout": 1}}`, constants.MinSSHTimeout},
+		{"above maximum", `{"ssh": {"timeout": 600}}`, constants.MaxSSHTimeout},
+		{"in range", `{"ssh": {"timeout": 20}}`, 20},
+		{"negative uses default", `{"ssh": {"timeout": -3}}`, 5},
+		{"unset uses default", `{}`, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.config)
+			if cfg.SSH.Timeout != tt.want {
+				t.Errorf("got timeout %d, want %d", cfg.SSH.Timeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPathFromEnv(t *testing.T) {
+	writeConfig(t, `{"serve": {"addr": "127.0.0.1:9999"}}`)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Serve.Addr != "127.0.0.1:9999" {
+		t.Errorf("got serve addr %q, want the one from the file in %s", cfg.Serve.Addr, ConfigPathEnv)
+	}
+}
+
+func TestLoadConfigMissingExplicitPath(t *testing.T) {
+	t.Setenv(ConfigPathEnv, filepath.Join(t.TempDir(), "missing.json"))
+
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LoadConfig succeeded, a missing explicit config file must be an error")
+	}
+}
+
+func TestLoadConfigDefaultPath(t *testing.T) {
+	t.Setenv(ConfigPathEnv, "")
+
+	// Without ./config.json the defaults apply
+	t.Chdir(t.TempDir())
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Serve.Addr != "127.0.0.1:8080" {
+		t.Errorf("got serve addr %q, want the default", cfg.Serve.Addr)
+	}
+
+	// ./config.json is read when present
+	if err := os.WriteFile(DefaultConfigPath, []byte(`{"serve": {"addr": "127.0.0.1:9999"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Serve.Addr != "127.0.0.1:9999" {
+		t.Errorf("got serve addr %q, want the one from %s", cfg.Serve.Addr, DefaultConfigPath)
+	}
+}
+
+func TestDecodeEncryptionKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyHex  string
+		wantLen int
+	}{
+		{"AES-128", strings.Repeat("ab", 16), 16},
+		{"AES-192", strings.Repeat("ab", 24), 24},
+		{"AES-256", strings.Repeat("ab", 32), 32},
+		{"too short", strings.Repeat("ab", 15), 0},
+		{"between lengths", strings.Repeat("ab", 20), 0},
+		{"too long", strings.Repeat("ab", 33), 0},
+		{"not hex", strings.Repeat("zz", 16), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := DecodeEncryptionKey(tt.keyHex)
+			if tt.wantLen == 0 {
+				if err == nil {
+					t.Errorf("DecodeEncryptionKey succeeded with a %d character key", len(tt.keyHex))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeEncryptionKey: %v", err)
+			}
+			if len(key) != tt.wantLen {
+				t.Errorf("got %d byte key, want %d", len(key), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidKeyLength(t *testing.T) {
+	writeConfig(t, `{"encryption": {"key": "`+strings.Repeat("ab", 20)+`"}}`)
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LoadConfig succeeded with a 20 byte encryption key")
+	}
+}
+
+func TestSubstituteCommandVars(t *testing.T) {
+	t.Setenv("PLUGIN_TEST_MOUNT", "/data")
+
+	tests := []struct {
+		name    string
+		command string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{"from vars", "ip -s link show ${IFACE}", map[string]string{"IFACE": "eth1"}, "ip -s link show eth1", ""},
+		{"from environment", "df -h ${PLUGIN_TEST_MOUNT}", nil, "df -h /data", ""},
+		{"vars before environment", "df -h ${PLUGIN_TEST_MOUNT}", map[string]string{"PLUGIN_TEST_MOUNT": "/var"}, "df -h /var", ""},
+		{"empty value", "echo ${EMPTY}x", map[string]string{"EMPTY": ""}, "echo x", ""},
+		{"shell variables kept", "echo $HOME ${IFACE}", map[string]string{"IFACE": "eth1"}, "echo $HOME eth1", ""},
+		{"unresolved", "ip link show ${PLUGIN_TEST_MISSING} ${IFACE}", map[string]string{"IFACE": "eth1"}, "", "PLUGIN_TEST_MISSING"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := map[string]string{"net": tt.command}
+			err := substituteCommandVars(commands, tt.vars)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("substituteCommandVars: %v", err)
+			}
+			if commands["net"] != tt.want {
+				t.Errorf("got command %q, want %q", commands["net"], tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCommandVars(t *testing.T) {
+	t.Setenv("PLUGIN_TEST_MOUNT", "/data")
+	cfg := loadTestConfig(t, `{"metrics": {"vars": {"IFACE": "eth1"}, "commands": {"hostname": "cat /sys/class/net/${IFACE}/address", "disk": "df -h ${PLUGIN_TEST_MOUNT}"}}}`)
+
+	if got := cfg.Metrics.Commands["hostname"]; got != "cat /sys/class/net/eth1/address" {
+		t.Errorf("got hostname command %q", got)
+	}
+	if got := cfg.Metrics.Commands["disk"]; got != "df -h /data" {
+		t.Errorf("got disk command %q", got)
+	}
+
+	// A placeholder left unresolved fails the load instead of running a broken command
+	writeConfig(t, `{"metrics": {"commands": {"hostname": "cat ${PLUGIN_TEST_MISSING}"}}}`)
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "PLUGIN_TEST_MISSING") {
+		t.Errorf("got error %v, want one naming PLUGIN_TEST_MISSING", err)
+	}
+}
+
+// writeCommandsFile writes content as a commands file named name and returns its path
+func writeCommandsFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigCommandsFile(t *testing.T) {
+	defaults := defaultMetricCommands()
+	jsonFile := writeCommandsFile(t, "commands.json", `{"hostname": "hostname -f", "kernel": "uname -r", "disk": {"cmd": "df -h /", "timeout_ms": 3000}}`)
+	yamlFile := writeCommandsFile(t, "commands.yaml", "hostname: hostname -f\nkernel: uname -r\ndisk:\n  cmd: df -h /\n  timeout_ms: 3000\n")
+
+	for name, path := range map[string]string{"json": jsonFile, "yaml": yamlFile} {
+		t.Run(name+" file only", func(t *testing.T) {
+			cfg := loadTestConfig(t, `{"metrics": {"commands_file": "`+path+`"}}`)
+			want := map[string]string{"hostname": "hostname -f", "kernel": "uname -r", "disk": "df -h /", "uptime": defaults["uptime"]}
+			for metric, cmd := range want {
+				if got := cfg.Metrics.Commands[metric]; got != cmd {
+					t.Errorf("got %s command %q, want %q", metric, got, cmd)
+				}
+			}
+			if got := cfg.Metrics.TimeoutsMs["disk"]; got != 3000 {
+				t.Errorf("got disk timeout %d, want 3000 from the file", got)
+			}
+		})
+	}
+
+	t.Run("inline overrides file", func(t *testing.T) {
+		cfg := loadTestConfig(t, `{"metrics": {"commands_file": "`+jsonFile+`", "commands": {"hostname": "cat /etc/hostname"}}}`)
+		if got := cfg.Metrics.Commands["hostname"]; got != "cat /etc/hostname" {
+			t.Errorf("got hostname command %q, want the inline one", got)
+		}
+		if got := cfg.Metrics.Commands["kernel"]; got != "uname -r" {
+			t.Errorf("got kernel command %q, want the one from the file", got)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		cfg := loadTestConfig(t, `{"metrics": {"commands_file": "`+filepath.Join(t.TempDir(), "missing.json")+`"}}`)
+		if got := cfg.Metrics.Commands["hostname"]; got != defaults["hostname"] {
+			t.Errorf("got hostname command %q, want the default", got)
+		}
+	})
+}
+
+func TestLoadConfigMalformedSections(t *testing.T) {
+	defaults := defaultMetricCommands()
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"commands not an object", `{"metrics": {"commands": ["hostname"]}, "serve": {"addr": "127.0.0.1:9999"}}`},
+		{"command not a string", `{"metrics": {"commands": {"hostname": 5}}, "serve": {"addr": "127.0.0.1:9999"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.config)
+			if !maps.Equal(cfg.Metrics.Commands, defaults) {
+				t.Errorf("got commands %v, want the defaults", cfg.Metrics.Commands)
+			}
+			// The other sections still apply
+			if cfg.Serve.Addr != "127.0.0.1:9999" {
+				t.Errorf("got serve addr %q, want the configured one", cfg.Serve.Addr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMalformedRequiredSections(t *testing.T) {
+	for _, config := range []string{
+		`{"encryption": {"key": 5}}`,
+		`{"ssh": {"timeout": "slow"}}`,
+		`{"metrics": `,
+	} {
+		writeConfig(t, config)
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("LoadConfig succeeded with %s", config)
+		}
+	}
+}
+
+func TestDeviceTimeout(t *testing.T) {
+	cfg := loadTestConfig(t, `{"ssh": {"timeout": 20}}`)
+
+	tests := []struct {
+		name       string
+		timeoutSec int
+		want       time.Duration
+	}{
+		{"unset uses global", 0, 20 * time.Second},
+		{"negative uses global", -1, 20 * time.Second},
+		{"override", 45, 45 * time.Second},
+		{"below minimum", 1, constants.MinSSHTimeout * time.Second},
+		{"above maximum", 600, constants.MaxSSHTimeout * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.DeviceTimeout(tt.timeoutSec); got != tt.want {
+				t.Errorf("DeviceTimeout(%d) = %s, want %s", tt.timeoutSec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCommandTimeouts(t *testing.T) {
+	cfg := loadTestConfig(t, `{"metrics": {"commands": {
+		"hostname": "hostname",
+		"cpu": {"cmd": "top -bn1 | head -5", "timeout_ms": 250},
+		"disk": {"cmd": "df -h /"}
+	}}}`)
+
+	if got := cfg.Metrics.Commands["cpu"]; got != "top -bn1 | head -5" {
+		t.Errorf("got cpu command %q, want the cmd of its object", got)
+	}
+	if got := cfg.Metrics.Commands["disk"]; got != "df -h /" {
+		t.Errorf("got disk command %q, want the cmd of its object", got)
+	}
+	if want := map[string]int{"cpu": 250}; !maps.Equal(cfg.Metrics.TimeoutsMs, want) {
+		t.Errorf("got timeouts %v, want %v", cfg.Metrics.TimeoutsMs, want)
+	}
+}
+
+func TestBase64Encoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *base64.Encoding
+	}{
+		{"unset", `{}`, base64.StdEncoding},
+		{"std", `{"output": {"base64": "std"}}`, base64.StdEncoding},
+		{"url", `{"output": {"base64": "url"}}`, base64.URLEncoding},
+		{"unknown falls back to std", `{"output": {"base64": "rawurl"}}`, base64.StdEncoding},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.content)
+			if got := cfg.Base64Encoding(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMaxSessions(t *testing.T) {
+	if random.Deterministic {
+		t.Skip("deterministic builds force one session at a time")
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    int
+	}{
+		{"unset", `{}`, constants.MaxSessions},
+		{"zero keeps the default", `{"ssh": {"max_sessions_per_device": 0}}`, constants.MaxSessions},
+		{"set", `{"ssh": {"max_sessions_per_device": 2}}`, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loadTestConfig(t, tt.content).SSH.MaxSessions; got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDeterministic(t *testing.T) {
+	cfg := loadTestConfig(t, `{"ssh": {"max_sessions_per_device": 8}, "output": {"ordered": false}}`)
+
+	// Deterministic builds run one session at a time and emit results in input order
+	wantSessions, wantOrdered := 8, false
+	if random.Deterministic {
+		wantSessions, wantOrdered = 1, true
+	}
+	if cfg.SSH.MaxSessions != wantSessions || cfg.Output.Ordered != wantOrdered {
+		t.Errorf("got max sessions %d and ordered %v, want %d and %v", cfg.SSH.MaxSessions, cfg.Output.Ordered, wantSessions, wantOrdered)
+	}
+}
+
+func TestLoadConfigEncryptionKeys(t *testing.T) {
+	const first = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	const second = "101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+
+	cfg := loadTestConfig(t, `{"encryption": {"keys": ["`+first+`", "`+second+`"]}}`)
+	if cfg.Encryption.Key != first {
+		t.Errorf("got current key %q, want the first listed", cfg.Encryption.Key)
+	}
+	keys, err := cfg.DecryptionKeys()
+	if err != nil {
+		t.Fatalf("DecryptionKeys: %v", err)
+	}
+	if len(keys) != 2 || keys[0][0] != 0x00 || keys[1][0] != 0x10 {
+		t.Errorf("got keys %x, want both in listed order", keys)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"key and keys", `{"encryption": {"key": "` + first + `", "keys": ["` + second + `"]}}`},
+		{"invalid entry", `{"encryption": {"keys": ["` + first + `", "not-hex"]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(t, tt.content)
+			if _, err := LoadConfig(); err == nil {
+				t.Error("LoadConfig succeeded, want an error")
+			}
+		})
+	}
+}
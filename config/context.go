@@ -0,0 +1,20 @@
+package config
+
+import "context"
+
+// contextKey keys the configuration carried by a context
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying cfg
+// Work started with it uses cfg even if the configuration is reloaded meanwhile
+func NewContext(ctx context.Context, cfg *Config) context.Context {
+	return context.WithValue(ctx, contextKey{}, cfg)
+}
+
+// FromContext returns the configuration carried by ctx, loading it with LoadConfig when there is none
+func FromContext(ctx context.Context) (*Config, error) {
+	if cfg, ok := ctx.Value(contextKey{}).(*Config); ok {
+		return cfg, nil
+	}
+	return LoadConfig()
+}
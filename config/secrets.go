@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadSecretsFile reads a JSON object mapping secret names to passwords
+func loadSecretsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %w", err)
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("invalid secrets file %s: %w", path, err)
+	}
+	return secrets, nil
+}
+
+// Secret returns the password stored under ref in the secrets file
+func (c *Config) Secret(ref string) (string, error) {
+	if c.SSH.SecretsFile == "" {
+		return "", fmt.Errorf("password_ref %q is set but no ssh.secrets_file is loaded", ref)
+	}
+	password, ok := c.secrets[ref]
+	if !ok {
+		return "", fmt.Errorf("password_ref %q not found in %s", ref, c.SSH.SecretsFile)
+	}
+	return password, nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeSecrets writes content to a temporary secrets file and returns its path
+func writeSecrets(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSecret(t *testing.T) {
+	path := writeSecrets(t, `{"core-router": "s3cret"}`)
+	cfg := loadTestConfig(t, `{"ssh": {"secrets_file": `+strconv.Quote(path)+`}}`)
+
+	password, err := cfg.Secret("core-router")
+	if err != nil || password != "s3cret" {
+		t.Errorf("got %q, %v, want the stored password", password, err)
+	}
+	if _, err := cfg.Secret("edge-router"); err == nil || !strings.Contains(err.Error(), "edge-router") {
+		t.Errorf("got error %v for a missing ref, want one naming it", err)
+	}
+}
+
+func TestSecretWithoutFile(t *testing.T) {
+	cfg := loadTestConfig(t, `{}`)
+	if _, err := cfg.Secret("core-router"); err == nil {
+		t.Error("got no error resolving a ref without a secrets file")
+	}
+}
+
+func TestLoadConfigUnusableSecretsFile(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"missing", filepath.Join(t.TempDir(), "missing.json")},
+		{"malformed", writeSecrets(t, `["not", "an", "object"]`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(t, `{"ssh": {"secrets_file": `+strconv.Quote(tt.path)+`}}`)
+			if _, err := LoadConfig(); err == nil {
+				t.Error("LoadConfig succeeded with an unusable secrets file")
+			}
+		})
+	}
+}
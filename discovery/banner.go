@@ -0,0 +1,23 @@
+package discovery
+
+import "regexp"
+
+// serverSoftwarePatterns match the banners of common SSH servers, capturing the version
+var serverSoftwarePatterns = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"OpenSSH", regexp.MustCompile(`^SSH-[0-9.]+-OpenSSH_([^\s]+)`)},
+	{"Dropbear", regexp.MustCompile(`^SSH-[0-9.]+-dropbear_([^\s]+)`)},
+}
+
+// DetectServerSoftware returns the server implementation and version named by an SSH banner,
+// e.g. "OpenSSH 8.9p1" for "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3", or "" for unrecognised servers
+func DetectServerSoftware(banner string) string {
+	for _, software := range serverSoftwarePatterns {
+		if match := software.pattern.FindStringSubmatch(banner); match != nil {
+			return software.name + " " + match[1]
+		}
+	}
+	return ""
+}
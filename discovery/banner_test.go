@@ -0,0 +1,25 @@
+package discovery
+
+import "testing"
+
+func TestDetectServerSoftware(t *testing.T) {
+	tests := []struct {
+		banner string
+		want   string
+	}{
+		{"SSH-2.0-OpenSSH_9.6", "OpenSSH 9.6"},
+		{"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6", "OpenSSH 8.9p1"},
+		{"SSH-1.99-OpenSSH_3.9p1", "OpenSSH 3.9p1"},
+		{"SSH-2.0-dropbear_2022.83", "Dropbear 2022.83"},
+		{"SSH-2.0-dropbear", ""},
+		{"SSH-2.0-Cisco-1.25", ""},
+		{"SSH-2.0-Go", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := DetectServerSoftware(tt.banner); got != tt.want {
+			t.Errorf("DetectServerSoftware(%q) = %q, want %q", tt.banner, got, tt.want)
+		}
+	}
+}
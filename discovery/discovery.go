@@ -1,47 +1,179 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"runtime/debug"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
 	"ssh-plugin/models"
 	"ssh-plugin/utils"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // PerformDiscovery attempts to establish an SSH connection to discover if a device is accessible
-// It checks port availability, SSH authentication, and executes a test command
+// It resolves the hostname, finds an open port among the candidates, checks SSH authentication, and executes a test command
 // Panics are caught and converted to error results to prevent process crashes
-func PerformDiscovery(device models.Device, timeout time.Duration) (result models.DiscoveryResult) {
+func PerformDiscovery(ctx context.Context, device models.Device, timeout time.Duration) (result models.DiscoveryResult) {
+	// Registered first so it runs last and logs the result a recovered panic produced
+	defer func() {
+		slog.Debug("Discovery finished", "device_id", device.ID, "success", result.Success, "code", result.Code, "step", result.Step)
+	}()
+
 	// Recover from panics to ensure the process continues for other devices
 	defer func() {
 		if r := recover(); r != nil {
-			result = models.NewDiscoveryResult(device.ID, false, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+			result = models.NewDiscoveryResult(device.ID, false, constants.DiscoveryPanic, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
 		}
 	}()
 
-	// Step 1: Check if the port is open
-	if !utils.IsPortOpen(device.IP, device.Port, timeout/2) {
-		return models.NewDiscoveryResult(device.ID, false, "port")
+	// Devices still queued when the batch is cancelled are not probed
+	if ctx.Err() != nil {
+		return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryCancelled, "cancelled")
+	}
+
+	// The configuration was validated at startup, fall back to the defaults if it cannot be reloaded
+	testCommand := constants.DefaultDiscoveryTestCommand
+	proxied := false
+	if cfg, err := config.FromContext(ctx); err == nil {
+		testCommand = cfg.Discovery.TestCommand
+		proxied = cfg.SSH.SOCKS5.Address != ""
+	}
+
+	// A device behind a bastion is neither resolved nor probed from here, only the bastion reaches it,
+	// the connection through the bastion in step 3 checks it on its first candidate port
+	jumped := device.Jump != nil && device.Jump.Host != ""
+	if jumped {
+		device.Port = candidatePorts(device)[0]
+	} else {
+		// Step 1: Resolve the hostname, unless the proxy resolves it
+		if !proxied {
+			if _, err := utils.ResolveHost(ctx, device.IP); err != nil {
+				return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryDNSFailed, "dns")
+			}
+		}
+
+		// Step 2: Find an open SSH port, the rest of discovery uses it
+		// A refused port shows the host is up, so it is told apart from a host that never answers
+		port, state := findOpenPort(ctx, device, timeout/2)
+		switch state {
+		case utils.PortClosed:
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryPortClosed, "port")
+		case utils.PortUnreachable:
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryUnreachable, "unreachable")
+		}
+		device.Port = port
 	}
 
-	// Step 2: Establish SSH connection
-	client, err := utils.CreateSSHClient(device, timeout)
+	// Step 3: Establish SSH connection
+	// The host key is reported whether or not it verifies, for building a known_hosts baseline
+	ctx, hostKey := utils.WithHostKeyRecorder(ctx)
+	defer func() {
+		result.Fingerprint = hostKey.Fingerprint()
+	}()
+	client, err := utils.CreateSSHClient(ctx, device, timeout)
 	if err != nil {
-		return models.NewDiscoveryResult(device.ID, false, "sshAuth")
+		if strings.HasPrefix(err.Error(), constants.ErrCancelled) {
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryCancelled, "cancelled")
+		}
+		if strings.HasPrefix(err.Error(), constants.ErrDNSFailed) {
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryDNSFailed, "dns")
+		}
+		if strings.HasPrefix(err.Error(), constants.ErrHostKeyChanged) {
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryHostKeyChanged, "hostKeyChanged")
+		}
+		if strings.HasPrefix(err.Error(), constants.ErrHostKeyUnknown) {
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryHostKeyUnknown, "hostKeyUnknown")
+		}
+		// Without the port probe a device the bastion cannot reach only shows up here
+		if jumped && (strings.HasPrefix(err.Error(), constants.ErrConnectionFailed) || strings.HasPrefix(err.Error(), constants.ErrTimeout)) {
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryUnreachable, "unreachable")
+		}
+		return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryAuthFailed, "sshAuth")
 	}
 	defer client.Close()
 
-	// Step 3: Execute a basic command (e.g., uptime)
+	// Report the server software on every result from here on, successful or not
+	serverVersion := string(client.ServerVersion())
+	defer func() {
+		result.ServerVersion = serverVersion
+		result.ServerSoftware = DetectServerSoftware(serverVersion)
+	}()
+
+	// Step 4: Execute the configured test command
 	session, err := client.NewSession()
 	if err != nil {
-		return models.NewDiscoveryResult(device.ID, false, "session")
+		return models.NewDiscoveryResult(device.ID, false, constants.DiscoverySessionFailed, "session")
 	}
 	defer session.Close()
 
-	if err := session.Run("uptime"); err != nil {
-		return models.NewDiscoveryResult(device.ID, false, "uptime")
+	// Abort the test command if the batch is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		session.Close()
+	})
+	defer stop()
+
+	if err := session.Run(testCommand); err != nil {
+		if ctx.Err() != nil {
+			return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryCancelled, "cancelled")
+		}
+		return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryCmdFailed, constants.DiscoveryStepTestCommand)
+	}
+
+	// Step 5: If all steps succeeded, identify the host
+	result = models.NewDiscoveryResult(device.ID, true, constants.DiscoveryOK, "")
+	result.Port = device.Port
+	result.Facts = collectFacts(ctx, client)
+	return result
+}
+
+// candidatePorts returns the ports to probe for SSH in order
+// The device's candidate list wins, otherwise its port as CreateSSHClient would dial it
+func candidatePorts(device models.Device) []int {
+	if len(device.Ports) > 0 {
+		return device.Ports
+	}
+	return []int{device.SSHPort()}
+}
+
+// findOpenPort probes the candidate ports in order and returns the first open one
+// Without an open port the state is PortClosed if any port was refused, PortUnreachable otherwise
+func findOpenPort(ctx context.Context, device models.Device, timeout time.Duration) (int, utils.PortState) {
+	state := utils.PortUnreachable
+	for _, port := range candidatePorts(device) {
+		switch utils.ProbePort(ctx, device.IP, port, timeout) {
+		case utils.PortOpen:
+			return port, utils.PortOpen
+		case utils.PortClosed:
+			state = utils.PortClosed
+		}
+	}
+	return 0, state
+}
+
+// collectFacts gathers the OS, hostname and SSH server version of a reachable device
+// Facts that cannot be read are left out rather than failing discovery
+func collectFacts(ctx context.Context, client *ssh.Client) map[string]string {
+	facts := map[string]string{
+		"ssh_server_version": string(client.ServerVersion()),
+	}
+
+	output, err := utils.ExecuteCommand(ctx, client, "uname -a; hostname")
+	if err != nil {
+		return facts
+	}
+
+	lines := strings.Split(output, "\n")
+	if len(lines) >= 1 && strings.TrimSpace(lines[0]) != "" {
+		facts["os"] = strings.TrimSpace(lines[0])
+	}
+	if len(lines) >= 2 && strings.TrimSpace(lines[1]) != "" {
+		facts["hostname"] = strings.TrimSpace(lines[1])
 	}
 
-	// Step 4: If all steps succeeded
-	return models.NewDiscoveryResult(device.ID, true, "")
+	return facts
 }
@@ -0,0 +1,382 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testDevice returns a device logging in to srv with password
+func testDevice(srv *sshtest.Server, password string) models.Device {
+	return models.Device{
+		ID:          1,
+		IP:          srv.Host(),
+		Port:        srv.Port(),
+		SystemType:  "linux",
+		Credentials: models.Credentials{Username: "test", Password: password},
+	}
+}
+
+// closedPort returns a loopback port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+// knownHostsConfig returns a config whose known_hosts file lists key for addr
+func knownHostsConfig(t *testing.T, addr string, key ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf(`{"ssh": {"known_hosts": %q}}`, path)
+}
+
+func TestPerformDiscoveryCodes(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw"})
+	noSessions := sshtest.NewServer(t, sshtest.Options{NoSessions: true})
+
+	tests := []struct {
+		name     string
+		config   string
+		device   func(t *testing.T) models.Device
+		cancel   bool
+		wantCode string
+		wantStep string
+	}{
+		{
+			name:     "success",
+			device:   func(t *testing.T) models.Device { return testDevice(srv, "pw") },
+			wantCode: constants.DiscoveryOK,
+		},
+		{
+			name: "dns failure",
+			device: func(t *testing.T) models.Device {
+				device := testDevice(srv, "pw")
+				device.IP = "no-such-host.invalid"
+				return device
+			},
+			wantCode: constants.DiscoveryDNSFailed,
+			wantStep: "dns",
+		},
+		{
+			name: "closed port",
+			device: func(t *testing.T) models.Device {
+				device := testDevice(srv, "pw")
+				device.Port = closedPort(t)
+				return device
+			},
+			wantCode: constants.DiscoveryPortClosed,
+			wantStep: "port",
+		},
+		{
+			name:     "wrong password",
+			device:   func(t *testing.T) models.Device { return testDevice(srv, "wrong") },
+			wantCode: constants.DiscoveryAuthFailed,
+			wantStep: "sshAuth",
+		},
+		{
+			name:     "host key changed",
+			config:   knownHostsConfig(t, srv.Addr, sshtest.NewSigner(t).PublicKey()),
+			device:   func(t *testing.T) models.Device { return testDevice(srv, "pw") },
+			wantCode: constants.DiscoveryHostKeyChanged,
+			wantStep: "hostKeyChanged",
+		},
+		{
+			name:     "host key unknown",
+			config:   knownHostsConfig(t, "192.0.2.1:22", srv.HostKey.PublicKey()),
+			device:   func(t *testing.T) models.Device { return testDevice(srv, "pw") },
+			wantCode: constants.DiscoveryHostKeyUnknown,
+			wantStep: "hostKeyUnknown",
+		},
+		{
+			name:     "session refused",
+			device:   func(t *testing.T) models.Device { return testDevice(noSessions, "pw") },
+			wantCode: constants.DiscoverySessionFailed,
+			wantStep: "session",
+		},
+		{
+			name:     "test command fails",
+			config:   `{"discovery": {"test_command": "exit 3"}}`,
+			device:   func(t *testing.T) models.Device { return testDevice(srv, "pw") },
+			wantCode: constants.DiscoveryCmdFailed,
+			wantStep: constants.DiscoveryStepTestCommand,
+		},
+		{
+			name:     "cancelled",
+			device:   func(t *testing.T) models.Device { return testDevice(srv, "pw") },
+			cancel:   true,
+			wantCode: constants.DiscoveryCancelled,
+			wantStep: "cancelled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configJSON := tt.config
+			if configJSON == "" {
+				configJSON = `{}`
+			}
+			ctx := sshtest.Context(t, configJSON)
+			if tt.cancel {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				cancel()
+			}
+
+			result := PerformDiscovery(ctx, tt.device(t), 5*time.Second)
+			if result.Code != tt.wantCode || result.Step != tt.wantStep {
+				t.Errorf("got code %q step %q, want code %q step %q", result.Code, result.Step, tt.wantCode, tt.wantStep)
+			}
+			if result.Success != (tt.wantCode == constants.DiscoveryOK) {
+				t.Errorf("got success %v for code %q", result.Success, result.Code)
+			}
+		})
+	}
+}
+
+func TestPerformDiscoveryFacts(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw"})
+
+	t.Run("success", func(t *testing.T) {
+		ctx := sshtest.Context(t, `{}`)
+		result := PerformDiscovery(ctx, testDevice(srv, "pw"), 5*time.Second)
+		if !result.Success {
+			t.Fatalf("discovery failed: %+v", result)
+		}
+		for _, fact := range []string{"os", "hostname", "ssh_server_version"} {
+			if result.Facts[fact] == "" {
+				t.Errorf("fact %s is missing: %v", fact, result.Facts)
+			}
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		ctx := sshtest.Context(t, `{"discovery": {"test_command": "false"}}`)
+		result := PerformDiscovery(ctx, testDevice(srv, "pw"), 5*time.Second)
+		if result.Success {
+			t.Fatal("discovery succeeded with a failing test command")
+		}
+		if result.Facts != nil {
+			t.Errorf("got facts %v on a failed discovery, want none", result.Facts)
+		}
+	})
+}
+
+func TestPerformDiscoveryServerVersion(t *testing.T) {
+	tests := []struct {
+		banner       string
+		wantSoftware string
+	}{
+		{"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6", "OpenSSH 8.9p1"},
+		{"SSH-2.0-dropbear_2020.81", "Dropbear 2020.81"},
+		{"SSH-2.0-AcmeSwitchOS_4.2", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.banner, func(t *testing.T) {
+			srv := sshtest.NewServer(t, sshtest.Options{Password: "pw", ServerVersion: tt.banner})
+			ctx := sshtest.Context(t, `{}`)
+
+			result := PerformDiscovery(ctx, testDevice(srv, "pw"), 5*time.Second)
+			if !result.Success {
+				t.Fatalf("discovery failed: %+v", result)
+			}
+			if result.ServerVersion != tt.banner {
+				t.Errorf("got server version %q, want %q", result.ServerVersion, tt.banner)
+			}
+			if result.ServerSoftware != tt.wantSoftware {
+				t.Errorf("got server software %q, want %q", result.ServerSoftware, tt.wantSoftware)
+			}
+		})
+	}
+
+	// A failure after the handshake still reports the banner
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw", ServerVersion: "SSH-2.0-OpenSSH_7.4"})
+	ctx := sshtest.Context(t, `{"discovery": {"test_command": "false"}}`)
+	result := PerformDiscovery(ctx, testDevice(srv, "pw"), 5*time.Second)
+	if result.Success || result.ServerSoftware != "OpenSSH 7.4" {
+		t.Errorf("got success %v software %q, want a failure reporting OpenSSH 7.4", result.Success, result.ServerSoftware)
+	}
+}
+
+func TestPerformDiscoveryFingerprint(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw"})
+	want := ssh.FingerprintSHA256(srv.HostKey.PublicKey())
+
+	tests := []struct {
+		name   string
+		config string
+		device func(t *testing.T) models.Device
+		want   string
+	}{
+		{"success", `{}`, func(t *testing.T) models.Device { return testDevice(srv, "pw") }, want},
+		// The key is presented before authentication, so a failed login still reports it
+		{"wrong password", `{}`, func(t *testing.T) models.Device { return testDevice(srv, "wrong") }, want},
+		// A changed key is reported as presented, not as listed in known_hosts
+		{"host key changed", knownHostsConfig(t, srv.Addr, sshtest.NewSigner(t).PublicKey()), func(t *testing.T) models.Device { return testDevice(srv, "pw") }, want},
+		{"closed port", `{}`, func(t *testing.T) models.Device {
+			device := testDevice(srv, "pw")
+			device.Port = closedPort(t)
+			return device
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := sshtest.Context(t, tt.config)
+			result := PerformDiscovery(ctx, tt.device(t), 5*time.Second)
+			if result.Fingerprint != tt.want {
+				t.Errorf("got fingerprint %q, want %q", result.Fingerprint, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerformDiscoveryFingerprintThroughJumpHost(t *testing.T) {
+	bastion := sshtest.NewServer(t, sshtest.Options{Forwarding: true})
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw"})
+	ctx := sshtest.Context(t, `{}`)
+
+	device := testDevice(srv, "pw")
+	device.Jump = &models.JumpHost{Host: bastion.Host(), Port: bastion.Port(), Credentials: models.Credentials{Username: "jump", Password: "jump-pw"}}
+
+	result := PerformDiscovery(ctx, device, 5*time.Second)
+	if !result.Success {
+		t.Fatalf("discovery failed: %+v", result)
+	}
+	// The bastion's key is not the device's
+	if want := ssh.FingerprintSHA256(srv.HostKey.PublicKey()); result.Fingerprint != want {
+		t.Errorf("got fingerprint %q, want the device's %q", result.Fingerprint, want)
+	}
+}
+
+func TestPerformDiscoveryWithoutUptime(t *testing.T) {
+	// A minimal system: uptime is not installed, echo works
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"sh: uptime: not found\" >&2\nexit 127\n"
+	if err := os.WriteFile(filepath.Join(dir, "uptime"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw"})
+
+	t.Run("default test command", func(t *testing.T) {
+		ctx := sshtest.Context(t, `{}`)
+		if result := PerformDiscovery(ctx, testDevice(srv, "pw"), 5*time.Second); !result.Success {
+			t.Errorf("got %+v, the default test command does not need uptime", result)
+		}
+	})
+
+	t.Run("uptime as test command", func(t *testing.T) {
+		ctx := sshtest.Context(t, `{"discovery": {"test_command": "uptime"}}`)
+		result := PerformDiscovery(ctx, testDevice(srv, "pw"), 5*time.Second)
+		if result.Success || result.Step != constants.DiscoveryStepTestCommand {
+			t.Errorf("got %+v, want a failed %s step", result, constants.DiscoveryStepTestCommand)
+		}
+	})
+}
+
+func TestCandidatePorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		device models.Device
+		want   []int
+	}{
+		{"port unset", models.Device{}, []int{constants.DefaultSSHPort}},
+		{"port set", models.Device{Port: 2222}, []int{2222}},
+		{"candidates", models.Device{Port: 2222, Ports: []int{22, 8022}}, []int{22, 8022}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := candidatePorts(tt.device); !slices.Equal(got, tt.want) {
+				t.Errorf("got ports %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerformDiscoveryCandidatePorts(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "pw"})
+	ctx := sshtest.Context(t, `{}`)
+
+	t.Run("second port open", func(t *testing.T) {
+		device := testDevice(srv, "pw")
+		device.Port = 0
+		device.Ports = []int{closedPort(t), srv.Port()}
+
+		result := PerformDiscovery(ctx, device, 5*time.Second)
+		if !result.Success {
+			t.Fatalf("discovery failed: %+v", result)
+		}
+		if result.Port != srv.Port() {
+			t.Errorf("got port %d, want the open candidate %d", result.Port, srv.Port())
+		}
+	})
+
+	t.Run("all closed", func(t *testing.T) {
+		device := testDevice(srv, "pw")
+		device.Ports = []int{closedPort(t), closedPort(t)}
+
+		result := PerformDiscovery(ctx, device, 5*time.Second)
+		if result.Code != constants.DiscoveryPortClosed {
+			t.Errorf("got code %q, want %q", result.Code, constants.DiscoveryPortClosed)
+		}
+	})
+
+	t.Run("all unreachable", func(t *testing.T) {
+		// No candidate port answers at all
+		host, port, _ := net.SplitHostPort(sshtest.BlackHole(t))
+		portNum, _ := strconv.Atoi(port)
+		device := testDevice(srv, "pw")
+		device.IP = host
+		device.Ports = []int{portNum}
+
+		result := PerformDiscovery(ctx, device, time.Second)
+		if result.Code != constants.DiscoveryUnreachable || result.Step != "unreachable" {
+			t.Errorf("got code %q at step %q, want %q at step unreachable", result.Code, result.Step, constants.DiscoveryUnreachable)
+		}
+	})
+}
+
+func TestPerformDiscoveryDefaultPort(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(constants.DefaultSSHPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on the default SSH port: %v", err)
+	}
+	listener.Close()
+	srv := sshtest.NewServerOn(t, addr, sshtest.Options{Password: "pw"})
+	ctx := sshtest.Context(t, `{}`)
+
+	device := testDevice(srv, "pw")
+	device.Port = 0
+	result := PerformDiscovery(ctx, device, 5*time.Second)
+	if !result.Success {
+		t.Fatalf("discovery with the port unset failed: %+v", result)
+	}
+	if result.Port != constants.DefaultSSHPort {
+		t.Errorf("got port %d, want %d", result.Port, constants.DefaultSSHPort)
+	}
+}
@@ -1,32 +1,61 @@
 package discovery
 
 import (
+	"context"
+	"ssh-plugin/internal/constants"
 	"ssh-plugin/models"
+	"sync"
 	"time"
 )
 
 // DiscoveryPerformer defines the interface for performing SSH discovery
 type DiscoveryPerformer interface {
-	Perform(device models.Device, timeout time.Duration) models.DiscoveryResult
+	Perform(ctx context.Context, device models.Device, timeout time.Duration) models.DiscoveryResult
+}
+
+// performers maps a system type to the factory creating its performer
+var (
+	performersMu sync.RWMutex
+	performers   = make(map[string]func() DiscoveryPerformer)
+)
+
+// RegisterDiscoveryPerformer registers the factory creating the performer for systemType
+// and makes systemType valid for devices, a later registration replaces the earlier one
+func RegisterDiscoveryPerformer(systemType string, factory func() DiscoveryPerformer) {
+	performersMu.Lock()
+	defer performersMu.Unlock()
+
+	performers[systemType] = factory
+	models.RegisterSystemType(systemType)
+}
+
+func init() {
+	// Discovery only needs an SSH login, every type collected over SSH gets the same checks,
+	// including devices left to auto-detection
+	for _, systemType := range []string{constants.SystemTypeLinux, constants.SystemTypeWindows, constants.SystemTypeDarwin, constants.SystemTypeFreeBSD, constants.SystemTypeRaw, constants.SystemTypeAuto} {
+		RegisterDiscoveryPerformer(systemType, func() DiscoveryPerformer { return &LinuxDiscoveryPerformer{} })
+	}
 }
 
 // GetDiscoveryPerformer returns the appropriate performer based on system type
+// Unregistered system types get an UnsupportedDiscoveryPerformer
 func GetDiscoveryPerformer(systemType string) DiscoveryPerformer {
-	switch systemType {
-	case "linux":
-		return &LinuxDiscoveryPerformer{}
-	default:
-		// Placeholder for unsupported system types
+	performersMu.RLock()
+	factory, ok := performers[systemType]
+	performersMu.RUnlock()
+
+	if !ok {
 		return &UnsupportedDiscoveryPerformer{systemType: systemType}
 	}
+	return factory()
 }
 
-// LinuxDiscoveryPerformer implements DiscoveryPerformer for Linux systems
+// LinuxDiscoveryPerformer implements DiscoveryPerformer for Linux systems and the other system types reached over SSH
 type LinuxDiscoveryPerformer struct{}
 
 // Perform calls the existing PerformDiscovery function for Linux
-func (p *LinuxDiscoveryPerformer) Perform(device models.Device, timeout time.Duration) models.DiscoveryResult {
-	return PerformDiscovery(device, timeout)
+func (p *LinuxDiscoveryPerformer) Perform(ctx context.Context, device models.Device, timeout time.Duration) models.DiscoveryResult {
+	return PerformDiscovery(ctx, device, timeout)
 }
 
 // UnsupportedDiscoveryPerformer handles unsupported system types
@@ -35,6 +64,6 @@ type UnsupportedDiscoveryPerformer struct {
 }
 
 // Perform returns an error for unsupported system types
-func (p *UnsupportedDiscoveryPerformer) Perform(device models.Device, timeout time.Duration) models.DiscoveryResult {
-	return models.NewDiscoveryResult(device.ID, false, "unsupported system type: "+p.systemType)
+func (p *UnsupportedDiscoveryPerformer) Perform(ctx context.Context, device models.Device, timeout time.Duration) models.DiscoveryResult {
+	return models.NewDiscoveryResult(device.ID, false, constants.DiscoveryUnsupported, "unsupported system type: "+p.systemType)
 }
@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"context"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"testing"
+	"time"
+)
+
+// stubPerformer reports a fixed step for every device
+type stubPerformer struct {
+	step string
+}
+
+func (p *stubPerformer) Perform(ctx context.Context, device models.Device, timeout time.Duration) models.DiscoveryResult {
+	return models.NewDiscoveryResult(device.ID, true, constants.DiscoveryOK, p.step)
+}
+
+// registerTestPerformer registers a stub performer for systemType, removed again when the test ends
+func registerTestPerformer(t *testing.T, systemType, step string) {
+	t.Helper()
+	RegisterDiscoveryPerformer(systemType, func() DiscoveryPerformer { return &stubPerformer{step: step} })
+	t.Cleanup(func() {
+		performersMu.Lock()
+		defer performersMu.Unlock()
+		delete(performers, systemType)
+	})
+}
+
+func TestRegisterDiscoveryPerformer(t *testing.T) {
+	registerTestPerformer(t, "routeros", "custom")
+
+	device := models.Device{ID: 7, IP: "192.0.2.1", SystemType: "routeros", Credentials: models.Credentials{Username: "admin", Password: "pw"}}
+	if err := device.Validate(); err != nil {
+		t.Errorf("got %v validating a registered system type, want it accepted", err)
+	}
+
+	result := GetDiscoveryPerformer("routeros").Perform(context.Background(), device, time.Second)
+	if !result.Success || result.ID != 7 || result.Step != "custom" {
+		t.Errorf("got %+v, want the registered performer's result", result)
+	}
+}
+
+func TestRegisterDiscoveryPerformerOverride(t *testing.T) {
+	registerTestPerformer(t, "routeros", "first")
+	registerTestPerformer(t, "routeros", "second")
+
+	result := GetDiscoveryPerformer("routeros").Perform(context.Background(), models.Device{ID: 1}, time.Second)
+	if result.Step != "second" {
+		t.Errorf("got step %q, want the later registration to win", result.Step)
+	}
+}
+
+func TestGetDiscoveryPerformerFallback(t *testing.T) {
+	for _, systemType := range []string{constants.SystemTypeLinux, constants.SystemTypeWindows, constants.SystemTypeDarwin, constants.SystemTypeFreeBSD, constants.SystemTypeRaw, constants.SystemTypeAuto} {
+		if _, ok := GetDiscoveryPerformer(systemType).(*LinuxDiscoveryPerformer); !ok {
+			t.Errorf("%q is not dispatched to the SSH discovery performer", systemType)
+		}
+	}
+
+	performer := GetDiscoveryPerformer("plan9")
+	if _, ok := performer.(*UnsupportedDiscoveryPerformer); !ok {
+		t.Fatalf("got %T for an unregistered type, want UnsupportedDiscoveryPerformer", performer)
+	}
+	result := performer.Perform(context.Background(), models.Device{ID: 1}, time.Second)
+	if result.Success || result.Code != constants.DiscoveryUnsupported {
+		t.Errorf("got %+v, want code %s", result, constants.DiscoveryUnsupported)
+	}
+}
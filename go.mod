@@ -1,11 +1,18 @@
 module ssh-plugin
 
-go 1.24
+go 1.24.0
 
 require (
-	github.com/golang/snappy v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
+	github.com/golang/snappy v1.0.0
+	github.com/gosnmp/gosnmp v1.45.0
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.37.0
+	golang.org/x/net v0.39.0
+	golang.org/x/sync v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
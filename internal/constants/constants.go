@@ -0,0 +1,91 @@
+package constants
+
+// SSH related constants
+const (
+	DefaultSSHPort   = 22
+	MinSSHTimeout    = 5        // Minimum SSH timeout in seconds
+	MaxSSHTimeout    = 60       // Maximum SSH timeout in seconds
+	CommandTimeout   = 30       // Default command execution timeout in seconds
+	PoolIdleTimeout  = 60       // Seconds a cached SSH client may stay unused before it is closed
+	DNSCacheTTL      = 300      // Seconds a resolved hostname is reused before it is looked up again
+	DNSLookupTimeout = 10       // Seconds a shared hostname lookup may take
+	MaxOutputBytes   = 16 << 20 // Default limit on the output of a single command in bytes
+	MaxSessions      = 4        // Default limit on the sessions opened at once on a device
+	MaxRetryBackoff  = 60       // Longest wait between connection attempts in seconds
+)
+
+// Discovery related constants
+const (
+	DefaultDiscoveryTestCommand = "echo ok"      // Liveness command run by discovery when none is configured
+	DiscoveryStepTestCommand    = "test_command" // Step reported when the liveness command fails
+)
+
+// SNMP related constants
+const (
+	DefaultSNMPPort = 161
+)
+
+// Supported system types
+const (
+	SystemTypeLinux   = "linux"
+	SystemTypeWindows = "windows"
+	SystemTypeDarwin  = "darwin"
+	SystemTypeSNMP    = "snmp"
+	SystemTypeFreeBSD = "freebsd"
+	SystemTypeRaw     = "raw"
+	SystemTypeAuto    = "" // Detected on the device before collecting
+)
+
+// Output related constants
+const (
+	OutputDialTimeout       = 10 // Seconds allowed to connect to a tcp+tls collector
+	OutputReconnectAttempts = 3  // Connections tried per write before a tcp+tls collector is given up on
+)
+
+// Input related constants
+const (
+	MaxCIDRHosts    = 4096     // Maximum number of hosts a single CIDR device may expand into
+	MaxRequestBytes = 64 << 20 // Maximum size of an encrypted device blob posted in serve mode
+)
+
+// Error messages
+const (
+	ErrConnectionFailed  = "failed to establish SSH connection"
+	ErrAuthFailed        = "authentication failed"
+	ErrExecutionFailed   = "command execution failed"
+	ErrInvalidParameters = "invalid parameters"
+	ErrTimeout           = "operation timed out"
+	ErrCancelled         = "operation cancelled"
+	ErrHostKeyChanged    = "host key has changed"
+	ErrHostKeyUnknown    = "host key not found in known_hosts"
+	ErrDNSFailed         = "hostname resolution failed"
+	ErrOutputTooLarge    = "command output exceeded limit"
+	ErrBatchDeadline     = "batch deadline exceeded"
+	ErrSystemTypeUnknown = "system type detection failed"
+)
+
+// Discovery result codes
+const (
+	DiscoveryOK               = "OK"
+	DiscoveryDNSFailed        = "DNS_FAILED"
+	DiscoveryPortClosed       = "PORT_CLOSED"
+	DiscoveryUnreachable      = "UNREACHABLE"
+	DiscoveryAuthFailed       = "AUTH_FAILED"
+	DiscoveryHostKeyChanged   = "HOST_KEY_CHANGED"
+	DiscoveryHostKeyUnknown   = "HOST_KEY_UNKNOWN"
+	DiscoverySessionFailed    = "SESSION_FAILED"
+	DiscoveryCmdFailed        = "CMD_FAILED"
+	DiscoveryUnsupported      = "UNSUPPORTED"
+	DiscoveryCancelled        = "CANCELLED"
+	DiscoveryDeadlineExceeded = "DEADLINE_EXCEEDED"
+	DiscoveryInvalidDevice    = "INVALID_DEVICE"
+	DiscoveryPanic            = "PANIC"
+)
+
+// Process exit codes
+const (
+	ExitSuccess        = 0 // Every device succeeded
+	ExitError          = 1 // Invalid arguments, configuration or input, nothing was processed
+	ExitPartialFailure = 2 // Some devices failed
+	ExitAllFailed      = 3 // Every device failed
+)
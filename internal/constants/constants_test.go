@@ -0,0 +1,79 @@
+package constants
+
+import "testing"
+
+// TestConstants references every constant so removing or renaming one fails to compile
+func TestConstants(t *testing.T) {
+	if MinSSHTimeout > MaxSSHTimeout {
+		t.Errorf("MinSSHTimeout %d is above MaxSSHTimeout %d", MinSSHTimeout, MaxSSHTimeout)
+	}
+	positive := map[string]int{
+		"DefaultSSHPort":          DefaultSSHPort,
+		"MinSSHTimeout":           MinSSHTimeout,
+		"MaxSSHTimeout":           MaxSSHTimeout,
+		"CommandTimeout":          CommandTimeout,
+		"PoolIdleTimeout":         PoolIdleTimeout,
+		"DNSCacheTTL":             DNSCacheTTL,
+		"DNSLookupTimeout":        DNSLookupTimeout,
+		"MaxOutputBytes":          MaxOutputBytes,
+		"MaxSessions":             MaxSessions,
+		"MaxRetryBackoff":         MaxRetryBackoff,
+		"DefaultSNMPPort":         DefaultSNMPPort,
+		"OutputDialTimeout":       OutputDialTimeout,
+		"OutputReconnectAttempts": OutputReconnectAttempts,
+		"MaxCIDRHosts":            MaxCIDRHosts,
+		"MaxRequestBytes":         MaxRequestBytes,
+	}
+	for name, value := range positive {
+		if value <= 0 {
+			t.Errorf("%s is %d, want a positive value", name, value)
+		}
+	}
+
+	if DefaultDiscoveryTestCommand == "" || DiscoveryStepTestCommand == "" {
+		t.Error("discovery constants must not be empty")
+	}
+
+	// System types are dispatch keys, only auto-detection may be empty
+	systemTypes := []string{SystemTypeLinux, SystemTypeWindows, SystemTypeDarwin, SystemTypeSNMP, SystemTypeFreeBSD, SystemTypeRaw, SystemTypeAuto}
+	assertDistinct(t, "system type", systemTypes)
+	if SystemTypeAuto != "" {
+		t.Errorf("SystemTypeAuto is %q, want empty", SystemTypeAuto)
+	}
+
+	// Callers classify errors by prefix, two equal messages would be indistinguishable
+	assertDistinct(t, "error message", []string{
+		ErrConnectionFailed, ErrAuthFailed, ErrExecutionFailed, ErrInvalidParameters, ErrTimeout, ErrCancelled,
+		ErrHostKeyChanged, ErrHostKeyUnknown, ErrDNSFailed, ErrOutputTooLarge, ErrBatchDeadline, ErrSystemTypeUnknown,
+	})
+
+	assertDistinct(t, "discovery code", []string{
+		DiscoveryOK, DiscoveryDNSFailed, DiscoveryPortClosed, DiscoveryUnreachable, DiscoveryAuthFailed,
+		DiscoveryHostKeyChanged, DiscoveryHostKeyUnknown, DiscoverySessionFailed, DiscoveryCmdFailed,
+		DiscoveryUnsupported, DiscoveryCancelled, DiscoveryDeadlineExceeded, DiscoveryInvalidDevice, DiscoveryPanic,
+	})
+
+	exitCodes := []int{ExitSuccess, ExitError, ExitPartialFailure, ExitAllFailed}
+	seen := make(map[int]bool)
+	for _, code := range exitCodes {
+		if seen[code] {
+			t.Errorf("exit code %d is used twice", code)
+		}
+		seen[code] = true
+	}
+	if ExitSuccess != 0 {
+		t.Errorf("ExitSuccess is %d, want 0", ExitSuccess)
+	}
+}
+
+// assertDistinct fails the test when values holds a value twice
+func assertDistinct(t *testing.T, kind string, values []string) {
+	t.Helper()
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if seen[value] {
+			t.Errorf("%s %q is used twice", kind, value)
+		}
+		seen[value] = true
+	}
+}
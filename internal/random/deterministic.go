@@ -0,0 +1,27 @@
+//go:build deterministic
+
+// Package random supplies the random bytes of nonces and tokens,
+// builds tagged deterministic replace them with a fixed sequence for reproducible tests
+package random
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// stream is seeded with zeros so every run of a deterministic build draws the same bytes,
+// it must never back a production build since nonces would repeat across runs
+var (
+	streamMu sync.Mutex
+	stream   = rand.NewChaCha8([32]byte{})
+)
+
+// Deterministic reports whether this build draws from the fixed-seed stream, see the deterministic build tag
+const Deterministic = true
+
+// Read fills b with the next bytes of the fixed-seed stream
+func Read(b []byte) (int, error) {
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	return stream.Read(b)
+}
@@ -0,0 +1,33 @@
+//go:build deterministic
+
+package random
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestReadDeterministic(t *testing.T) {
+	if !Deterministic {
+		t.Fatal("a build with the deterministic tag does not report itself deterministic")
+	}
+
+	// Every run draws the zero-seeded stream from its start, tests run after this one continue it
+	streamMu.Lock()
+	stream = rand.NewChaCha8([32]byte{})
+	streamMu.Unlock()
+
+	want := make([]byte, 48)
+	rand.NewChaCha8([32]byte{}).Read(want)
+
+	got := make([]byte, 48)
+	for _, part := range [][]byte{got[:16], got[16:]} {
+		if n, err := Read(part); err != nil || n != len(part) {
+			t.Fatalf("Read = %d, %v, want %d bytes", n, err, len(part))
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want the zero-seeded ChaCha8 stream %x", got, want)
+	}
+}
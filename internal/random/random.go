@@ -0,0 +1,15 @@
+//go:build !deterministic
+
+// Package random supplies the random bytes of nonces and tokens,
+// builds tagged deterministic replace them with a fixed sequence for reproducible tests
+package random
+
+import "crypto/rand"
+
+// Deterministic reports whether this build draws from the fixed-seed stream, see the deterministic build tag
+const Deterministic = false
+
+// Read fills b with random bytes from crypto/rand
+func Read(b []byte) (int, error) {
+	return rand.Read(b)
+}
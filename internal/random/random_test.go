@@ -0,0 +1,24 @@
+//go:build !deterministic
+
+package random
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadRandom(t *testing.T) {
+	if Deterministic {
+		t.Fatal("a build without the deterministic tag reports itself deterministic")
+	}
+
+	first, second := make([]byte, 32), make([]byte, 32)
+	for _, b := range [][]byte{first, second} {
+		if n, err := Read(b); err != nil || n != len(b) {
+			t.Fatalf("Read = %d, %v, want %d bytes", n, err, len(b))
+		}
+	}
+	if bytes.Equal(first, second) {
+		t.Error("two reads returned the same bytes")
+	}
+}
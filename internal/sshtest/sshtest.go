@@ -0,0 +1,500 @@
+// Package sshtest runs in-process SSH servers and builds configurations for tests
+// Commands sent to a server run locally through sh
+package sshtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"ssh-plugin/config"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options configures a Server, the zero value accepts any password
+type Options struct {
+	Password      string        // Password accepted by password auth, empty accepts any
+	AuthorizedKey ssh.PublicKey // Key accepted by public-key auth, nil disables it
+	NoPassword    bool          // Disable password auth
+	Interactive   bool          // Offer keyboard-interactive auth, prompting once for Password
+	Forwarding    bool          // Accept direct-tcpip channels, as a jump host does
+	NoSessions    bool          // Refuse every session channel
+	BannerDelay   time.Duration // Wait before sending the server version, like a slow or overloaded server
+	Ciphers       []string      // Ciphers the server accepts, empty uses the defaults
+	KeyExchanges  []string      // Key exchange algorithms the server accepts, empty uses the defaults
+	ServerVersion string        // Version banner the server sends, empty uses the library default
+	SFTP          bool          // Serve the sftp subsystem
+	AcceptEnv     []string      // Names accepted by env requests like sshd's AcceptEnv, nil accepts every name
+	MaxSessions   int           // Sessions open at once on a connection like sshd's MaxSessions, 0 is unlimited
+}
+
+// Server is an SSH server listening on a loopback port
+type Server struct {
+	Addr    string     // host:port the server listens on
+	HostKey ssh.Signer // Key the server presents
+
+	opts     Options
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	accepted int
+	forwards int
+	attempts []string
+	ptys     []PTYRequest
+	commands []string
+	sftps    int
+	peak     int
+	refused  int
+}
+
+// PTYRequest is a pseudo-terminal requested by a session
+type PTYRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Modes   map[uint8]uint32 // Terminal mode opcode to value
+}
+
+// NewServer starts a server on 127.0.0.1, it is stopped when the test ends
+func NewServer(t testing.TB, opts Options) *Server {
+	t.Helper()
+	return NewServerOn(t, "127.0.0.1:0", opts)
+}
+
+// NewServerOn starts a server listening on addr, it is stopped when the test ends
+func NewServerOn(t testing.TB, addr string, opts Options) *Server {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("sshtest: listen: %v", err)
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		HostKey:  NewSigner(t),
+		opts:     opts,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Host returns the address the server listens on
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Close stops accepting connections and closes the open ones
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+	s.CloseConnections()
+}
+
+// CloseConnections drops every open connection, as a server restart or network failure would
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serverConfig returns the SSH configuration of new connections
+func (s *Server) serverConfig() *ssh.ServerConfig {
+	cfg := &ssh.ServerConfig{
+		Config:        ssh.Config{Ciphers: s.opts.Ciphers, KeyExchanges: s.opts.KeyExchanges},
+		ServerVersion: s.opts.ServerVersion,
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.attempts = append(s.attempts, method)
+		},
+	}
+	if !s.opts.NoPassword {
+		cfg.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.opts.Password != "" && string(password) != s.opts.Password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		}
+	}
+	if s.opts.Interactive {
+		cfg.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || (s.opts.Password != "" && answers[0] != s.opts.Password) {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		}
+	}
+	if s.opts.AuthorizedKey != nil {
+		cfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), s.opts.AuthorizedKey.Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		}
+	}
+	cfg.AddHostKey(s.HostKey)
+	return cfg
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn runs the handshake and serves the channels of one connection
+func (s *Server) handleConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.accepted++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	if s.opts.BannerDelay > 0 {
+		time.Sleep(s.opts.BannerDelay)
+	}
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, s.serverConfig())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	// Sessions open on this connection, counted against MaxSessions
+	var open int
+	for newChannel := range chans {
+		switch {
+		case newChannel.ChannelType() == "session" && !s.opts.NoSessions:
+			if !s.openSession(&open) {
+				newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				s.closeSession(&open)
+				continue
+			}
+			go s.handleSession(channel, requests, func() { s.closeSession(&open) })
+		case newChannel.ChannelType() == "direct-tcpip" && s.opts.Forwarding:
+			go s.handleForward(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// openSession counts a new session in open, refusing it once MaxSessions are open
+func (s *Server) openSession(open *int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.MaxSessions > 0 && *open >= s.opts.MaxSessions {
+		s.refused++
+		return false
+	}
+	*open++
+	s.peak = max(s.peak, *open)
+	return true
+}
+
+// closeSession counts a session of open as ended
+func (s *Server) closeSession(open *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*open--
+}
+
+// PeakSessions returns the most sessions open at once on one connection
+func (s *Server) PeakSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// RefusedSessions returns the number of sessions refused for exceeding MaxSessions
+func (s *Server) RefusedSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refused
+}
+
+// Connections returns the number of connections the server accepted
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// AuthAttempts returns the auth method of every authentication attempt in order, including "none"
+func (s *Server) AuthAttempts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.attempts)
+}
+
+// Forwards returns the number of direct-tcpip channels the server connected
+func (s *Server) Forwards() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forwards
+}
+
+// handleForward connects a direct-tcpip channel to the address it asks for
+func (s *Server) handleForward(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	s.mu.Lock()
+	s.forwards++
+	s.mu.Unlock()
+
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+	channel.Close()
+}
+
+// handleSession serves the requests of a session channel, running the command of an exec request
+// release is called before the channel closes, so the client never sees a session still counted
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request, release func()) {
+	release = sync.OnceFunc(release)
+	defer channel.Close()
+	defer release()
+
+	var env []string
+	var cmd *exec.Cmd
+	exited := make(chan struct{})
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var pair struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &pair); err != nil || (s.opts.AcceptEnv != nil && !slices.Contains(s.opts.AcceptEnv, pair.Name)) {
+				req.Reply(false, nil)
+				continue
+			}
+			env = append(env, pair.Name+"="+pair.Value)
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if cmd != nil || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			s.mu.Unlock()
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Env = append(os.Environ(), env...)
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			// Output still held open by background children is given up on shortly after sh exits
+			cmd.WaitDelay = time.Second
+			stdin, err := cmd.StdinPipe()
+			if err != nil || cmd.Start() != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			go func() {
+				io.Copy(stdin, channel)
+				stdin.Close()
+			}()
+			go func() {
+				defer close(exited)
+				status := 0
+				var exitErr *exec.ExitError
+				if err := cmd.Wait(); errors.As(err, &exitErr) {
+					status = exitErr.ExitCode()
+				} else if err != nil {
+					status = 255
+				}
+				channel.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, uint32(status)))
+				channel.CloseWrite()
+				release()
+				channel.Close()
+			}()
+		case "pty-req":
+			var payload struct {
+				Term          string
+				Columns, Rows uint32
+				Width, Height uint32
+				Modes         string
+			}
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			s.mu.Lock()
+			s.ptys = append(s.ptys, PTYRequest{Term: payload.Term, Columns: payload.Columns, Rows: payload.Rows, Modes: parseModes(payload.Modes)})
+			s.mu.Unlock()
+			req.Reply(true, nil)
+		case "subsystem":
+			var payload struct{ Name string }
+			if !s.opts.SFTP || cmd != nil || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			s.mu.Lock()
+			s.sftps++
+			s.mu.Unlock()
+			req.Reply(true, nil)
+			go func() {
+				server.Serve()
+				server.Close()
+				release()
+				channel.Close()
+			}()
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+
+	// The client closed the channel, stop a command still running
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// Commands returns the command of every exec request so far, in order
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.commands)
+}
+
+// SFTPSessions returns the number of sftp subsystems the server started
+func (s *Server) SFTPSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sftps
+}
+
+// PTYRequests returns the pseudo-terminals requested so far, in order
+func (s *Server) PTYRequests() []PTYRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.ptys)
+}
+
+// parseModes decodes encoded terminal modes, opcode and uint32 value pairs ended by opcode 0
+func parseModes(encoded string) map[uint8]uint32 {
+	modes := make(map[uint8]uint32)
+	for data := []byte(encoded); len(data) >= 5 && data[0] != 0; data = data[5:] {
+		modes[data[0]] = binary.BigEndian.Uint32(data[1:5])
+	}
+	return modes
+}
+
+// NewSigner returns a new ed25519 signer
+func NewSigner(t testing.TB) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("sshtest: generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("sshtest: signer: %v", err)
+	}
+	return signer
+}
+
+// Context returns a context carrying the configuration LoadConfig reads from configJSON
+// The config path variable is set for the rest of the test, so tests using it cannot run in parallel
+func Context(t testing.TB, configJSON string) context.Context {
+	t.Helper()
+	cfg := LoadConfig(t, configJSON)
+	return config.NewContext(context.Background(), cfg)
+}
+
+// LoadConfig writes configJSON to a temporary file and loads it with LoadConfig
+func LoadConfig(t testing.TB, configJSON string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(configJSON), 0o600); err != nil {
+		t.Fatalf("sshtest: write config: %v", err)
+	}
+	t.Setenv(config.ConfigPathEnv, path)
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("sshtest: load config: %v", err)
+	}
+	return cfg
+}
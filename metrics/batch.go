@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"ssh-plugin/models"
+	"sync"
+)
+
+// CollectorSet hands out one collector per system type for the duration of a batch
+// Collectors holding state across devices, such as pooled connections, implement io.Closer
+// and are closed together by Close once the batch is done
+type CollectorSet struct {
+	mu         sync.Mutex
+	collectors map[string]MetricsCollector
+}
+
+// NewCollectorSet creates an empty set for a new batch
+func NewCollectorSet() *CollectorSet {
+	return &CollectorSet{collectors: make(map[string]MetricsCollector)}
+}
+
+// Get returns the batch's collector for systemType, created with GetMetricsCollector on first use
+func (s *CollectorSet) Get(systemType string) MetricsCollector {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collector, ok := s.collectors[systemType]
+	if !ok {
+		collector = GetMetricsCollector(systemType)
+		s.collectors[systemType] = collector
+	}
+	return collector
+}
+
+// Close closes every collector handed out that implements io.Closer and returns their errors joined
+func (s *CollectorSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, collector := range s.collectors {
+		if closer, ok := collector.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	s.collectors = make(map[string]MetricsCollector)
+	return errors.Join(errs...)
+}
+
+// pooledCollector is embedded by the SSH collectors, whose connections are shared through clientPool
+// It remembers the devices collected from, so closing one batch leaves the clients of batches running alongside cached
+type pooledCollector struct {
+	mu      sync.Mutex
+	devices []models.Device
+}
+
+// acquired records that the collector used the pooled client of device
+func (c *pooledCollector) acquired(device models.Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.devices = append(c.devices, device)
+}
+
+// Close releases the SSH clients of the devices collected from during the batch
+func (c *pooledCollector) Close() error {
+	c.mu.Lock()
+	devices := c.devices
+	c.devices = nil
+	c.mu.Unlock()
+
+	clientPool.Release(devices...)
+	return nil
+}
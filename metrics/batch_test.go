@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closingCollector is a stub collector counting its Close calls
+type closingCollector struct {
+	stubCollector
+	closed *atomic.Int32
+	err    error
+}
+
+func (c *closingCollector) Close() error {
+	c.closed.Add(1)
+	return c.err
+}
+
+func TestCollectorSetClose(t *testing.T) {
+	var created, closed atomic.Int32
+	errClose := errors.New("close failed")
+	registerTestFactory(t, "closing", func() MetricsCollector {
+		created.Add(1)
+		return &closingCollector{stubCollector: stubCollector{value: "closing"}, closed: &closed, err: errClose}
+	})
+	registerTestCollector(t, "plain", "plain")
+
+	set := NewCollectorSet()
+	first := set.Get("closing")
+	if second := set.Get("closing"); second != first {
+		t.Error("got a new collector for the same system type, want it shared for the batch")
+	}
+	if _, ok := set.Get("plain").(io.Closer); ok {
+		t.Fatal("the plain stub should not implement io.Closer")
+	}
+
+	if err := set.Close(); !errors.Is(err, errClose) {
+		t.Errorf("got error %v, want the collector's close error", err)
+	}
+	if got := created.Load(); got != 1 {
+		t.Errorf("got %d collectors created, want 1", got)
+	}
+	if got := closed.Load(); got != 1 {
+		t.Errorf("got %d Close calls, want 1", got)
+	}
+
+	// Collectors are closed once, a second Close has nothing left to close
+	if err := set.Close(); err != nil {
+		t.Errorf("got error %v from a second Close", err)
+	}
+	if got := closed.Load(); got != 1 {
+		t.Errorf("got %d Close calls after closing twice, want 1", got)
+	}
+}
+
+func TestCollectorSetClosesPooledClients(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo host1"}}}`)
+	device := testDevice(srv)
+
+	set := NewCollectorSet()
+	collector := set.Get(constants.SystemTypeLinux)
+	if _, ok := collector.(io.Closer); !ok {
+		t.Fatal("the Linux collector does not implement io.Closer")
+	}
+	if result := collector.Collect(ctx, device, 5*time.Second); !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if err := set.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached client went with the batch, the next collect connects again
+	if result := GetMetricsCollector(constants.SystemTypeLinux).Collect(ctx, device, 5*time.Second); !result.Success {
+		t.Fatalf("collect after closing the set failed: %+v", result)
+	}
+	if got := srv.Connections(); got != 2 {
+		t.Errorf("got %d connections, want a new one after the set was closed", got)
+	}
+}
+
+func TestCollectorSetCloseKeepsOtherBatchClients(t *testing.T) {
+	first := newTestServer(t, sshtest.Options{})
+	second := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo host1"}}}`)
+	firstDevice, secondDevice := testDevice(first), testDevice(second)
+
+	// Two batches run alongside, like concurrent serve requests sharing the client pool
+	firstSet, secondSet := NewCollectorSet(), NewCollectorSet()
+	if result := firstSet.Get(constants.SystemTypeLinux).Collect(ctx, firstDevice, 5*time.Second); !result.Success {
+		t.Fatalf("first batch collect failed: %+v", result)
+	}
+	if result := secondSet.Get(constants.SystemTypeLinux).Collect(ctx, secondDevice, 5*time.Second); !result.Success {
+		t.Fatalf("second batch collect failed: %+v", result)
+	}
+
+	if err := firstSet.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch still running keeps its cached client
+	if result := secondSet.Get(constants.SystemTypeLinux).Collect(ctx, secondDevice, 5*time.Second); !result.Success {
+		t.Fatalf("second batch collect after the first closed failed: %+v", result)
+	}
+	if got := second.Connections(); got != 1 {
+		t.Errorf("got %d connections for the second batch, want its client kept when the first batch closed", got)
+	}
+
+	// The closed batch's client is gone
+	if result := GetMetricsCollector(constants.SystemTypeLinux).Collect(ctx, firstDevice, 5*time.Second); !result.Success {
+		t.Fatalf("collect after the first batch closed failed: %+v", result)
+	}
+	if got := first.Connections(); got != 2 {
+		t.Errorf("got %d connections for the first batch's device, want a new one after its batch closed", got)
+	}
+}
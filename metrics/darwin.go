@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"ssh-plugin/models"
+	"time"
+)
+
+// darwinCommands maps metric names to macOS commands producing the same shape as the Linux commands
+var darwinCommands = map[string]string{
+	"hostname":  "hostname",
+	"uptime":    "uptime | awk -F'up |, [0-9]+ user' '{print \"up \" $2}'",
+	"cpu":       "ps -A -o %cpu | awk -v n=$(sysctl -n hw.ncpu) 'NR>1 {s+=$1} END {print s/n}'",
+	"memory":    "vm_stat | awk -v ps=$(sysctl -n hw.pagesize) '/Pages active/ {a=$3} /Pages wired down/ {w=$4} END {printf \"%.0fB\\n\", (a+w)*ps}'",
+	"disk":      "df -k / | awk 'NR==2 {printf \"%.0fB\\n\", $3*1024}'",
+	"processes": "ps ax | wc -l",
+}
+
+// CollectDarwinMetrics collects metrics from a macOS device using SSH
+// It executes all commands in a single SSH session and parses the output
+// Panics are caught and converted to error results to prevent process crashes
+func CollectDarwinMetrics(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Recover from panics to ensure the process continues for other devices
+	defer func() {
+		if r := recover(); r != nil {
+			result = models.NewMetricsError(device.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+		}
+	}()
+
+	return collectSectioned(ctx, device, timeout, orderedNames(darwinCommands, nil), darwinCommands, combineShellCommands, "", ptyPolicy{}, false)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"ssh-plugin/utils"
+	"strings"
+	"time"
+)
+
+// systemTypeProbe prints the kernel name on Unix-like systems
+const systemTypeProbe = "uname -s"
+
+// windowsProbe prints the Windows version from cmd.exe, run when uname is not available
+const windowsProbe = "cmd /c ver"
+
+// unameSystemTypes maps the output of systemTypeProbe to a system type
+var unameSystemTypes = map[string]string{
+	"Linux":   constants.SystemTypeLinux,
+	"Darwin":  constants.SystemTypeDarwin,
+	"FreeBSD": constants.SystemTypeFreeBSD,
+}
+
+// AutoMetricsCollector implements MetricsCollector for devices without a system type
+// It detects the system type with DetectSystemType and hands the device to that type's collector
+type AutoMetricsCollector struct {
+	pooledCollector
+}
+
+// Collect detects the device's system type and collects with the matching collector
+// Panics are caught and converted to error results to prevent process crashes
+func (c *AutoMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Recover from panics to ensure the process continues for other devices
+	defer func() {
+		if r := recover(); r != nil {
+			result = models.NewMetricsError(device.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+		}
+	}()
+
+	c.acquired(device)
+	systemType, err := DetectSystemType(ctx, device, timeout)
+	if err != nil {
+		return models.NewMetricsError(device.ID, err.Error())
+	}
+
+	// Parsers are chosen by the device's system type, so the detected one is passed on
+	device.SystemType = systemType
+	return GetMetricsCollector(systemType).Collect(ctx, device, timeout)
+}
+
+// DetectSystemType connects to the device and returns its system type from the output of uname -s,
+// falling back to cmd.exe's ver for Windows hosts without uname
+// The connection is left in the client pool for the collection that follows
+func DetectSystemType(ctx context.Context, device models.Device, timeout time.Duration) (string, error) {
+	client, err := clientPool.Get(ctx, device, timeout)
+	if err != nil {
+		return "", fmt.Errorf("SSH connection error: %s", err.Error())
+	}
+
+	opts := utils.ExecOptions{Timeout: commandTimeout(device, timeout)}
+	output, err := utils.ExecuteCommandWithOptions(ctx, client, systemTypeProbe, opts)
+	if err != nil && isExitError(err) {
+		output, err = utils.ExecuteCommandWithOptions(ctx, client, windowsProbe, opts)
+	}
+	if err != nil {
+		if !isExitError(err) {
+			clientPool.Discard(device, client)
+		} else {
+			clientPool.Put(device, client)
+		}
+		return "", fmt.Errorf("%s: %s", constants.ErrSystemTypeUnknown, err.Error())
+	}
+	clientPool.Put(device, client)
+
+	systemType, ok := systemTypeFromProbe(output)
+	if !ok {
+		return "", fmt.Errorf("%s: probe returned %q", constants.ErrSystemTypeUnknown, strings.TrimSpace(output))
+	}
+	return systemType, nil
+}
+
+// systemTypeFromProbe maps the output of systemTypeProbe or windowsProbe to a system type
+// Cygwin and MSYS shells on Windows report names like "CYGWIN_NT-10.0" or "MINGW64_NT-10.0"
+func systemTypeFromProbe(output string) (string, bool) {
+	output = strings.TrimSpace(output)
+	if systemType, ok := unameSystemTypes[output]; ok {
+		return systemType, true
+	}
+
+	for _, prefix := range []string{"CYGWIN", "MINGW", "MSYS"} {
+		if strings.HasPrefix(output, prefix) {
+			return constants.SystemTypeWindows, true
+		}
+	}
+	if strings.Contains(output, "Microsoft Windows") {
+		return constants.SystemTypeWindows, true
+	}
+	return "", false
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemTypeFromProbe(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+		ok     bool
+	}{
+		{"Linux\n", constants.SystemTypeLinux, true},
+		{"Darwin\n", constants.SystemTypeDarwin, true},
+		{"FreeBSD\n", constants.SystemTypeFreeBSD, true},
+		{"CYGWIN_NT-10.0-19045\n", constants.SystemTypeWindows, true},
+		{"MINGW64_NT-10.0-19045\n", constants.SystemTypeWindows, true},
+		{"\r\nMicrosoft Windows [Version 10.0.20348.2340]\r\n", constants.SystemTypeWindows, true},
+		{"SunOS\n", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := systemTypeFromProbe(tt.output)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("systemTypeFromProbe(%q) = %q, %v, want %q, %v", tt.output, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCollectAutoDetectsLinux(t *testing.T) {
+	fakeCommands(t, map[string]string{"uname": `[ "$1" = "-s" ] && echo Linux`})
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo host1"}}}`)
+	device := testDevice(srv)
+	device.SystemType = ""
+
+	if err := device.Validate(); err != nil {
+		t.Fatalf("got %v validating an empty system type, want it accepted", err)
+	}
+	systemType, err := DetectSystemType(ctx, device, 5*time.Second)
+	if err != nil || systemType != constants.SystemTypeLinux {
+		t.Fatalf("got %q, %v, want linux", systemType, err)
+	}
+
+	result := GetMetricsCollector(device.SystemType).Collect(ctx, device, 5*time.Second)
+	if !result.Success || result.Metrics["hostname"] != "host1" {
+		t.Errorf("got %+v, want the Linux collector's metrics", result)
+	}
+	// The probe's connection is reused by the collection
+	if got := srv.Connections(); got != 1 {
+		t.Errorf("got %d connections, want the probe and collection to share one", got)
+	}
+}
+
+func TestDetectSystemTypeWindowsFallback(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"uname": `exit 127`,
+		"cmd":   `printf '\r\nMicrosoft Windows [Version 10.0.20348.2340]\r\n'`,
+	})
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{}`)
+
+	systemType, err := DetectSystemType(ctx, testDevice(srv), 5*time.Second)
+	if err != nil || systemType != constants.SystemTypeWindows {
+		t.Errorf("got %q, %v, want windows from the cmd.exe probe", systemType, err)
+	}
+}
+
+func TestDetectSystemTypeUnknown(t *testing.T) {
+	fakeCommands(t, map[string]string{"uname": `echo SunOS`})
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{}`)
+	device := testDevice(srv)
+	device.SystemType = ""
+
+	result := GetMetricsCollector(device.SystemType).Collect(ctx, device, 5*time.Second)
+	if result.Success || !strings.HasPrefix(result.Metrics["error"], constants.ErrSystemTypeUnknown) {
+		t.Errorf("got %+v, want %s", result.Metrics, constants.ErrSystemTypeUnknown)
+	}
+	if !strings.Contains(result.Metrics["error"], "SunOS") {
+		t.Errorf("got error %q, want the probe output in it", result.Metrics["error"])
+	}
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+)
+
+// containersMetric names the metric added with metrics.docker, its output is moved to MetricsResult.Containers
+const containersMetric = "containers"
+
+// dockerCommand prints one tab-separated line of name, CPU, memory usage and memory percentage per running container
+// Hosts without docker, or whose daemon cannot be reached, print nothing so the metric is only reported as empty
+const dockerCommand = `if command -v docker >/dev/null 2>&1; then docker stats --no-stream --format '{{.Name}}\t{{.CPUPerc}}\t{{.MemUsage}}\t{{.MemPerc}}' 2>/dev/null; fi`
+
+// nestContainers replaces the raw containers metric of a successful result with the parsed per-container stats
+// Lines that do not parse are dropped with a warning each
+func nestContainers(result models.MetricsResult) models.MetricsResult {
+	raw, ok := result.Metrics[containersMetric]
+	if !result.Success || !ok {
+		return result
+	}
+	delete(result.Metrics, containersMetric)
+	delete(result.TypedMetrics, containersMetric)
+
+	containers, warnings := ParseDockerStats(raw)
+	result.Containers = containers
+	result.Warnings = append(result.Warnings, warnings...)
+	return result
+}
+
+// ParseDockerStats parses the output of dockerCommand, e.g. "web\t0.25%\t10.5MiB / 1.944GiB\t0.53%"
+// A line that does not parse is skipped and reported in the warnings, the other containers are kept
+func ParseDockerStats(raw string) ([]models.ContainerStats, []string) {
+	var containers []models.ContainerStats
+	var warnings []string
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		container, err := parseDockerStatsLine(line)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to parse metric %s: %s", containersMetric, err.Error()))
+			continue
+		}
+		containers = append(containers, container)
+	}
+	return containers, warnings
+}
+
+// parseDockerStatsLine parses the stats of one container
+func parseDockerStatsLine(line string) (models.ContainerStats, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 4 {
+		return models.ContainerStats{}, fmt.Errorf("unexpected docker stats line %q", line)
+	}
+
+	cpu, err := parsePercent(fields[1])
+	if err != nil {
+		return models.ContainerStats{}, fmt.Errorf("container %s: %w", fields[0], err)
+	}
+	usage, limit, ok := strings.Cut(fields[2], "/")
+	if !ok {
+		return models.ContainerStats{}, fmt.Errorf("container %s: unexpected memory usage %q", fields[0], fields[2])
+	}
+	usageBytes, ok := models.ParseBytes(strings.TrimSpace(usage))
+	if !ok {
+		return models.ContainerStats{}, fmt.Errorf("container %s: unexpected memory usage %q", fields[0], fields[2])
+	}
+	limitBytes, ok := models.ParseBytes(strings.TrimSpace(limit))
+	if !ok {
+		return models.ContainerStats{}, fmt.Errorf("container %s: unexpected memory limit %q", fields[0], fields[2])
+	}
+	memory, err := parsePercent(fields[3])
+	if err != nil {
+		return models.ContainerStats{}, fmt.Errorf("container %s: %w", fields[0], err)
+	}
+
+	return models.ContainerStats{
+		Name:             fields[0],
+		CPUPercent:       cpu,
+		MemoryBytes:      usageBytes,
+		MemoryLimitBytes: limitBytes,
+		MemoryPercent:    memory,
+	}, nil
+}
+
+// parsePercent parses a percentage such as "12.5%", docker prints "--" for containers without stats
+func parsePercent(raw string) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "--" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(strings.TrimSuffix(raw, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected percentage %q", raw)
+	}
+	return value, nil
+}
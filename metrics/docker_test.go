@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"slices"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dockerStatsOutput is docker stats --no-stream printing the format of dockerCommand for three containers
+const dockerStatsOutput = "web\t0.25%\t10.5MiB / 1.944GiB\t0.53%\n" +
+	"db\t12.40%\t512MiB / 2GiB\t25.00%\n" +
+	"starting\t--\t0B / 0B\t--\n"
+
+func TestParseDockerStats(t *testing.T) {
+	containers, warnings := ParseDockerStats(dockerStatsOutput + "\n")
+	if len(warnings) != 0 {
+		t.Errorf("got warnings %v, want none", warnings)
+	}
+	want := []models.ContainerStats{
+		{Name: "web", CPUPercent: 0.25, MemoryBytes: 10.5 * (1 << 20), MemoryLimitBytes: 1.944 * (1 << 30), MemoryPercent: 0.53},
+		{Name: "db", CPUPercent: 12.4, MemoryBytes: 512 << 20, MemoryLimitBytes: 2 << 30, MemoryPercent: 25},
+		{Name: "starting"},
+	}
+	if !slices.Equal(containers, want) {
+		t.Errorf("got %+v, want %+v", containers, want)
+	}
+}
+
+func TestParseDockerStatsBadLines(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"missing field", "cache\t1.00%\t5MiB / 1GiB"},
+		{"bad percentage", "cache\thigh\t5MiB / 1GiB\t0.50%"},
+		{"bad memory usage", "cache\t1.00%\t5MiB\t0.50%"},
+		{"bad memory limit", "cache\t1.00%\t5MiB / lots\t0.50%"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The other containers are kept
+			containers, warnings := ParseDockerStats("web\t0.25%\t10.5MiB / 1.944GiB\t0.53%\n" + tt.line + "\n")
+			if len(containers) != 1 || containers[0].Name != "web" {
+				t.Errorf("got containers %+v, want web only", containers)
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "cache") {
+				t.Errorf("got warnings %v, want one naming the container", warnings)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsDocker(t *testing.T) {
+	tests := []struct {
+		name           string
+		docker         string
+		wantContainers int
+		wantWarning    string
+	}{
+		{"running containers", "cat <<'OUT'\n" + dockerStatsOutput + "OUT\n", 3, ""},
+		{"daemon unreachable", "echo 'Cannot connect to the Docker daemon' >&2; exit 1", 0, "no value for metric containers"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCommands(t, map[string]string{"docker": tt.docker})
+			srv := newTestServer(t, sshtest.Options{})
+			ctx := sshtest.Context(t, `{"metrics": {"docker": true, "commands": {"hostname": "echo host1"}}}`)
+
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if !result.Success || result.Metrics["hostname"] != "host1" {
+				t.Fatalf("got %+v, want a successful collect", result)
+			}
+			if _, ok := result.Metrics[containersMetric]; ok {
+				t.Errorf("got a flat %s metric, want the stats nested", containersMetric)
+			}
+			if len(result.Containers) != tt.wantContainers {
+				t.Errorf("got containers %+v, want %d", result.Containers, tt.wantContainers)
+			}
+			if tt.wantWarning != "" && !slices.Contains(result.Warnings, tt.wantWarning) {
+				t.Errorf("got warnings %v, want %q", result.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestKnownMetricNamesDocker(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, `{"metrics": {"docker": true}}`)
+	if slices.Contains(KnownMetricNames(cfg), containersMetric) {
+		t.Errorf("got %s among the known metric names, it is not a flat metric", containersMetric)
+	}
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"fmt"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+)
+
+// PlannedCommand returns the command line the collector for systemType would run, without connecting
+// In parallel mode each Linux command runs in its own session, the combined form is still returned for review
+// Devices without a system type only show the detection probe, the collector is chosen on the device
+func PlannedCommand(systemType string, cfg *config.Config) (string, error) {
+	switch systemType {
+	case constants.SystemTypeLinux:
+		commands := linuxCommands(cfg)
+		return combineShellCommands(orderedNames(commands, cfg.Metrics.Order), commands), nil
+	case constants.SystemTypeWindows:
+		return combinePowerShellCommands(orderedNames(windowsCommands, nil), windowsCommands), nil
+	case constants.SystemTypeDarwin:
+		return combineShellCommands(orderedNames(darwinCommands, nil), darwinCommands), nil
+	case constants.SystemTypeFreeBSD:
+		return combineShellCommands(orderedNames(freebsdCommands, nil), freebsdCommands), nil
+	case constants.SystemTypeRaw:
+		return combineShellCommands(orderedNames(cfg.Metrics.Commands, cfg.Metrics.Order), cfg.Metrics.Commands), nil
+	case constants.SystemTypeAuto:
+		return systemTypeProbe, nil
+	case constants.SystemTypeSNMP:
+		return fmt.Sprintf("snmp get %s %s; snmp walk %s %s", oidSysUpTime, oidSysName, oidIfInOctets, oidIfOutOctets), nil
+	default:
+		return "", fmt.Errorf("unsupported system type: %s", systemType)
+	}
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"ssh-plugin/internal/sshtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// localizedFree is a free printing decimal commas unless the C locale is selected, like procps under de_DE
+const localizedFree = `case "${LC_ALL:-$LANG}" in
+C|POSIX) used=3.2 ;;
+*) used=3,2 ;;
+esac
+echo "               total        used        free      shared  buff/cache   available"
+echo "Mem:            15       $used         9           0           3          11"
+`
+
+func TestCollectMetricsEnv(t *testing.T) {
+	fakeCommands(t, map[string]string{"free": localizedFree})
+	// The server's own environment asks for German number formatting
+	t.Setenv("LANG", "de_DE.UTF-8")
+	t.Setenv("LC_ALL", "")
+	const env = `"env": {"LANG": "C", "LC_ALL": "C"}`
+
+	tests := []struct {
+		name      string
+		acceptEnv []string
+		ssh       string
+		want      string
+	}{
+		{"server locale", nil, ``, "3,2"},
+		{"accepted by the server", nil, env, "3.2"},
+		// sshd without AcceptEnv for the names refuses them, the command exports them instead
+		{"refused by the server", []string{"TZ"}, env, "3.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, sshtest.Options{AcceptEnv: tt.acceptEnv})
+			for mode, metrics := range map[string]string{"combined": ``, "parallel": `"parallel": true, `} {
+				ctx := sshtest.Context(t, `{"ssh": {`+tt.ssh+`}, "metrics": {`+metrics+`"commands": {"memory": "free -g | awk '/Mem:/ {print $3}'"}}}`)
+				result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+				if got := result.Metrics["memory"]; got != tt.want {
+					t.Errorf("%s: got memory %q, want %q", mode, got, tt.want)
+				}
+			}
+
+			exported := false
+			for _, command := range srv.Commands() {
+				exported = exported || strings.HasPrefix(command, "export LANG='C' LC_ALL='C'; ")
+			}
+			if refused := tt.acceptEnv != nil; exported != refused {
+				t.Errorf("got commands %q, want the variables exported only when the server refuses them", srv.Commands())
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"ssh-plugin/models"
+	"time"
+)
+
+// freebsdCommands maps metric names to sysctl-based FreeBSD commands producing the same shape as the Linux commands
+var freebsdCommands = map[string]string{
+	"hostname":  "hostname",
+	"uptime":    "uptime | awk -F'up |, [0-9]+ user' '{print \"up \" $2}'",
+	"cpu":       "a=$(sysctl -n kern.cp_time); sleep 1; b=$(sysctl -n kern.cp_time); echo $a $b | awk '{t=0; for (i=1; i<=5; i++) t+=$(i+5)-$i; printf \"%.1f\\n\", t ? 100*(t-($10-$5))/t : 0}'",
+	"memory":    "sysctl -n vm.stats.vm.v_active_count vm.stats.vm.v_wire_count hw.pagesize | awk '{v[NR]=$1} END {printf \"%.0fB\\n\", (v[1]+v[2])*v[3]}'",
+	"disk":      "df -k / | awk 'NR==2 {printf \"%.0fB\\n\", $3*1024}'",
+	"processes": "ps ax | wc -l",
+}
+
+// CollectFreeBSDMetrics collects metrics from a FreeBSD device using SSH
+// It executes all commands in a single SSH session and parses the output
+// Panics are caught and converted to error results to prevent process crashes
+func CollectFreeBSDMetrics(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Recover from panics to ensure the process continues for other devices
+	defer func() {
+		if r := recover(); r != nil {
+			result = models.NewMetricsError(device.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+		}
+	}()
+
+	return collectSectioned(ctx, device, timeout, orderedNames(freebsdCommands, nil), freebsdCommands, combineShellCommands, "", ptyPolicy{}, false)
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"testing"
+	"time"
+)
+
+// freebsdOutput holds commands printing output recorded on a FreeBSD 14 firewall
+// sysctl reports advancing CPU counters on each kern.cp_time read
+var freebsdOutput = map[string]string{
+	"hostname": `echo fw1.example.org`,
+	"uptime":   `echo " 3:14PM  up 12 days,  4:31, 2 users, load averages: 0.21, 0.18, 0.16"`,
+	"sysctl": `shift
+case "$1" in
+kern.cp_time)
+	state="$(dirname "$0")/cp_time"
+	if [ -e "$state" ]; then echo "1010 0 505 50 8535"; else echo "1000 0 500 50 8450"; touch "$state"; fi ;;
+vm.stats.vm.v_active_count)
+	printf '262150\n131072\n4096\n' ;;
+esac
+`,
+	"df": `cat <<'OUT'
+Filesystem  1K-blocks    Used    Avail Capacity  Mounted on
+/dev/ada0p2  28311552 9437190 16777210    36%    /
+OUT
+`,
+	"ps": `cat <<'OUT'
+ PID TT  STAT    TIME COMMAND
+   1  -  ILs  0:00.01 /sbin/init
+ 412  -  Ss   0:01.12 /usr/sbin/syslogd -s
+ 598  -  Ss   0:00.40 /usr/sbin/sshd
+ 611  -  Is   0:00.05 /usr/sbin/cron -s
+OUT
+`,
+}
+
+func TestCollectFreeBSDMetrics(t *testing.T) {
+	fakeCommands(t, freebsdOutput)
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{}`)
+	device := testDevice(srv)
+	device.SystemType = constants.SystemTypeFreeBSD
+
+	result := CollectFreeBSDMetrics(ctx, device, 10*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+
+	want := map[string]string{
+		"hostname":  "fw1.example.org",
+		"uptime":    "up 12 days,  4:31",
+		"cpu":       "15.0",
+		"memory":    "1610637312B",
+		"disk":      "9663682560B",
+		"processes": "5",
+	}
+	for name, value := range want {
+		if got := result.Metrics[name]; got != value {
+			t.Errorf("got %s %q, want %q", name, got, value)
+		}
+	}
+	if got := result.TypedMetrics["uptime"].Num; got != 12*86400+4*3600+31*60 {
+		t.Errorf("got uptime %v seconds, want 12 days 4:31", got)
+	}
+	if got := result.TypedMetrics["memory"].Num; got != 1610637312 {
+		t.Errorf("got memory %v bytes, want 1610637312", got)
+	}
+}
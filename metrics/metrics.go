@@ -1,21 +1,47 @@
 package metrics
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"runtime/debug"
-	"ssh-plugin/constants"
+	"slices"
+	"sort"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/random"
 	"ssh-plugin/models"
 	"ssh-plugin/utils"
 	"strings"
+	"sync"
 	"time"
 
 	"ssh-plugin/config"
+
+	"golang.org/x/crypto/ssh"
 )
 
+// clientPool shares SSH clients between collections within a batch
+var clientPool = utils.NewClientPool(constants.PoolIdleTimeout * time.Second)
+
+// CloseClients closes the SSH clients cached during the batch
+func CloseClients() {
+	clientPool.Close()
+}
+
 // CollectMetrics collects metrics from a device using SSH for Linux systems
-// It executes all configured commands in a single SSH session and parses the output
+// It executes all configured commands in a single SSH session and parses the output,
+// or runs each command in its own session when metrics.parallel is set
 // Panics are caught and converted to error results to prevent process crashes
-func CollectMetrics(device models.Device, timeout time.Duration) (result models.MetricsResult) {
+func CollectMetrics(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Registered first so it runs last and logs the result a recovered panic produced
+	defer func() {
+		slog.Debug("Metrics collection finished", "device_id", device.ID, "success", result.Success, "metrics", len(result.Metrics))
+	}()
+
 	// Recover from panics to ensure the process continues for other devices
 	defer func() {
 		if r := recover(); r != nil {
@@ -23,51 +49,669 @@ func CollectMetrics(device models.Device, timeout time.Duration) (result models.
 		}
 	}()
 
-	client, err := utils.CreateSSHClient(device, timeout)
+	cfg, err := config.FromContext(ctx)
 	if err != nil {
-		return models.NewMetricsError(device.ID, fmt.Sprintf("SSH connection error: %s", err.Error()))
+		return models.NewMetricsError(device.ID, fmt.Sprintf("Config load error: %s", err.Error()))
+	}
+
+	commands := mergeCommands(linuxCommands(cfg), device.CommandOverrides)
+	password := device.Credentials.SudoPassword
+	commands, sudoed := wrapSudo(commands, cfg.Metrics.Sudo, password)
+
+	names := orderedNames(commands, cfg.Metrics.Order)
+	pty := newPTYPolicy(cfg.Metrics.PTY, cfg.Metrics.PTYCommands)
+
+	if cfg.Metrics.Parallel {
+		result = collectParallel(ctx, device, timeout, commands, groupNames(names, cfg.Metrics.Groups), func(unit []string) string {
+			return sudoStdin(unit, sudoed, password)
+		}, pty)
+	} else {
+		result = collectSectioned(ctx, device, timeout, names, commands, combineShellCommands, sudoStdin(names, sudoed, password), pty, cfg.Metrics.UploadScript)
+	}
+
+	// Container stats are structured, they are reported apart from the flat metrics
+	if cfg.Metrics.Docker {
+		result = nestContainers(result)
+	}
+	return result
+}
+
+// ptyPolicy decides which sessions request a PTY
+type ptyPolicy struct {
+	all      bool
+	commands map[string]bool
+}
+
+// newPTYPolicy creates a policy requesting a PTY for every session when all is set,
+// otherwise for sessions running any of the named commands
+func newPTYPolicy(all bool, names []string) ptyPolicy {
+	commands := make(map[string]bool, len(names))
+	for _, name := range names {
+		commands[name] = true
+	}
+	return ptyPolicy{all: all, commands: commands}
+}
+
+// needed reports whether a session running the named commands needs a PTY
+func (p ptyPolicy) needed(names []string) bool {
+	if p.all {
+		return true
+	}
+	for _, name := range names {
+		if p.commands[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// orderedNames returns the command names in execution order
+// Names listed in order come first as declared, the remaining ones follow sorted by name
+func orderedNames(commands map[string]string, order []string) []string {
+	names := make([]string, 0, len(commands))
+	seen := make(map[string]bool, len(commands))
+	for _, name := range order {
+		if _, ok := commands[name]; ok && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
 	}
-	defer client.Close()
 
-	cfg, err := config.LoadConfig()
+	var rest []string
+	for name := range commands {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+
+	return append(names, rest...)
+}
+
+// groupNames splits the ordered names into the units run by collectParallel
+// Each configured group becomes one unit in name order, every other command is a unit of its own
+func groupNames(names []string, groups [][]string) [][]string {
+	groupOf := make(map[string]int)
+	for i, group := range groups {
+		for _, name := range group {
+			if _, ok := groupOf[name]; !ok {
+				groupOf[name] = i
+			}
+		}
+	}
+
+	var units [][]string
+	unitOf := make(map[int]int)
+	for _, name := range names {
+		i, grouped := groupOf[name]
+		if !grouped {
+			units = append(units, []string{name})
+			continue
+		}
+		if u, ok := unitOf[i]; ok {
+			units[u] = append(units[u], name)
+			continue
+		}
+		unitOf[i] = len(units)
+		units = append(units, []string{name})
+	}
+	return units
+}
+
+// wrapSudo runs the named commands through sudo and returns the names it wrapped
+// Without a password sudo must not ask for one (-n). With one, each wrapped command reads its own
+// line from stdin and pipes it into sudo -S, every other command gets /dev/null as stdin so the
+// password lines cannot end up in its output
+func wrapSudo(commands map[string]string, sudoNames []string, password string) (map[string]string, map[string]bool) {
+	if len(sudoNames) == 0 {
+		return commands, nil
+	}
+
+	wrapped := make(map[string]string, len(commands))
+	for name, cmd := range commands {
+		wrapped[name] = cmd
+	}
+
+	sudoed := make(map[string]bool, len(sudoNames))
+	for _, name := range sudoNames {
+		if cmd, ok := wrapped[name]; ok && !sudoed[name] {
+			if password == "" {
+				wrapped[name] = fmt.Sprintf("sudo -n sh -c %s", shellQuote(cmd))
+			} else {
+				// The subshell keeps the password variable out of the commands that follow
+				wrapped[name] = fmt.Sprintf(`(IFS= read -r pw && printf '%%s\n' "$pw" | sudo -S -p '' sh -c %s)`, shellQuote(cmd))
+			}
+			sudoed[name] = true
+		}
+	}
+
+	if password != "" {
+		for name, cmd := range wrapped {
+			if !sudoed[name] {
+				wrapped[name] = "{ " + cmd + "\n} </dev/null"
+			}
+		}
+	}
+	return wrapped, sudoed
+}
+
+// sudoStdin returns the stdin for a session running the named commands, one password line
+// per sudo-wrapped command and nothing for a session without any
+func sudoStdin(names []string, sudoed map[string]bool, password string) string {
+	if password == "" {
+		return ""
+	}
+	var stdin strings.Builder
+	for _, name := range names {
+		if sudoed[name] {
+			stdin.WriteString(password + "\n")
+		}
+	}
+	return stdin.String()
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// mergeCommands returns the configured commands with the device overrides applied on top
+func mergeCommands(commands map[string]string, overrides map[string]string) map[string]string {
+	if len(overrides) == 0 {
+		return commands
+	}
+
+	merged := make(map[string]string, len(commands)+len(overrides))
+	for name, cmd := range commands {
+		merged[name] = cmd
+	}
+	for name, cmd := range overrides {
+		if cmd != "" {
+			merged[name] = cmd
+		}
+	}
+	return merged
+}
+
+// collectParallel runs each unit of commands in its own SSH session over a shared connection
+// Commands within a unit run in order in the same session, a failing unit records an error value
+// under each of its names without affecting the others
+// stdin returns what is fed to the session of a unit, pty decides which sessions get a PTY
+func collectParallel(ctx context.Context, device models.Device, timeout time.Duration, commands map[string]string, units [][]string, stdin func([]string) string, pty ptyPolicy) models.MetricsResult {
+	connectStart := time.Now()
+	client, err := clientPool.Get(ctx, device, timeout)
+	connectMs := time.Since(connectStart).Milliseconds()
 	if err != nil {
-		return models.NewMetricsError(device.ID, fmt.Sprintf("Config load error: %s", err.Error()))
+		result := models.NewMetricsError(device.ID, fmt.Sprintf("SSH connection error: %s", err.Error()))
+		result.ConnectMs = connectMs
+		return result
+	}
+
+	collectStart := time.Now()
+
+	metrics := make(map[string]string, len(commands))
+	commandMs := make(map[string]int64)
+	var warnings []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxSessions(ctx))
+	failed := 0
+	var broken error // First failure that was not the command's own exit status
+	timeoutsMs := commandTimeoutsMs(ctx)
+
+	for _, unit := range units {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(unit []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// A command with its own timeout is stopped after it, recording an error for its unit only
+			unitCtx := ctx
+			if limit := unitTimeout(unit, timeoutsMs); limit > 0 {
+				var cancel context.CancelFunc
+				unitCtx, cancel = context.WithTimeout(ctx, limit)
+				defer cancel()
+			}
+
+			unitStart := time.Now()
+			output, unitWarnings, err := runUnit(unitCtx, client, unit, commands, utils.ExecOptions{Stdin: stdin(unit), PTY: pty.needed(unit), Timeout: commandTimeout(device, timeout), MaxOutputBytes: maxOutputBytes(ctx), Env: sessionEnv(ctx, device)})
+			elapsedMs := time.Since(unitStart).Milliseconds()
+
+			mu.Lock()
+			defer mu.Unlock()
+			// Grouped commands share a session, only a command run alone has a time of its own
+			if len(unit) == 1 {
+				commandMs[unit[0]] = elapsedMs
+			}
+			warnings = append(warnings, unitWarnings...)
+			if err != nil && !isExitError(err) && broken == nil {
+				broken = err
+			}
+			for _, name := range unit {
+				if err != nil {
+					metrics[name] = "error: " + err.Error()
+					failed++
+					continue
+				}
+				metrics[name] = output[name]
+			}
+		}(unit)
+	}
+	wg.Wait()
+
+	// The connection may be broken, do not hand it to the next collection
+	if broken != nil {
+		slog.Debug("Discarding SSH client after session failure", "device_id", device.ID, "error", broken)
+		clientPool.Discard(device, client)
+	} else {
+		clientPool.Put(device, client)
+	}
+
+	if failed == len(commands) {
+		return withTimings(models.NewMetricsError(device.ID, constants.ErrExecutionFailed), connectMs, collectStart)
+	}
+
+	sort.Strings(warnings)
+	warnings = append(warnings, dropEmptyMetrics(commands, metrics)...)
+
+	result := models.NewMetricsSuccess(device.ID, metrics)
+	result.Warnings = append(warnings, applyParsers(device.SystemType, &result)...)
+	result.CommandMs = commandMs
+	return withTimings(result, connectMs, collectStart)
+}
+
+// runUnit runs the named commands in one session and returns their output by name
+// A single command runs as is and is streamed like runSectioned, several are combined and split like collectSectioned
+func runUnit(ctx context.Context, client *ssh.Client, unit []string, commands map[string]string, opts utils.ExecOptions) (map[string]string, []string, error) {
+	if len(unit) == 1 {
+		return runSingle(ctx, client, unit[0], commands[unit[0]], opts)
+	}
+
+	return runSectioned(ctx, client, combineShellCommands(unit, commands), opts, nil)
+}
+
+// runSectioned runs a combined command and parses its output as it streams in
+// raw, if not nil, receives the output as it was read
+// The warnings name the metrics whose output was cut, see readSections
+func runSectioned(ctx context.Context, client *ssh.Client, command string, opts utils.ExecOptions, raw *strings.Builder) (map[string]string, []string, error) {
+	stream, err := utils.StreamCommand(ctx, client, command, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stream.Close()
+
+	output := io.Reader(stream)
+	if raw != nil {
+		output = io.TeeReader(stream, raw)
+	}
+
+	// The exit status is the last command's, the output of the others is still valid
+	metrics, warnings, err := parseSectionedOutput(output)
+	if err != nil && isExitError(err) {
+		return metrics, warnings, nil
+	}
+	return metrics, warnings, err
+}
+
+// runSingle runs one command and reads its streamed output as the value of the named metric
+// Output of a command exiting with a nonzero status is kept as long as there is some
+func runSingle(ctx context.Context, client *ssh.Client, name string, command string, opts utils.ExecOptions) (map[string]string, []string, error) {
+	stream, err := utils.StreamCommand(ctx, client, command, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stream.Close()
+
+	metrics, warnings, err := readSections(stream, name)
+	if err != nil && !(isExitError(err) && metrics[name] != "") {
+		return nil, nil, err
+	}
+	return metrics, warnings, nil
+}
+
+// isExitError reports whether err comes from a command exiting with a nonzero status
+func isExitError(err error) bool {
+	var exitErr *ssh.ExitError
+	return errors.As(err, &exitErr)
+}
+
+// collectSectioned runs all commands in a single SSH session and splits the output into metrics
+// combine builds the remote command line running names in order, marking each command's output with sectionHeader
+// stdin, if set, is fed to the combined command, which runs with a PTY if pty requires one for any command
+// With upload the combined command is uploaded as a shell script and run from there, see uploadScript
+func collectSectioned(ctx context.Context, device models.Device, timeout time.Duration, names []string, commands map[string]string, combine func([]string, map[string]string) string, stdin string, pty ptyPolicy, upload bool) models.MetricsResult {
+	connectStart := time.Now()
+	client, err := clientPool.Get(ctx, device, timeout)
+	connectMs := time.Since(connectStart).Milliseconds()
+	if err != nil {
+		result := models.NewMetricsError(device.ID, fmt.Sprintf("SSH connection error: %s", err.Error()))
+		result.ConnectMs = connectMs
+		return result
+	}
+
+	// Execute all commands in one go
+	collectStart := time.Now()
+	opts := utils.ExecOptions{Stdin: stdin, PTY: pty.needed(names), Timeout: commandTimeout(device, timeout), MaxOutputBytes: maxOutputBytes(ctx), Env: sessionEnv(ctx, device)}
+	command := combine(names, commands)
+
+	// The output as received is kept for debugging parsers, also on failure, covering both attempts when retried
+	var raw *strings.Builder
+	if debugRaw(ctx) {
+		raw = new(strings.Builder)
+	}
+	metrics, cutWarnings, err := runCombined(ctx, client, command, opts, upload, raw)
+
+	// Banners or kernel messages interleaved with the output can cost sections, a fresh session usually recovers them
+	if err == nil && len(metrics) < len(names) {
+		slog.Debug("Retrying metrics collection after missing sections", "device_id", device.ID, "sections", len(metrics), "commands", len(names))
+		if raw != nil {
+			raw.WriteString(rawRetrySeparator)
+		}
+		if retried, retriedWarnings, retryErr := runCombined(ctx, client, command, opts, upload, raw); retryErr == nil && len(retried) > len(metrics) {
+			metrics, cutWarnings = retried, retriedWarnings
+		}
+	}
+	if err != nil {
+		// The connection may be broken, do not hand it to the next collection
+		slog.Debug("Discarding SSH client after command failure", "device_id", device.ID, "error", err)
+		clientPool.Discard(device, client)
+		result := models.NewMetricsError(device.ID, fmt.Sprintf("Command execution error: %s", err.Error()))
+		// What arrived before the failure is what explains it
+		if raw != nil {
+			result.Raw = raw.String()
+		}
+		return withTimings(result, connectMs, collectStart)
+	}
+	clientPool.Put(device, client)
+
+	// Metrics without output are reported as warnings, the command itself succeeded
+	warnings := append(cutWarnings, dropEmptyMetrics(commands, metrics)...)
+
+	result := models.NewMetricsSuccess(device.ID, metrics)
+	result.Warnings = append(warnings, applyParsers(device.SystemType, &result)...)
+	if raw != nil {
+		result.Raw = raw.String()
+	}
+	return withTimings(result, connectMs, collectStart)
+}
+
+// rawRetrySeparator starts the output of the retry in a result's raw output
+const rawRetrySeparator = "\n----- retry after missing sections -----\n"
+
+// runCombined runs a combined command like runSectioned, from an uploaded script when upload is set
+func runCombined(ctx context.Context, client *ssh.Client, command string, opts utils.ExecOptions, upload bool, raw *strings.Builder) (map[string]string, []string, error) {
+	if !upload {
+		return runSectioned(ctx, client, command, opts, raw)
+	}
+
+	path, command, err := uploadScript(ctx, client, command, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics, warnings, err := runSectioned(ctx, client, command, opts, raw)
+	if err != nil {
+		removeScript(ctx, client, path)
 	}
+	return metrics, warnings, err
+}
+
+// commandTimeout returns the command timeout for a device with a timeout override,
+// which also gives its commands at least as long as the connection, zero keeps the default
+func commandTimeout(device models.Device, timeout time.Duration) time.Duration {
+	if device.TimeoutSec > 0 {
+		return timeout
+	}
+	return 0
+}
 
+// maxOutputBytes returns the configured output limit of a command
+// The configuration was validated at startup, zero lets StreamCommand apply its default if it cannot be reloaded
+func maxOutputBytes(ctx context.Context) int64 {
+	cfg, err := config.FromContext(ctx)
+	if err != nil {
+		return 0
+	}
+	return cfg.Metrics.MaxOutputBytes
+}
+
+// debugRaw reports whether results carry the raw combined output, see metrics.debug_raw
+func debugRaw(ctx context.Context) bool {
+	cfg, err := config.FromContext(ctx)
+	if err != nil {
+		return false
+	}
+	return cfg.Metrics.DebugRaw
+}
+
+// maxSessions returns how many sessions parallel mode opens at once on a device,
+// servers refuse channels beyond their MaxSessions so the default stays small
+func maxSessions(ctx context.Context) int {
+	cfg, err := config.FromContext(ctx)
+	if err != nil {
+		return constants.MaxSessions
+	}
+	return cfg.SSH.MaxSessions
+}
+
+// sessionEnv returns the environment metric commands run with on device
+// Windows devices get none, the fallback exporting variables refused by the server needs a POSIX shell
+func sessionEnv(ctx context.Context, device models.Device) map[string]string {
+	cfg, err := config.FromContext(ctx)
+	if err != nil || device.SystemType == constants.SystemTypeWindows {
+		return nil
+	}
+	return cfg.SSH.Env
+}
+
+// commandTimeoutsMs returns the configured timeouts of individual commands in milliseconds
+func commandTimeoutsMs(ctx context.Context) map[string]int {
+	cfg, err := config.FromContext(ctx)
+	if err != nil {
+		return nil
+	}
+	return cfg.Metrics.TimeoutsMs
+}
+
+// unitTimeout returns the time a unit may run, the longest timeout among its commands,
+// zero when none of them has one so the command timeout applies
+func unitTimeout(unit []string, timeoutsMs map[string]int) time.Duration {
+	var limit time.Duration
+	for _, name := range unit {
+		limit = max(limit, time.Duration(timeoutsMs[name])*time.Millisecond)
+	}
+	return limit
+}
+
+// dropEmptyMetrics removes metrics without a value and returns a warning for each command that produced none
+func dropEmptyMetrics(commands map[string]string, metrics map[string]string) []string {
+	var warnings []string
+	for name := range commands {
+		if metrics[name] == "" {
+			delete(metrics, name)
+			warnings = append(warnings, fmt.Sprintf("no value for metric %s", name))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// withTimings records the connection and collection latency on a result
+func withTimings(result models.MetricsResult, connectMs int64, collectStart time.Time) models.MetricsResult {
+	result.ConnectMs = connectMs
+	result.CollectMs = time.Since(collectStart).Milliseconds()
+	return result
+}
+
+// combineShellCommands joins the named commands into a single POSIX shell command line, in order
+// Every command runs whatever the exit status of the previous one
+func combineShellCommands(names []string, commands map[string]string) string {
 	// Prepare single combined command
 	var combinedCommands []string
 
 	// Add each command to the combined command list
-	for name, cmd := range cfg.Metrics.Commands {
-		combinedCommands = append(combinedCommands, fmt.Sprintf("echo '__%s__'; %s", name, cmd))
+	for _, name := range names {
+		combinedCommands = append(combinedCommands, fmt.Sprintf("echo '%s'; %s", sectionHeader(name), commands[name]))
 	}
 
-	finalCommand := strings.Join(combinedCommands, " && ")
+	return strings.Join(combinedCommands, "; ")
+}
 
-	// Execute all commands in one go
-	rawOutput, err := utils.ExecuteCommand(client, finalCommand)
-	if err != nil {
-		return models.NewMetricsError(device.ID, fmt.Sprintf("Command execution error: %s", err.Error()))
+// sectionPrefix starts every section header, it embeds a random token generated once per run
+// so command output cannot be mistaken for a header
+var sectionPrefix = "__" + newSectionToken() + "_"
+
+// sectionSuffix ends every section header
+const sectionSuffix = "__"
+
+// newSectionToken returns a random hex token for sectionPrefix
+func newSectionToken() string {
+	token := make([]byte, 8)
+	if _, err := random.Read(token); err != nil {
+		panic(fmt.Sprintf("failed to generate section token: %v", err))
 	}
+	return hex.EncodeToString(token)
+}
+
+// sectionHeader returns the marker line printed before a metric's output
+func sectionHeader(name string) string {
+	return sectionPrefix + name + sectionSuffix
+}
+
+// maxOutputLine bounds a single line of command output, a longer line turns its metric into an error value
+const maxOutputLine = 1024 * 1024
 
-	// Parse the output
-	lines := strings.Split(strings.TrimSpace(rawOutput), "\n")
+// maxSectionBytes bounds the value kept for one metric, output past it is read and dropped with a warning
+const maxSectionBytes = 1024 * 1024
+
+// parseSectionedOutput maps each section header in the output to the lines that follow it, up to the next header
+// Everything before the first header, such as a login banner or MOTD, is discarded
+// A header glued to the end of other output, e.g. banner text printed without a newline, is still recognized,
+// the text before it stays with the section it was printed in
+// Output is read line by line, each metric keeps at most maxSectionBytes of it and the rest is dropped,
+// the returned warnings name the metrics cut this way
+func parseSectionedOutput(r io.Reader) (map[string]string, []string, error) {
+	return readSections(r, "")
+}
+
+// readSections reads output like parseSectionedOutput, all of it going to the metric first when set
+// with section headers no longer recognized, as for a command run on its own
+func readSections(r io.Reader, first string) (map[string]string, []string, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
 	metrics := make(map[string]string)
-	var currentMetric string
+	var warnings []string
+	currentMetric := first
+	var lines []string
+	var size int
+	var tooLong, cut bool
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "__") && strings.HasSuffix(line, "__") {
-			currentMetric = strings.TrimSuffix(strings.TrimPrefix(line, "__"), "__")
-		} else if currentMetric != "" {
-			metrics[currentMetric] = line
-			currentMetric = ""
+	// A section without output is still recorded, only lost headers count as missing sections
+	finishSection := func() {
+		switch {
+		case currentMetric == "":
+		case tooLong:
+			metrics[currentMetric] = fmt.Sprintf("error: output line longer than %d bytes", maxOutputLine)
+		default:
+			metrics[currentMetric] = sectionValue(lines)
+			if cut {
+				warnings = append(warnings, fmt.Sprintf("output of metric %s cut at %d bytes", currentMetric, maxSectionBytes))
+			}
 		}
 	}
 
-	if len(metrics) == 0 {
-		return models.NewMetricsError(device.ID, constants.ErrExecutionFailed)
+	keepLine := func(line string) {
+		if currentMetric == "" || cut {
+			return
+		}
+		if size+len(line) > maxSectionBytes {
+			cut = true
+			return
+		}
+		lines = append(lines, line)
+		size += len(line) + 1
 	}
 
-	return models.NewMetricsSuccess(device.ID, metrics)
+	addLine := func(text string) {
+		// Lines keep their indentation so tabular output such as df stays aligned
+		line := strings.TrimRight(text, " \t\r")
+		if first != "" {
+			keepLine(line)
+			return
+		}
+		before, name, ok := cutSectionHeader(strings.TrimSpace(line))
+		if !ok {
+			keepLine(line)
+			return
+		}
+
+		if before != "" {
+			keepLine(before)
+		}
+		finishSection()
+		currentMetric, lines, size, tooLong, cut = name, nil, 0, false, false
+	}
+
+	for {
+		text, lineTooLong, err := readLine(reader, maxOutputLine)
+		if lineTooLong {
+			tooLong = true
+		} else if text != "" || err == nil {
+			addLine(text)
+		}
+
+		if err != nil {
+			finishSection()
+			if err == io.EOF {
+				err = nil
+			}
+			return metrics, warnings, err
+		}
+	}
+}
+
+// readLine reads one line without its newline, a line longer than limit is skipped and reported as too long
+func readLine(r *bufio.Reader, limit int) (string, bool, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > limit+1 {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return strings.TrimSuffix(string(line), "\n"), tooLong, err
+	}
+}
+
+// sectionValue joins the lines of a section into its metric value, without the blank lines around them
+// A single line is trimmed like before, several keep their indentation
+func sectionValue(lines []string) string {
+	first := slices.IndexFunc(lines, func(line string) bool { return strings.TrimSpace(line) != "" })
+	if first < 0 {
+		return ""
+	}
+	last := len(lines) - 1
+	for strings.TrimSpace(lines[last]) == "" {
+		last--
+	}
+
+	if first == last {
+		return strings.TrimSpace(lines[first])
+	}
+	return strings.Join(lines[first:last+1], "\n")
+}
+
+// cutSectionHeader splits a line ending in a section header into the text before the header and the metric name
+func cutSectionHeader(line string) (before string, name string, ok bool) {
+	index := strings.Index(line, sectionPrefix)
+	if index < 0 || !strings.HasSuffix(line, sectionSuffix) || len(line) < index+len(sectionPrefix)+len(sectionSuffix) {
+		return "", "", false
+	}
+	name = line[index+len(sectionPrefix) : len(line)-len(sectionSuffix)]
+	return strings.TrimSpace(line[:index]), name, true
 }
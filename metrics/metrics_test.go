@@ -0,0 +1,789 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/random"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDevice returns a Linux device logging in to srv
+func testDevice(srv *sshtest.Server) models.Device {
+	return models.Device{
+		ID:          1,
+		IP:          srv.Host(),
+		Port:        srv.Port(),
+		SystemType:  "linux",
+		Credentials: models.Credentials{Username: "test", Password: "pw"},
+	}
+}
+
+// newTestServer starts a test server whose cached clients are closed when the test ends
+func newTestServer(t *testing.T, opts sshtest.Options) *sshtest.Server {
+	t.Helper()
+	srv := sshtest.NewServer(t, opts)
+	t.Cleanup(CloseClients)
+	return srv
+}
+
+func TestCollectMetricsReusesClient(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo host1"}}}`)
+	device := testDevice(srv)
+
+	for i := range 2 {
+		result := CollectMetrics(ctx, device, 5*time.Second)
+		if !result.Success || result.Metrics["hostname"] != "host1" {
+			t.Fatalf("collect %d: got %+v, want hostname host1", i+1, result)
+		}
+	}
+
+	if got := srv.Connections(); got != 1 {
+		t.Errorf("got %d connections for two collects, want the cached client reused", got)
+	}
+}
+
+func TestCollectMetricsReconnectsAfterDrop(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo host1"}}}`)
+	device := testDevice(srv)
+
+	if result := CollectMetrics(ctx, device, 5*time.Second); !result.Success {
+		t.Fatalf("first collect failed: %+v", result)
+	}
+	srv.CloseConnections()
+
+	// A cached client the server dropped is replaced instead of failing the collect
+	if result := CollectMetrics(ctx, device, 5*time.Second); !result.Success {
+		t.Fatalf("collect after the connection dropped failed: %+v", result)
+	}
+	if got := srv.Connections(); got != 2 {
+		t.Errorf("got %d connections, want a new one after the drop", got)
+	}
+}
+
+func TestCollectMetricsTimings(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{BannerDelay: 100 * time.Millisecond})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "sleep 0.1; echo host1"}}}`)
+
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if result.ConnectMs < 100 {
+		t.Errorf("got connect_ms %d, want at least the 100ms banner delay", result.ConnectMs)
+	}
+	if result.CollectMs < 100 {
+		t.Errorf("got collect_ms %d, want at least the 100ms command", result.CollectMs)
+	}
+}
+
+func TestCollectMetricsCommandTimings(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	commands := `"commands": {"hostname": "echo host1", "uptime": "echo up 1 hour", "cpu": "sleep 0.2; echo 12.5", "memory": "echo 3", "disk": "echo 18G", "processes": "echo 42"}`
+
+	ctx := sshtest.Context(t, `{"metrics": {"parallel": true, "groups": [["memory", "disk"]], `+commands+`}}`)
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	for _, name := range []string{"hostname", "uptime", "cpu", "processes"} {
+		if _, ok := result.CommandMs[name]; !ok {
+			t.Errorf("no timing recorded for %s: %v", name, result.CommandMs)
+		}
+	}
+	// Grouped commands share a session and have no time of their own
+	for _, name := range []string{"memory", "disk"} {
+		if ms, ok := result.CommandMs[name]; ok {
+			t.Errorf("got timing %dms for grouped command %s, want none", ms, name)
+		}
+	}
+	if ms := result.CommandMs["cpu"]; ms < 200 {
+		t.Errorf("got cpu timing %dms, want at least the 200ms the command sleeps", ms)
+	}
+	if result.CommandMs["hostname"] >= result.CommandMs["cpu"] {
+		t.Errorf("got hostname %dms not below cpu %dms, want the slow command to stand out", result.CommandMs["hostname"], result.CommandMs["cpu"])
+	}
+
+	// Combined commands run in one session, so there is nothing to break down
+	ctx = sshtest.Context(t, `{"metrics": {`+commands+`}}`)
+	if result := CollectMetrics(ctx, testDevice(srv), 5*time.Second); result.CommandMs != nil {
+		t.Errorf("got command timings %v in combined mode, want none", result.CommandMs)
+	}
+}
+
+func TestCollectMetricsOutputLimit(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	commands := `"max_output_bytes": 1024, "commands": {"hostname": "echo host1", "cpu": "head -c 100000 /dev/zero"}`
+
+	t.Run("parallel", func(t *testing.T) {
+		ctx := sshtest.Context(t, `{"metrics": {"parallel": true, `+commands+`}}`)
+		result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+		if !result.Success {
+			t.Fatalf("collect failed: %+v", result)
+		}
+		if got := result.Metrics["hostname"]; got != "host1" {
+			t.Errorf("got hostname %q, want %q", got, "host1")
+		}
+		if got := result.Metrics["cpu"]; !strings.HasPrefix(got, "error: "+constants.ErrOutputTooLarge) {
+			t.Errorf("got cpu %q, want the truncation error", got)
+		}
+	})
+
+	// Combined commands share the limit, the whole collection fails
+	t.Run("combined", func(t *testing.T) {
+		ctx := sshtest.Context(t, `{"metrics": {`+commands+`}}`)
+		result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+		if result.Success {
+			t.Fatalf("collect succeeded with output over the limit: %+v", result)
+		}
+		if got := result.Metrics["error"]; !strings.Contains(got, constants.ErrOutputTooLarge) {
+			t.Errorf("got error %q, want the truncation error", got)
+		}
+	})
+}
+
+func TestCollectMetricsCommandTimeout(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"parallel": true, "commands": {
+		"hostname": {"cmd": "echo host1", "timeout_ms": 2000},
+		"uptime": "echo up 1 hour",
+		"cpu": {"cmd": "sleep 10; echo 12.5", "timeout_ms": 300}
+	}}}`)
+
+	start := time.Now()
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("collect took %s, want the slow command stopped after 300ms", elapsed)
+	}
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if got := result.Metrics["cpu"]; !strings.HasPrefix(got, "error: ") || !strings.Contains(got, constants.ErrTimeout) {
+		t.Errorf("got cpu %q, want a timeout error", got)
+	}
+	if result.Metrics["hostname"] != "host1" || result.Metrics["uptime"] != "up 1 hour" {
+		t.Errorf("got %v, want the other commands to succeed", result.Metrics)
+	}
+}
+
+func TestUnitTimeout(t *testing.T) {
+	timeoutsMs := map[string]int{"cpu": 300, "memory": 1500}
+	tests := []struct {
+		unit []string
+		want time.Duration
+	}{
+		{[]string{"hostname"}, 0},
+		{[]string{"cpu"}, 300 * time.Millisecond},
+		// A group runs under the longest timeout of its commands
+		{[]string{"cpu", "memory", "hostname"}, 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := unitTimeout(tt.unit, timeoutsMs); got != tt.want {
+			t.Errorf("unitTimeout(%q) = %s, want %s", tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestTimingsOmittedWhenUnset(t *testing.T) {
+	data, err := json.Marshal(models.NewMetricsError(1, "failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"connect_ms", "collect_ms", "command_ms"} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("result without timings contains %s: %s", field, data)
+		}
+	}
+}
+
+func TestCollectMetricsDeviceOverride(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo from-config", "uptime": "echo 42"}}}`)
+
+	device := testDevice(srv)
+	device.CommandOverrides = map[string]string{"hostname": "echo from-device", "kernel": "echo 6.1"}
+
+	result := CollectMetrics(ctx, device, 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	want := map[string]string{"hostname": "from-device", "kernel": "6.1", "uptime": "42"}
+	for name, value := range want {
+		if got := result.Metrics[name]; got != value {
+			t.Errorf("got %s %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestParseSectionedOutputOldDelimiter(t *testing.T) {
+	output := strings.Join([]string{
+		sectionHeader("hostname"),
+		"__disk__",
+		"host1",
+		sectionHeader("disk"),
+		"18G",
+	}, "\n")
+
+	metrics, _, err := parseSectionedOutput(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics["hostname"]; got != "__disk__\nhost1" {
+		t.Errorf("got hostname %q, a line like the old delimiter must stay in its section", got)
+	}
+	if got := metrics["disk"]; got != "18G" {
+		t.Errorf("got disk %q, want %q", got, "18G")
+	}
+	if _, ok := metrics["__disk__"]; ok {
+		t.Error("the old delimiter was parsed as a section")
+	}
+}
+
+func TestCollectMetricsDelimiterLookalike(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo '__uptime__'; echo host1", "uptime": "echo 42"}}}`)
+
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if got := result.Metrics["hostname"]; got != "__uptime__\nhost1" {
+		t.Errorf("got hostname %q", got)
+	}
+	if got := result.Metrics["uptime"]; got != "42" {
+		t.Errorf("got uptime %q, want %q", got, "42")
+	}
+}
+
+func TestCollectMetricsEmptyOutput(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	commands := `"commands": {"hostname": "echo host1", "uptime": "true", "cpu": "echo 12.5"}`
+
+	for mode, configJSON := range map[string]string{
+		"combined": `{"metrics": {` + commands + `}}`,
+		"parallel": `{"metrics": {"parallel": true, ` + commands + `}}`,
+	} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := sshtest.Context(t, configJSON)
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if !result.Success {
+				t.Fatalf("collect failed: %+v", result)
+			}
+			if _, ok := result.Metrics["uptime"]; ok {
+				t.Errorf("metric without output is reported: %q", result.Metrics["uptime"])
+			}
+			if result.Metrics["hostname"] != "host1" || result.Metrics["cpu"] != "12.5" {
+				t.Errorf("got metrics %v, the other metrics should be kept", result.Metrics)
+			}
+			if !slices.Contains(result.Warnings, "no value for metric uptime") {
+				t.Errorf("got warnings %v, want one for uptime", result.Warnings)
+			}
+		})
+	}
+}
+
+// fakeCommands puts executable scripts named by the keys of scripts first on PATH
+func fakeCommands(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// fakeSudo puts a sudo on PATH that accepts -n, and -S with the password "secret" on stdin
+// Commands it runs see SUDO_USER set
+func fakeSudo(t *testing.T) {
+	t.Helper()
+	fakeCommands(t, map[string]string{"sudo": `case "$1" in
+-n) shift; SUDO_USER=test exec "$@" ;;
+-S) IFS= read -r pw; [ "$pw" = secret ] || { echo "sudo: incorrect password" >&2; exit 1; }; shift 3; SUDO_USER=test exec "$@" ;;
+esac
+echo "sudo: a password is required" >&2
+exit 1
+`})
+}
+
+func TestCollectMetricsSudo(t *testing.T) {
+	fakeSudo(t)
+	srv := newTestServer(t, sshtest.Options{})
+	// hostname runs through sudo, cpu shows what other commands read from stdin
+	commands := `"sudo": ["hostname"], "commands": {"hostname": "echo \"$SUDO_USER\"", "cpu": "cat; echo 12"}`
+
+	tests := []struct {
+		name     string
+		password string
+		wantSudo bool
+	}{
+		{"non-interactive", "", true},
+		{"password", "secret", true},
+		{"wrong password", "guess", false},
+	}
+
+	for _, tt := range tests {
+		for mode, configJSON := range map[string]string{
+			"combined": `{"metrics": {` + commands + `}}`,
+			"parallel": `{"metrics": {"parallel": true, ` + commands + `}}`,
+		} {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				ctx := sshtest.Context(t, configJSON)
+				device := testDevice(srv)
+				device.Credentials.SudoPassword = tt.password
+
+				result := CollectMetrics(ctx, device, 5*time.Second)
+				if got := result.Metrics["hostname"]; (got == "test") != tt.wantSudo {
+					t.Errorf("got hostname %q, ran through sudo should be %v", got, tt.wantSudo)
+				}
+				// The password lines are only read by sudo, other commands see no stdin
+				if got := result.Metrics["cpu"]; got != "12" {
+					t.Errorf("got cpu %q, want %q", got, "12")
+				}
+			})
+		}
+	}
+}
+
+func TestWrapSudoNonInteractive(t *testing.T) {
+	commands := map[string]string{"disk": "cat /proc/diskstats", "cpu": "echo 1"}
+
+	wrapped, sudoed := wrapSudo(commands, []string{"disk"}, "")
+	if want := "sudo -n sh -c 'cat /proc/diskstats'"; wrapped["disk"] != want {
+		t.Errorf("got %q, want %q", wrapped["disk"], want)
+	}
+	if wrapped["cpu"] != commands["cpu"] || sudoed["cpu"] || !sudoed["disk"] {
+		t.Errorf("got %v wrapped as %v, only disk should use sudo", wrapped, sudoed)
+	}
+	if stdin := sudoStdin([]string{"cpu", "disk"}, sudoed, ""); stdin != "" {
+		t.Errorf("got stdin %q, want none without a sudo password", stdin)
+	}
+}
+
+func TestOrderedNamesStable(t *testing.T) {
+	commands := map[string]string{"uptime": "", "cpu": "", "disk": "", "memory": "", "hostname": ""}
+	want := []string{"memory", "hostname", "cpu", "disk", "uptime"}
+
+	for range 20 {
+		if got := orderedNames(commands, []string{"memory", "missing", "hostname", "memory"}); !slices.Equal(got, want) {
+			t.Fatalf("got order %q, want %q", got, want)
+		}
+	}
+}
+
+func TestGroupNames(t *testing.T) {
+	names := []string{"memory", "hostname", "cpu", "disk", "uptime"}
+	got := groupNames(names, [][]string{{"disk", "memory"}})
+	want := [][]string{{"memory", "disk"}, {"hostname"}, {"cpu"}, {"uptime"}}
+
+	if !slices.EqualFunc(got, want, slices.Equal[[]string]) {
+		t.Errorf("got units %q, want %q", got, want)
+	}
+}
+
+func TestCollectMetricsDependentCommands(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	state := filepath.Join(t.TempDir(), "state")
+	// cpu sorts first by name, it only sees the value when memory runs before it
+	commands := `"order": ["memory", "cpu"], "commands": {"memory": "echo 42 > ` + state + `; echo 1", "cpu": "cat ` + state + `"}`
+
+	for mode, configJSON := range map[string]string{
+		"combined": `{"metrics": {` + commands + `}}`,
+		"parallel": `{"metrics": {"parallel": true, "groups": [["cpu", "memory"]], ` + commands + `}}`,
+	} {
+		t.Run(mode, func(t *testing.T) {
+			os.Remove(state)
+			ctx := sshtest.Context(t, configJSON)
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if got := result.Metrics["cpu"]; got != "42" {
+				t.Errorf("got cpu %q, want %q written by the command ordered before it", got, "42")
+			}
+		})
+	}
+}
+
+func TestCollectMetricsSizesInBytes(t *testing.T) {
+	// Output recorded from free -b and df -B1 --output=used on Ubuntu hosts
+	tests := []struct {
+		name       string
+		free       string
+		df         string
+		wantMemory models.MetricValue
+		wantDisk   models.MetricValue
+	}{
+		{
+			name: "not whole gigabytes",
+			free: `               total        used        free      shared  buff/cache   available
+Mem:     16106127360  3435973837  8375186995           0  3294966528 11596887040
+Swap:     1073741824           0  1073741824`,
+			df: `        Used
+19864223744`,
+			wantMemory: models.MetricValue{Raw: "3435973837B", Num: 3435973837, Unit: "B"},
+			wantDisk:   models.MetricValue{Raw: "19864223744B", Num: 19864223744, Unit: "B"},
+		},
+		{
+			name: "under a gigabyte",
+			free: `               total        used        free      shared  buff/cache   available
+Mem:      1023406080   612368384   180224000     1048576   230813696   331776000
+Swap:              0           0           0`,
+			df: `     Used
+734003200`,
+			wantMemory: models.MetricValue{Raw: "612368384B", Num: 612368384, Unit: "B"},
+			wantDisk:   models.MetricValue{Raw: "734003200B", Num: 734003200, Unit: "B"},
+		},
+	}
+
+	srv := newTestServer(t, sshtest.Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCommands(t, map[string]string{
+				"free": "cat <<'OUT'\n" + tt.free + "\nOUT\n",
+				"df":   "cat <<'OUT'\n" + tt.df + "\nOUT\n",
+			})
+			ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "echo host1", "uptime": "echo up 1 hour", "cpu": "echo 12.5", "processes": "echo 42"}}}`)
+
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if !result.Success {
+				t.Fatalf("collect failed: %+v", result)
+			}
+			// The metric keeps the exact byte count the command printed
+			if got := result.TypedMetrics["memory"]; got != tt.wantMemory {
+				t.Errorf("got memory %+v, want %+v", got, tt.wantMemory)
+			}
+			if got := result.TypedMetrics["disk"]; got != tt.wantDisk {
+				t.Errorf("got disk %+v, want %+v", got, tt.wantDisk)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsPTY(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantPTYs int
+	}{
+		{"none", `{"metrics": {"parallel": true, "commands": {"hostname": "echo host1"}}}`, 0},
+		{"one command", `{"metrics": {"parallel": true, "pty_commands": ["hostname"], "commands": {"hostname": "echo host1"}}}`, 1},
+		{"every command", `{"metrics": {"parallel": true, "pty": true, "commands": {"hostname": "echo host1"}}}`, 6},
+		{"combined session", `{"metrics": {"pty_commands": ["hostname"], "commands": {"hostname": "echo host1"}}}`, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, sshtest.Options{})
+			ctx := sshtest.Context(t, tt.config)
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if result.Metrics["hostname"] != "host1" {
+				t.Errorf("got hostname %q, want host1", result.Metrics["hostname"])
+			}
+			if got := len(srv.PTYRequests()); got != tt.wantPTYs {
+				t.Errorf("got %d PTY requests, want %d", got, tt.wantPTYs)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsMalformedCommands(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": ["not", "an", "object"]}}`)
+	want, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default commands run instead
+	result := CollectMetrics(ctx, testDevice(srv), 10*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if got := result.Metrics["hostname"]; got != want {
+		t.Errorf("got hostname %q, want %q from the default command", got, want)
+	}
+}
+
+func TestCollectMetricsNonzeroExit(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	// grep -c prints 0 and exits 1 without a match, run last its status is the session's
+	commands := `"order": ["cpu", "disk", "hostname", "memory", "uptime"], "commands": {"hostname": "echo host1", "processes": "echo sshd cron | grep -c nginx"}`
+
+	for mode, configJSON := range map[string]string{
+		"combined": `{"metrics": {` + commands + `}}`,
+		"parallel": `{"metrics": {"parallel": true, ` + commands + `}}`,
+	} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := sshtest.Context(t, configJSON)
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if !result.Success {
+				t.Fatalf("collect failed: %+v", result)
+			}
+			if got := result.Metrics["processes"]; got != "0" {
+				t.Errorf("got processes %q, want the output of the failing command", got)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsRetriesMissingSections(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	state := filepath.Join(t.TempDir(), "first-run")
+	// The first run loses every section after hostname, as noise swallowing the headers would
+	hostname := "[ -e " + state + " ] || { touch " + state + "; exit 0; }; echo host1"
+	configJSON, err := json.Marshal(map[string]any{"metrics": map[string]any{
+		"order":    []string{"hostname", "uptime", "cpu"},
+		"commands": map[string]string{"hostname": hostname, "uptime": "echo 42", "cpu": "echo 12.5"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := sshtest.Context(t, string(configJSON))
+
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if _, err := os.Stat(state); err != nil {
+		t.Fatalf("the first run did not happen: %v", err)
+	}
+	want := map[string]string{"hostname": "host1", "uptime": "42", "cpu": "12.5"}
+	for name, value := range want {
+		if got := result.Metrics[name]; got != value {
+			t.Errorf("got %s %q, want %q from the retry", name, got, value)
+		}
+	}
+}
+
+func TestParseSectionedOutputBanner(t *testing.T) {
+	output := strings.Join([]string{
+		"Welcome to host1",
+		"Last login: Mon Oct 12 09:14:02 2026",
+		sectionHeader("hostname"),
+		"",
+		"host1",
+		"host1.example.com",
+		"",
+		"kernel: eth0 link up" + sectionHeader("uptime"),
+		"42",
+	}, "\n")
+
+	metrics, warnings, err := parseSectionedOutput(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics["hostname"]; got != "host1\nhost1.example.com\n\nkernel: eth0 link up" {
+		t.Errorf("got hostname %q, want every line and the text before the glued header", got)
+	}
+	if got := metrics["uptime"]; got != "42" {
+		t.Errorf("got uptime %q, want %q", got, "42")
+	}
+	if len(metrics) != 2 || len(warnings) != 0 {
+		t.Errorf("got metrics %v and warnings %v, the banner must be discarded", metrics, warnings)
+	}
+}
+
+func TestParseSectionedOutputSectionLimit(t *testing.T) {
+	line := strings.Repeat("x", 1023)
+	var output strings.Builder
+	output.WriteString(sectionHeader("processes") + "\n")
+	for range 2 * maxSectionBytes / 1024 {
+		output.WriteString(line + "\n")
+	}
+	output.WriteString(sectionHeader("uptime") + "\n42\n")
+
+	metrics, warnings, err := parseSectionedOutput(strings.NewReader(output.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(metrics["processes"]); got > maxSectionBytes {
+		t.Errorf("got %d bytes for processes, want at most %d", got, maxSectionBytes)
+	}
+	if got := metrics["uptime"]; got != "42" {
+		t.Errorf("got uptime %q, the section after the cut one must be parsed", got)
+	}
+	want := fmt.Sprintf("output of metric processes cut at %d bytes", maxSectionBytes)
+	if !slices.Equal(warnings, []string{want}) {
+		t.Errorf("got warnings %v, want %q", warnings, want)
+	}
+}
+
+func TestParseSectionedOutputIndentation(t *testing.T) {
+	output := strings.Join([]string{
+		sectionHeader("disk"),
+		"",
+		"Filesystem  Size  Used\r",
+		"  /dev/sda1   18G    9G  ",
+		"  /dev/sdb1  200G   50G",
+		"",
+		sectionHeader("processes"),
+		"      42",
+	}, "\n")
+
+	metrics, _, err := parseSectionedOutput(strings.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Filesystem  Size  Used\n  /dev/sda1   18G    9G\n  /dev/sdb1  200G   50G"
+	if got := metrics["disk"]; got != want {
+		t.Errorf("got disk %q, want %q", got, want)
+	}
+	// A single line is trimmed, as wc -l prints it on BSD
+	if got := metrics["processes"]; got != "42" {
+		t.Errorf("got processes %q, want %q", got, "42")
+	}
+}
+
+func TestCollectMetricsMaxSessions(t *testing.T) {
+	if random.Deterministic {
+		t.Skip("deterministic builds open one session at a time")
+	}
+	commands := `"commands": {"hostname": "sleep 0.2; echo host1", "uptime": "sleep 0.2; echo 42", "cpu": "sleep 0.2; echo 12.5", "memory": "sleep 0.2; echo 2048", "disk": "sleep 0.2; echo 18G", "processes": "sleep 0.2; echo 99"}`
+
+	tests := []struct {
+		name        string
+		ssh         string
+		wantRefused bool
+	}{
+		{"within the server limit", `"ssh": {"max_sessions_per_device": 2}, `, false},
+		{"default above the server limit", ``, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, sshtest.Options{MaxSessions: 2})
+			ctx := sshtest.Context(t, `{`+tt.ssh+`"metrics": {"parallel": true, `+commands+`}}`)
+
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if refused := srv.RefusedSessions() > 0; refused != tt.wantRefused {
+				t.Fatalf("got %d sessions refused, want refusals %v", srv.RefusedSessions(), tt.wantRefused)
+			}
+			if tt.wantRefused {
+				return
+			}
+			if !result.Success || len(result.Metrics) != 6 {
+				t.Errorf("got %+v, want every metric", result)
+			}
+			if got := srv.PeakSessions(); got != 2 {
+				t.Errorf("got %d sessions open at once, want 2", got)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsParallelDiscardsBrokenClient(t *testing.T) {
+	tests := []struct {
+		name            string
+		opts            sshtest.Options
+		commands        string
+		wantConnections int
+	}{
+		{"session refused", sshtest.Options{NoSessions: true}, `"hostname": "echo host1", "uptime": "echo 42"`, 2},
+		{"command failed", sshtest.Options{}, `"hostname": "echo host1", "uptime": "exit 1"`, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.opts)
+			ctx := sshtest.Context(t, `{"metrics": {"parallel": true, "commands": {`+tt.commands+`}}}`)
+			device := testDevice(srv)
+
+			for range 2 {
+				CollectMetrics(ctx, device, 5*time.Second)
+			}
+
+			// Only a failed session leaves the connection suspect, a failing command does not
+			if got := srv.Connections(); got != tt.wantConnections {
+				t.Errorf("got %d connections for two collects, want %d", got, tt.wantConnections)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsDebugRaw(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	commands := `"commands": {"hostname": "echo host1", "uptime": "echo 42"}`
+
+	tests := []struct {
+		name       string
+		configJSON string
+		wantRaw    bool
+	}{
+		{"unset", `{"metrics": {` + commands + `}}`, false},
+		{"combined", `{"metrics": {"debug_raw": true, ` + commands + `}}`, true},
+		{"parallel", `{"metrics": {"debug_raw": true, "parallel": true, ` + commands + `}}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := sshtest.Context(t, tt.configJSON)
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if !result.Success {
+				t.Fatalf("collect failed: %+v", result)
+			}
+			if !tt.wantRaw {
+				if result.Raw != "" {
+					t.Errorf("got raw output %q, want none", result.Raw)
+				}
+				return
+			}
+			// The output is kept as received, headers included
+			for _, want := range []string{sectionHeader("hostname") + "\nhost1\n", sectionHeader("uptime") + "\n42\n"} {
+				if !strings.Contains(result.Raw, want) {
+					t.Errorf("got raw output %q, want it to contain %q", result.Raw, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectMetricsDebugRawRetry(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	state := filepath.Join(t.TempDir(), "first-run")
+	configJSON, err := json.Marshal(map[string]any{"metrics": map[string]any{
+		"debug_raw": true,
+		"order":     []string{"hostname", "uptime"},
+		"commands":  map[string]string{"hostname": "[ -e " + state + " ] || { touch " + state + "; echo lost; exit 0; }; echo host1", "uptime": "echo 42"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := sshtest.Context(t, string(configJSON))
+
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	first, second, ok := strings.Cut(result.Raw, rawRetrySeparator)
+	if !ok {
+		t.Fatalf("got raw output %q, want the retry marked", result.Raw)
+	}
+	if !strings.Contains(first, "lost") || !strings.Contains(second, "host1") {
+		t.Errorf("got attempts %q and %q, want the output of both", first, second)
+	}
+}
+
+func TestCollectMetricsDebugRawFailure(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"debug_raw": true, "commands": {"hostname": "echo host1", "uptime": "sleep 10"}}}`)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	// What arrived before the failure explains it
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if result.Success {
+		t.Fatalf("got %+v, want the collect to fail", result)
+	}
+	if !strings.Contains(result.Raw, "host1") {
+		t.Errorf("got raw output %q, want the output received before the failure", result.Raw)
+	}
+}
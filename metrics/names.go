@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"sort"
+	"ssh-plugin/config"
+)
+
+// KnownMetricNames returns the sorted names of every metric the collectors can report with cfg
+func KnownMetricNames(cfg *config.Config) []string {
+	seen := make(map[string]bool)
+	for _, commands := range []map[string]string{linuxCommands(cfg), windowsCommands, darwinCommands, freebsdCommands} {
+		for name := range commands {
+			seen[name] = true
+		}
+	}
+	for _, name := range snmpMetricNames {
+		seen[name] = true
+	}
+	// Container stats are reported apart from the flat metrics, see nestContainers
+	if cfg.Metrics.Docker {
+		delete(seen, containersMetric)
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricParser post-processes the raw output of a metric command into a numeric value for TypedMetrics
+type MetricParser func(raw string) (string, error)
+
+// parsers maps system type and metric name to the parser applied to the metric
+var (
+	parsersMu sync.RWMutex
+	parsers   = make(map[string]map[string]MetricParser)
+)
+
+// RegisterParser registers the parser applied to a metric collected from systemType
+// A later registration for the same metric replaces the earlier one
+func RegisterParser(systemType string, metric string, parser MetricParser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	if parsers[systemType] == nil {
+		parsers[systemType] = make(map[string]MetricParser)
+	}
+	parsers[systemType][metric] = parser
+}
+
+func init() {
+	for _, systemType := range []string{constants.SystemTypeLinux, constants.SystemTypeWindows, constants.SystemTypeDarwin, constants.SystemTypeFreeBSD} {
+		RegisterParser(systemType, "uptime", ParseUptimeSeconds)
+		RegisterParser(systemType, "cpu", StripPercent)
+	}
+}
+
+// applyParsers records the parsed value of each metric with a parser in the result's TypedMetrics
+// The raw strings in Metrics are left unchanged, metrics without a parser pass through
+// A metric whose parser fails or yields a non-numeric value produces a warning
+func applyParsers(systemType string, result *models.MetricsResult) []string {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+
+	var warnings []string
+	for name, raw := range result.Metrics {
+		parser, ok := parsers[systemType][name]
+		if !ok {
+			continue
+		}
+		value, err := parser(raw)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to parse metric %s: %s", name, err.Error()))
+			continue
+		}
+		if !result.SetTypedMetric(name, value) {
+			warnings = append(warnings, fmt.Sprintf("failed to parse metric %s: parsed value %q is not numeric", name, value))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// uptimeUnitPattern matches one "<n> <unit>" part of an uptime, e.g. "3 days" or "1 hour"
+var uptimeUnitPattern = regexp.MustCompile(`(\d+)\s+(week|day|hour|min|minute|sec|second)s?\b`)
+
+// uptimeClockPattern matches the "H:MM" part printed by uptime on BSD and macOS
+var uptimeClockPattern = regexp.MustCompile(`\b(\d+):(\d{2})\b`)
+
+// uptimeUnitSeconds holds the length of each uptime unit in seconds
+var uptimeUnitSeconds = map[string]int{
+	"week":   7 * 24 * 3600,
+	"day":    24 * 3600,
+	"hour":   3600,
+	"min":    60,
+	"minute": 60,
+	"sec":    1,
+	"second": 1,
+}
+
+// ParseUptimeSeconds converts an uptime such as "up 3 days, 2 hours, 5 minutes" or "up 3 days, 2:05" to seconds
+func ParseUptimeSeconds(raw string) (string, error) {
+	total := 0
+	matched := false
+
+	for _, match := range uptimeUnitPattern.FindAllStringSubmatch(raw, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return "", err
+		}
+		total += n * uptimeUnitSeconds[match[2]]
+		matched = true
+	}
+
+	if match := uptimeClockPattern.FindStringSubmatch(raw); match != nil {
+		hours, _ := strconv.Atoi(match[1])
+		minutes, _ := strconv.Atoi(match[2])
+		total += hours*3600 + minutes*60
+		matched = true
+	}
+
+	if !matched {
+		return "", fmt.Errorf("unrecognized uptime %q", raw)
+	}
+	return strconv.Itoa(total), nil
+}
+
+// StripPercent removes a trailing percent sign, e.g. "12.5%" becomes "12.5"
+func StripPercent(raw string) (string, error) {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(raw), "%")), nil
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"testing"
+)
+
+func TestParseUptimeSeconds(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"up 3 days, 2 hours, 5 minutes", "266700", false},
+		{"up 1 week, 1 day", "691200", false},
+		{"up 45 minutes", "2700", false},
+		{"up 1 hour, 1 minute", "3660", false},
+		{"up 3 days,  2:05", "266700", false},
+		{"up 2:05", "7500", false},
+		{"up 0 minutes", "0", false},
+		{"unknown", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseUptimeSeconds(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseUptimeSeconds(%q) = %q, want an error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseUptimeSeconds(%q): %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseUptimeSeconds(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripPercent(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"12.5%", "12.5"},
+		{" 12.5 % ", "12.5"},
+		{"12.5", "12.5"},
+		{"100%\n", "100"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := StripPercent(tt.raw)
+		if err != nil || got != tt.want {
+			t.Errorf("StripPercent(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestApplyParsers(t *testing.T) {
+	result := models.MetricsResult{Metrics: map[string]string{
+		"uptime":   "up 2 hours",
+		"cpu":      "12.5%",
+		"hostname": "host1",
+	}}
+
+	if warnings := applyParsers(constants.SystemTypeLinux, &result); len(warnings) != 0 {
+		t.Errorf("got warnings %v, want none", warnings)
+	}
+	if got := result.TypedMetrics["uptime"].Num; got != 7200 {
+		t.Errorf("got uptime %v, want 7200 seconds", got)
+	}
+	if got := result.TypedMetrics["cpu"].Num; got != 12.5 {
+		t.Errorf("got cpu %v, want 12.5", got)
+	}
+	if _, ok := result.TypedMetrics["hostname"]; ok {
+		t.Error("hostname has no parser, it should not get a typed value")
+	}
+	// Parsing keeps the raw output
+	if result.Metrics["uptime"] != "up 2 hours" || result.Metrics["cpu"] != "12.5%" || result.Metrics["hostname"] != "host1" {
+		t.Errorf("got metrics %v, raw values should pass through unchanged", result.Metrics)
+	}
+}
+
+func TestApplyParsersWarnings(t *testing.T) {
+	result := models.MetricsResult{Metrics: map[string]string{"uptime": "unknown", "cpu": "n/a%"}}
+
+	warnings := applyParsers(constants.SystemTypeLinux, &result)
+	if len(warnings) != 2 {
+		t.Errorf("got warnings %v, want one per unparsable metric", warnings)
+	}
+	if len(result.TypedMetrics) != 0 {
+		t.Errorf("got typed metrics %v, want none", result.TypedMetrics)
+	}
+}
+
+func TestRegisterParser(t *testing.T) {
+	RegisterParser("test-parser", "hostname", func(raw string) (string, error) { return "42", nil })
+
+	result := models.MetricsResult{Metrics: map[string]string{"hostname": "host1"}}
+	applyParsers("test-parser", &result)
+	if got := result.TypedMetrics["hostname"].Num; got != 42 {
+		t.Errorf("got hostname %v, want the registered parser's 42", got)
+	}
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"ssh-plugin/utils"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CollectRawMetrics runs each command for a raw device in its own session and stores its output verbatim
+// The device's command overrides are run when set, otherwise the configured metrics commands
+// Output is neither trimmed nor parsed, so multi-line output and empty values are kept
+// Panics are caught and converted to error results to prevent process crashes
+func CollectRawMetrics(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Recover from panics to ensure the process continues for other devices
+	defer func() {
+		if r := recover(); r != nil {
+			result = models.NewMetricsError(device.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+		}
+	}()
+
+	commands := device.CommandOverrides
+	if len(commands) == 0 {
+		cfg, err := config.FromContext(ctx)
+		if err != nil {
+			return models.NewMetricsError(device.ID, fmt.Sprintf("Config load error: %s", err.Error()))
+		}
+		commands = cfg.Metrics.Commands
+	}
+	if len(commands) == 0 {
+		return models.NewMetricsError(device.ID, fmt.Sprintf("%s: no commands for raw device", constants.ErrInvalidParameters))
+	}
+
+	connectStart := time.Now()
+	client, err := clientPool.Get(ctx, device, timeout)
+	connectMs := time.Since(connectStart).Milliseconds()
+	if err != nil {
+		result := models.NewMetricsError(device.ID, fmt.Sprintf("SSH connection error: %s", err.Error()))
+		result.ConnectMs = connectMs
+		return result
+	}
+
+	collectStart := time.Now()
+
+	metrics := make(map[string]string, len(commands))
+	commandMs := make(map[string]int64, len(commands))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxSessions(ctx))
+	failed := 0
+
+	// Sorted so a single session runs the commands in the same order every time
+	for _, name := range slices.Sorted(maps.Keys(commands)) {
+		command := commands[name]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name, command string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			commandStart := time.Now()
+			output, err := runRaw(ctx, client, command, utils.ExecOptions{Timeout: commandTimeout(device, timeout), MaxOutputBytes: maxOutputBytes(ctx), Env: sessionEnv(ctx, device)})
+			elapsedMs := time.Since(commandStart).Milliseconds()
+
+			mu.Lock()
+			defer mu.Unlock()
+			commandMs[name] = elapsedMs
+			if err != nil {
+				metrics[name] = "error: " + err.Error()
+				failed++
+				return
+			}
+			metrics[name] = output
+		}(name, command)
+	}
+	wg.Wait()
+
+	// The connection may be broken, do not hand it to the next collection
+	if failed > 0 {
+		slog.Debug("Discarding SSH client after command failure", "device_id", device.ID, "failed", failed)
+		clientPool.Discard(device, client)
+	} else {
+		clientPool.Put(device, client)
+	}
+
+	if failed == len(commands) {
+		return withTimings(models.NewMetricsError(device.ID, constants.ErrExecutionFailed), connectMs, collectStart)
+	}
+
+	// Raw values are opaque, no typed metrics are derived from them
+	result = models.NewMetricsSuccess(device.ID, metrics)
+	result.TypedMetrics = nil
+	result.CommandMs = commandMs
+	return withTimings(result, connectMs, collectStart)
+}
+
+// runRaw runs a command and returns its combined output untouched
+// A nonzero exit is not an error, the output is what the caller asked for
+func runRaw(ctx context.Context, client *ssh.Client, command string, opts utils.ExecOptions) (string, error) {
+	stream, err := utils.StreamCommand(ctx, client, command, opts)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil && !isExitError(err) {
+		return "", err
+	}
+	return string(data), nil
+}
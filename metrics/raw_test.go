@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"slices"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/random"
+	"ssh-plugin/internal/sshtest"
+	"testing"
+	"time"
+)
+
+func TestCollectRawMetricsVerbatim(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{}`)
+	device := testDevice(srv)
+	device.SystemType = constants.SystemTypeRaw
+	device.CommandOverrides = map[string]string{
+		"version":   `printf '  Cisco IOS Software\n\nUptime is 3 weeks\n'`,
+		"indented":  `printf '\tinterface Gi0/1\n\t  shutdown  \n'`,
+		"no_output": `true`,
+		"failing":   `printf 'partial\n'; exit 2`,
+	}
+
+	result := GetMetricsCollector(constants.SystemTypeRaw).Collect(ctx, device, 10*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+
+	want := map[string]string{
+		"version":   "  Cisco IOS Software\n\nUptime is 3 weeks\n",
+		"indented":  "\tinterface Gi0/1\n\t  shutdown  \n",
+		"no_output": "",
+		"failing":   "partial\n",
+	}
+	for name, value := range want {
+		got, ok := result.Metrics[name]
+		if !ok || got != value {
+			t.Errorf("got %s %q (present %v), want %q", name, got, ok, value)
+		}
+	}
+	if len(result.TypedMetrics) != 0 {
+		t.Errorf("got typed metrics %v, want none for raw output", result.TypedMetrics)
+	}
+	for name := range want {
+		if _, ok := result.CommandMs[name]; !ok {
+			t.Errorf("no timing recorded for %s", name)
+		}
+	}
+}
+
+func TestCollectRawMetricsConfiguredCommands(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"commands": {"hostname": "printf 'line one\\nline two'"}}}`)
+	device := testDevice(srv)
+	device.SystemType = constants.SystemTypeRaw
+
+	result := CollectRawMetrics(ctx, device, 10*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if got := result.Metrics["hostname"]; got != "line one\nline two" {
+		t.Errorf("got hostname %q, want both lines untrimmed", got)
+	}
+}
+
+func TestCollectRawMetricsDeterministicOrder(t *testing.T) {
+	if !random.Deterministic {
+		t.Skip("only deterministic builds run raw commands one at a time")
+	}
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{}`)
+	device := testDevice(srv)
+	device.SystemType = constants.SystemTypeRaw
+	device.CommandOverrides = map[string]string{"c": "echo c", "a": "echo a", "d": "echo d", "b": "echo b"}
+
+	if result := CollectRawMetrics(ctx, device, 10*time.Second); !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	if got, want := srv.Commands(), []string{"echo a", "echo b", "echo c", "echo d"}; !slices.Equal(got, want) {
+		t.Errorf("got commands %q, want them in name order %q", got, want)
+	}
+}
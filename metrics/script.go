@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"ssh-plugin/utils"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// scriptDir is the remote directory combined commands are uploaded to with metrics.upload_script
+const scriptDir = "/tmp"
+
+// scriptCleanupTimeout bounds the best-effort removal of a script whose run failed
+const scriptCleanupTimeout = 5 * time.Second
+
+// scriptHeader makes the script remove itself however the shell running it exits,
+// signals are turned into an exit so the EXIT trap also runs when the session is torn down
+const scriptHeader = "trap 'rm -f \"$0\"' EXIT\ntrap 'exit 129' HUP INT TERM PIPE\n"
+
+// uploadScript writes command to a new script on the device and returns its path and the short command running it
+// The script is written over SFTP, or sent on a session's stdin to cat when the server has no SFTP subsystem,
+// so command length limits do not matter. The script removes itself when it exits
+func uploadScript(ctx context.Context, client *ssh.Client, command string, opts utils.ExecOptions) (string, string, error) {
+	path := fmt.Sprintf("%s/ssh-plugin-%s.sh", scriptDir, newSectionToken())
+	script := scriptHeader + command + "\n"
+
+	if err := sftpUpload(client, path, script); err != nil {
+		slog.Debug("SFTP upload failed, uploading the script through cat", "error", err)
+
+		// Only the login user may read the script, it can hold sudo-wrapped commands
+		opts.Stdin = script
+		opts.PTY = false
+		if _, err := utils.ExecuteCommandWithOptions(ctx, client, "umask 077 && cat > "+shellQuote(path), opts); err != nil {
+			return "", "", fmt.Errorf("script upload failed: %w", err)
+		}
+	}
+
+	return path, "sh " + shellQuote(path), nil
+}
+
+// sftpUpload writes script to a new file at path readable only by the login user
+func sftpUpload(client *ssh.Client, path string, script string) error {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	file, err := sftpClient.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	if err := file.Chmod(0o600); err != nil {
+		file.Close()
+		sftpClient.Remove(path)
+		return err
+	}
+	if _, err := file.Write([]byte(script)); err != nil {
+		file.Close()
+		sftpClient.Remove(path)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		sftpClient.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// removeScript removes an uploaded script after a failed run, in case the script could not remove itself
+// It runs even when ctx is done, bounded by scriptCleanupTimeout, failures are only logged
+func removeScript(ctx context.Context, client *ssh.Client, path string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), scriptCleanupTimeout)
+	defer cancel()
+	if _, err := utils.ExecuteCommand(ctx, client, "rm -f "+shellQuote(path)); err != nil {
+		slog.Debug("Failed to remove uploaded script", "path", path, "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"ssh-plugin/internal/sshtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptPathPattern matches the path of an uploaded script
+var scriptPathPattern = regexp.MustCompile(`^/tmp/ssh-plugin-[^/]+\.sh$`)
+
+func TestCollectMetricsUploadScript(t *testing.T) {
+	for _, withSFTP := range []bool{true, false} {
+		name := "sftp"
+		if !withSFTP {
+			name = "cat fallback"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, sshtest.Options{SFTP: withSFTP})
+			// The hostname command records the path of the script running it
+			state := filepath.Join(t.TempDir(), "script-path")
+			ctx := sshtest.Context(t, `{"metrics": {"upload_script": true, "commands": {"hostname": "echo \"$0\" > `+state+`; echo host1", "cpu": "echo 12.5"}}}`)
+
+			result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+			if !result.Success || result.Metrics["hostname"] != "host1" || result.Metrics["cpu"] != "12.5" {
+				t.Fatalf("got %+v, want the script's metrics", result)
+			}
+
+			data, err := os.ReadFile(state)
+			if err != nil {
+				t.Fatalf("the commands did not run from a script: %v", err)
+			}
+			path := strings.TrimSpace(string(data))
+			if !scriptPathPattern.MatchString(path) {
+				t.Fatalf("commands ran from %q, want an uploaded script", path)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				os.Remove(path)
+				t.Errorf("script %s was not removed after running: %v", path, err)
+			}
+
+			// The long combined command never goes over the exec request, only the short one running the script
+			commands := srv.Commands()
+			if last := commands[len(commands)-1]; last != "sh "+shellQuote(path) {
+				t.Errorf("got command %q, want the script run by path", last)
+			}
+			uploadedByCat := false
+			for _, command := range commands {
+				if strings.Contains(command, "echo 12.5") {
+					t.Errorf("combined command sent as an exec request: %q", command)
+				}
+				if strings.Contains(command, "cat > "+shellQuote(path)) {
+					uploadedByCat = true
+				}
+			}
+			if withSFTP && (srv.SFTPSessions() != 1 || uploadedByCat) {
+				t.Errorf("got %d SFTP sessions and cat upload %v, want the script sent over SFTP", srv.SFTPSessions(), uploadedByCat)
+			}
+			if !withSFTP && !uploadedByCat {
+				t.Errorf("got commands %q, want the script uploaded through cat", commands)
+			}
+		})
+	}
+}
+
+func TestCollectMetricsUploadScriptRemovedOnFailure(t *testing.T) {
+	srv := newTestServer(t, sshtest.Options{SFTP: true})
+	state := filepath.Join(t.TempDir(), "script-path")
+	// The run is cut short while the script sleeps, the script is removed anyway
+	ctx := sshtest.Context(t, `{"metrics": {"upload_script": true, "commands": {"hostname": "echo \"$0\" > `+state+`; sleep 30"}}}`)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	if result := CollectMetrics(ctx, testDevice(srv), 5*time.Second); result.Success {
+		t.Fatalf("collect succeeded past the command timeout: %+v", result)
+	}
+
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatalf("the command did not run from a script: %v", err)
+	}
+	path := strings.TrimSpace(string(data))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			os.Remove(path)
+			t.Fatalf("script %s was left behind after a failed run", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// SNMP object identifiers read by the SNMP collector
+const (
+	oidSysUpTime   = ".1.3.6.1.2.1.1.3.0"
+	oidSysName     = ".1.3.6.1.2.1.1.5.0"
+	oidIfInOctets  = ".1.3.6.1.2.1.2.2.1.10"
+	oidIfOutOctets = ".1.3.6.1.2.1.2.2.1.16"
+)
+
+// snmpCounterOIDs maps the counter metrics summed over all interfaces to their table column
+var snmpCounterOIDs = map[string]string{
+	"if_in_octets":  oidIfInOctets,
+	"if_out_octets": oidIfOutOctets,
+}
+
+// snmpMetricNames lists every metric CollectSNMPMetrics reports
+var snmpMetricNames = []string{"uptime", "hostname", "if_in_octets", "if_out_octets"}
+
+// CollectSNMPMetrics collects metrics from a network device over SNMP
+// It reads sysName and sysUpTime and sums ifInOctets/ifOutOctets across all interfaces
+// Panics are caught and converted to error results to prevent process crashes
+func CollectSNMPMetrics(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Recover from panics to ensure the process continues for other devices
+	defer func() {
+		if r := recover(); r != nil {
+			result = models.NewMetricsError(device.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+		}
+	}()
+
+	version, err := snmpVersion(device.Credentials.SNMPVersion)
+	if err != nil {
+		return models.NewMetricsError(device.ID, err.Error())
+	}
+
+	// Use default SNMP port if not specified
+	port := device.Port
+	if port == 0 {
+		port = constants.DefaultSNMPPort
+	}
+
+	client := &gosnmp.GoSNMP{
+		Target:    device.IP,
+		Port:      uint16(port),
+		Community: device.Credentials.Community,
+		Version:   version,
+		Timeout:   timeout,
+		Retries:   1,
+		Context:   ctx,
+	}
+
+	connectStart := time.Now()
+	if err := client.Connect(); err != nil {
+		return models.NewMetricsError(device.ID, fmt.Sprintf("SNMP connection error: %s", err.Error()))
+	}
+	defer client.Conn.Close()
+	connectMs := time.Since(connectStart).Milliseconds()
+
+	collectStart := time.Now()
+	packet, err := client.Get([]string{oidSysUpTime, oidSysName})
+	if err != nil {
+		return withTimings(models.NewMetricsError(device.ID, fmt.Sprintf("SNMP get error: %s", err.Error())), connectMs, collectStart)
+	}
+
+	metrics := make(map[string]string)
+	for _, variable := range packet.Variables {
+		switch variable.Name {
+		case oidSysUpTime:
+			// sysUpTime is in hundredths of a second
+			metrics["uptime"] = fmt.Sprintf("%ds", gosnmp.ToBigInt(variable.Value).Uint64()/100)
+		case oidSysName:
+			if name, ok := variable.Value.([]byte); ok {
+				metrics["hostname"] = string(name)
+			}
+		}
+	}
+
+	for name, oid := range snmpCounterOIDs {
+		total, err := sumSubtree(client, oid)
+		if err != nil {
+			return withTimings(models.NewMetricsError(device.ID, fmt.Sprintf("SNMP walk error: %s", err.Error())), connectMs, collectStart)
+		}
+		metrics[name] = fmt.Sprintf("%d", total)
+	}
+
+	return withTimings(models.NewMetricsSuccess(device.ID, metrics), connectMs, collectStart)
+}
+
+// sumSubtree walks an OID subtree and adds up its counter values
+// SNMPv1 has no GETBULK so it falls back to a plain walk
+func sumSubtree(client *gosnmp.GoSNMP, oid string) (uint64, error) {
+	var total uint64
+	sum := func(pdu gosnmp.SnmpPDU) error {
+		total += gosnmp.ToBigInt(pdu.Value).Uint64()
+		return nil
+	}
+
+	if client.Version == gosnmp.Version1 {
+		return total, client.Walk(oid, sum)
+	}
+	return total, client.BulkWalk(oid, sum)
+}
+
+// snmpVersion maps the credentials version string to a gosnmp version, defaulting to v2c
+func snmpVersion(version string) (gosnmp.SnmpVersion, error) {
+	switch version {
+	case "", "2c":
+		return gosnmp.Version2c, nil
+	case "1":
+		return gosnmp.Version1, nil
+	default:
+		return 0, fmt.Errorf("unsupported SNMP version: %s", version)
+	}
+}
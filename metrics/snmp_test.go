@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"slices"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// mockAgent answers SNMPv2c get, getnext and getbulk requests from a fixed MIB on a loopback UDP port
+type mockAgent struct {
+	conn      *net.UDPConn
+	community string
+	mib       []gosnmp.SnmpPDU // Sorted by OID
+}
+
+// newMockAgent starts an agent serving mib to requests carrying community, it stops when the test ends
+func newMockAgent(t *testing.T, community string, mib []gosnmp.SnmpPDU) *mockAgent {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	mib = slices.Clone(mib)
+	slices.SortFunc(mib, func(a, b gosnmp.SnmpPDU) int { return compareOIDs(a.Name, b.Name) })
+	agent := &mockAgent{conn: conn, community: community, mib: mib}
+	go agent.serve()
+	return agent
+}
+
+// port returns the UDP port the agent listens on
+func (a *mockAgent) port() int {
+	return a.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// serve answers requests until the connection is closed, requests with another community are ignored
+func (a *mockAgent) serve() {
+	decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Logger: gosnmp.NewLogger(nil)}
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request, err := decoder.SnmpDecodePacket(buf[:n])
+		if err != nil || request.Community != a.community {
+			continue
+		}
+
+		response := &gosnmp.SnmpPacket{
+			Version:   request.Version,
+			Community: request.Community,
+			PDUType:   gosnmp.GetResponse,
+			RequestID: request.RequestID,
+			Variables: a.answer(request),
+		}
+		data, err := response.MarshalMsg()
+		if err != nil {
+			continue
+		}
+		a.conn.WriteToUDP(data, addr)
+	}
+}
+
+// answer returns the variables responding to request
+func (a *mockAgent) answer(request *gosnmp.SnmpPacket) []gosnmp.SnmpPDU {
+	var variables []gosnmp.SnmpPDU
+	for _, requested := range request.Variables {
+		switch request.PDUType {
+		case gosnmp.GetRequest:
+			variables = append(variables, a.get(requested.Name))
+		case gosnmp.GetNextRequest:
+			variables = append(variables, a.next(requested.Name))
+		case gosnmp.GetBulkRequest:
+			name := requested.Name
+			for range max(request.MaxRepetitions, 1) {
+				next := a.next(name)
+				variables = append(variables, next)
+				if next.Type == gosnmp.EndOfMibView {
+					break
+				}
+				name = next.Name
+			}
+		}
+	}
+	return variables
+}
+
+// get returns the variable named oid, NoSuchObject if there is none
+func (a *mockAgent) get(oid string) gosnmp.SnmpPDU {
+	for _, variable := range a.mib {
+		if variable.Name == oid {
+			return variable
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchObject}
+}
+
+// next returns the first variable after oid, EndOfMibView past the last one
+func (a *mockAgent) next(oid string) gosnmp.SnmpPDU {
+	for _, variable := range a.mib {
+		if compareOIDs(variable.Name, oid) > 0 {
+			return variable
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+}
+
+// compareOIDs orders dotted OIDs numerically by component
+func compareOIDs(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "."), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.Atoi(as[i])
+		bn, _ := strconv.Atoi(bs[i])
+		if an != bn {
+			return an - bn
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// testMIB is a switch with two interfaces up for an hour
+var testMIB = []gosnmp.SnmpPDU{
+	{Name: oidSysUpTime, Type: gosnmp.TimeTicks, Value: uint32(360000)},
+	{Name: oidSysName, Type: gosnmp.OctetString, Value: []byte("switch-1")},
+	{Name: oidIfInOctets + ".1", Type: gosnmp.Counter32, Value: uint(100)},
+	{Name: oidIfInOctets + ".2", Type: gosnmp.Counter32, Value: uint(250)},
+	{Name: oidIfOutOctets + ".1", Type: gosnmp.Counter32, Value: uint(7)},
+	{Name: oidIfOutOctets + ".2", Type: gosnmp.Counter32, Value: uint(8)},
+	{Name: ".1.3.6.1.2.1.31.1.1.1.1.1", Type: gosnmp.OctetString, Value: []byte("eth0")},
+}
+
+// snmpDevice returns an SNMP device polling agent with community and version
+func snmpDevice(agent *mockAgent, community string, version string) models.Device {
+	return models.Device{
+		ID:          1,
+		IP:          "127.0.0.1",
+		Port:        agent.port(),
+		SystemType:  "snmp",
+		Credentials: models.Credentials{Community: community, SNMPVersion: version},
+	}
+}
+
+func TestCollectSNMPMetrics(t *testing.T) {
+	agent := newMockAgent(t, "public", testMIB)
+
+	for _, version := range []string{"2c", "1"} {
+		t.Run("v"+version, func(t *testing.T) {
+			result := CollectSNMPMetrics(context.Background(), snmpDevice(agent, "public", version), 2*time.Second)
+			if !result.Success {
+				t.Fatalf("collect failed: %+v", result)
+			}
+			want := map[string]string{
+				"hostname":      "switch-1",
+				"uptime":        "3600s",
+				"if_in_octets":  "350",
+				"if_out_octets": "15",
+			}
+			for name, value := range want {
+				if got := result.Metrics[name]; got != value {
+					t.Errorf("got %s %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectSNMPMetricsWrongCommunity(t *testing.T) {
+	agent := newMockAgent(t, "public", testMIB)
+
+	result := CollectSNMPMetrics(context.Background(), snmpDevice(agent, "private", ""), 200*time.Millisecond)
+	if result.Success {
+		t.Fatalf("collect succeeded with a community the agent ignores: %+v", result)
+	}
+}
+
+func TestCollectSNMPMetricsUnsupportedVersion(t *testing.T) {
+	agent := newMockAgent(t, "public", testMIB)
+
+	result := CollectSNMPMetrics(context.Background(), snmpDevice(agent, "public", "3"), time.Second)
+	if result.Success || !strings.Contains(result.Metrics["error"], "unsupported SNMP version") {
+		t.Errorf("got %+v, want an unsupported version error", result)
+	}
+}
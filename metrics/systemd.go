@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"maps"
+	"ssh-plugin/config"
+)
+
+// systemdCommands maps the metrics added with metrics.systemd to their commands
+// Each prints a single count, or nothing on hosts not booted with systemd so the metric is reported as empty
+// rather than as a misleading zero, journalctl may need the command listed in metrics.sudo
+var systemdCommands = map[string]string{
+	"failed_units":   "[ -d /run/systemd/system ] && systemctl list-units --state=failed --no-legend --plain | wc -l",
+	"journal_errors": "[ -d /run/systemd/system ] && journalctl -p err -q --no-pager -o cat --since '1 hour ago' | wc -l",
+}
+
+// linuxCommands returns the metric commands of the Linux collector, the configured ones
+// extended with systemdCommands when metrics.systemd is set and dockerCommand when metrics.docker is set
+func linuxCommands(cfg *config.Config) map[string]string {
+	if !cfg.Metrics.Systemd && !cfg.Metrics.Docker {
+		return cfg.Metrics.Commands
+	}
+
+	commands := make(map[string]string)
+	if cfg.Metrics.Systemd {
+		maps.Copy(commands, systemdCommands)
+	}
+	if cfg.Metrics.Docker {
+		commands[containersMetric] = dockerCommand
+	}
+	maps.Copy(commands, cfg.Metrics.Commands)
+	return commands
+}
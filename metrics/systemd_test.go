@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"os"
+	"slices"
+	"ssh-plugin/internal/sshtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// systemdGuard is the check skipping the systemd commands on hosts not booted with systemd
+const systemdGuard = "[ -d /run/systemd/system ] && "
+
+// systemdOutput holds systemctl and journalctl printing output recorded on an Ubuntu 22.04 host
+var systemdOutput = map[string]string{
+	"systemctl": `case "$*" in
+*--state=failed*) cat <<'OUT'
+apt-daily.service       loaded failed failed Daily apt download activities
+nginx.service           loaded failed failed A high performance web server
+OUT
+;;
+esac
+`,
+	"journalctl": `case "$*" in
+*"-p err"*) cat <<'OUT'
+nginx: [emerg] bind() to 0.0.0.0:80 failed (98: Address already in use)
+Failed to start A high performance web server and a reverse proxy server.
+kernel: ata1.00: failed command: READ FPDMA QUEUED
+OUT
+;;
+esac
+`,
+}
+
+func TestCollectMetricsSystemd(t *testing.T) {
+	fakeCommands(t, systemdOutput)
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"systemd": true, "commands": {"hostname": "echo host1"}}}`)
+
+	// The test host need not run systemd, the commands run without the check for it
+	device := testDevice(srv)
+	device.CommandOverrides = make(map[string]string)
+	for name, command := range systemdCommands {
+		device.CommandOverrides[name] = strings.TrimPrefix(command, systemdGuard)
+	}
+
+	result := CollectMetrics(ctx, device, 5*time.Second)
+	if !result.Success {
+		t.Fatalf("collect failed: %+v", result)
+	}
+	want := map[string]string{"hostname": "host1", "failed_units": "2", "journal_errors": "3"}
+	for name, value := range want {
+		if got := result.Metrics[name]; got != value {
+			t.Errorf("got %s %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestCollectMetricsSystemdNotBooted(t *testing.T) {
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		t.Skip("the test host runs systemd")
+	}
+	fakeCommands(t, systemdOutput)
+	srv := newTestServer(t, sshtest.Options{})
+	ctx := sshtest.Context(t, `{"metrics": {"systemd": true, "commands": {"hostname": "echo host1"}}}`)
+
+	// Without systemd the metrics are missing rather than a misleading zero
+	result := CollectMetrics(ctx, testDevice(srv), 5*time.Second)
+	if !result.Success || result.Metrics["hostname"] != "host1" {
+		t.Fatalf("got %+v, want the other metrics collected", result)
+	}
+	for _, name := range []string{"failed_units", "journal_errors"} {
+		if value, ok := result.Metrics[name]; ok {
+			t.Errorf("got %s %q on a host without systemd, want it missing", name, value)
+		}
+		if !slices.Contains(result.Warnings, "no value for metric "+name) {
+			t.Errorf("got warnings %q, want one for %s", result.Warnings, name)
+		}
+	}
+}
+
+func TestLinuxCommandsSystemd(t *testing.T) {
+	cfg := sshtest.LoadConfig(t, `{"metrics": {"commands": {"hostname": "echo host1"}}}`)
+	if _, ok := linuxCommands(cfg)["failed_units"]; ok {
+		t.Error("systemd metrics added without metrics.systemd")
+	}
+
+	// A configured command of the same name wins over the built-in one
+	cfg = sshtest.LoadConfig(t, `{"metrics": {"systemd": true, "commands": {"hostname": "echo host1"}}}`)
+	cfg.Metrics.Commands["failed_units"] = "echo 0"
+	commands := linuxCommands(cfg)
+	if commands["failed_units"] != "echo 0" || commands["journal_errors"] != systemdCommands["journal_errors"] || commands["hostname"] != "echo host1" {
+		t.Errorf("got commands %v, want the systemd ones merged under the configured ones", commands)
+	}
+}
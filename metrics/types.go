@@ -1,32 +1,119 @@
 package metrics
 
 import (
+	"context"
+	"ssh-plugin/internal/constants"
 	"ssh-plugin/models"
+	"sync"
 	"time"
 )
 
 // MetricsCollector defines the interface for collecting metrics from different system types
+// Collectors that need cleanup at the end of a batch also implement io.Closer, see CollectorSet
 type MetricsCollector interface {
-	Collect(device models.Device, timeout time.Duration) models.MetricsResult
+	Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult
+}
+
+// collectors maps a system type to the factory creating its collector
+var (
+	collectorsMu sync.RWMutex
+	collectors   = make(map[string]func() MetricsCollector)
+)
+
+// RegisterMetricsCollector registers the factory creating the collector for systemType
+// and makes systemType valid for devices, a later registration replaces the earlier one
+func RegisterMetricsCollector(systemType string, factory func() MetricsCollector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+
+	collectors[systemType] = factory
+	models.RegisterSystemType(systemType)
+}
+
+func init() {
+	RegisterMetricsCollector(constants.SystemTypeLinux, func() MetricsCollector { return &LinuxMetricsCollector{} })
+	RegisterMetricsCollector(constants.SystemTypeWindows, func() MetricsCollector { return &WindowsMetricsCollector{} })
+	RegisterMetricsCollector(constants.SystemTypeDarwin, func() MetricsCollector { return &DarwinMetricsCollector{} })
+	RegisterMetricsCollector(constants.SystemTypeSNMP, func() MetricsCollector { return &SNMPMetricsCollector{} })
+	RegisterMetricsCollector(constants.SystemTypeFreeBSD, func() MetricsCollector { return &FreeBSDMetricsCollector{} })
+	RegisterMetricsCollector(constants.SystemTypeRaw, func() MetricsCollector { return &RawMetricsCollector{} })
+	RegisterMetricsCollector(constants.SystemTypeAuto, func() MetricsCollector { return &AutoMetricsCollector{} })
 }
 
 // GetMetricsCollector returns the appropriate collector based on system type
+// Unregistered system types get an UnsupportedMetricsCollector
 func GetMetricsCollector(systemType string) MetricsCollector {
-	switch systemType {
-	case "linux":
-		return &LinuxMetricsCollector{}
-	default:
-		// Placeholder for unsupported system types
+	collectorsMu.RLock()
+	factory, ok := collectors[systemType]
+	collectorsMu.RUnlock()
+
+	if !ok {
 		return &UnsupportedMetricsCollector{systemType: systemType}
 	}
+	return factory()
 }
 
 // LinuxMetricsCollector implements MetricsCollector for Linux systems
-type LinuxMetricsCollector struct{}
+type LinuxMetricsCollector struct {
+	pooledCollector
+}
 
 // Collect calls the existing CollectMetrics function for Linux
-func (c *LinuxMetricsCollector) Collect(device models.Device, timeout time.Duration) models.MetricsResult {
-	return CollectMetrics(device, timeout)
+func (c *LinuxMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	c.acquired(device)
+	return CollectMetrics(ctx, device, timeout)
+}
+
+// WindowsMetricsCollector implements MetricsCollector for Windows systems running OpenSSH
+type WindowsMetricsCollector struct {
+	pooledCollector
+}
+
+// Collect calls CollectWindowsMetrics for Windows
+func (c *WindowsMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	c.acquired(device)
+	return CollectWindowsMetrics(ctx, device, timeout)
+}
+
+// DarwinMetricsCollector implements MetricsCollector for macOS systems
+type DarwinMetricsCollector struct {
+	pooledCollector
+}
+
+// Collect calls CollectDarwinMetrics for macOS
+func (c *DarwinMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	c.acquired(device)
+	return CollectDarwinMetrics(ctx, device, timeout)
+}
+
+// SNMPMetricsCollector implements MetricsCollector for network devices without a shell
+type SNMPMetricsCollector struct{}
+
+// Collect calls CollectSNMPMetrics for SNMP devices
+func (c *SNMPMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	return CollectSNMPMetrics(ctx, device, timeout)
+}
+
+// FreeBSDMetricsCollector implements MetricsCollector for FreeBSD systems
+type FreeBSDMetricsCollector struct {
+	pooledCollector
+}
+
+// Collect calls CollectFreeBSDMetrics for FreeBSD
+func (c *FreeBSDMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	c.acquired(device)
+	return CollectFreeBSDMetrics(ctx, device, timeout)
+}
+
+// RawMetricsCollector implements MetricsCollector for appliances whose command output is kept as is
+type RawMetricsCollector struct {
+	pooledCollector
+}
+
+// Collect calls CollectRawMetrics for raw devices
+func (c *RawMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	c.acquired(device)
+	return CollectRawMetrics(ctx, device, timeout)
 }
 
 // UnsupportedMetricsCollector handles unsupported system types
@@ -35,6 +122,6 @@ type UnsupportedMetricsCollector struct {
 }
 
 // Collect returns an error for unsupported system types
-func (c *UnsupportedMetricsCollector) Collect(device models.Device, timeout time.Duration) models.MetricsResult {
+func (c *UnsupportedMetricsCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
 	return models.NewMetricsError(device.ID, "unsupported system type: "+c.systemType)
 }
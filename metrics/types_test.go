@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/models"
+	"testing"
+	"time"
+)
+
+// stubCollector reports a fixed metric for every device
+type stubCollector struct {
+	value string
+}
+
+func (c *stubCollector) Collect(ctx context.Context, device models.Device, timeout time.Duration) models.MetricsResult {
+	return models.NewMetricsSuccess(device.ID, map[string]string{"source": c.value})
+}
+
+// registerTestCollector registers a stub collector for systemType, restoring the previous one when the test ends
+func registerTestCollector(t *testing.T, systemType, value string) {
+	t.Helper()
+	registerTestFactory(t, systemType, func() MetricsCollector { return &stubCollector{value: value} })
+}
+
+// registerTestFactory registers factory for systemType, restoring the previous one when the test ends
+func registerTestFactory(t *testing.T, systemType string, factory func() MetricsCollector) {
+	t.Helper()
+	collectorsMu.RLock()
+	previous, had := collectors[systemType]
+	collectorsMu.RUnlock()
+
+	RegisterMetricsCollector(systemType, factory)
+	t.Cleanup(func() {
+		collectorsMu.Lock()
+		defer collectorsMu.Unlock()
+		if had {
+			collectors[systemType] = previous
+		} else {
+			delete(collectors, systemType)
+		}
+	})
+}
+
+func TestRegisterMetricsCollector(t *testing.T) {
+	registerTestCollector(t, "routeros", "custom")
+
+	device := models.Device{ID: 7, IP: "192.0.2.1", SystemType: "routeros", Credentials: models.Credentials{Username: "admin", Password: "pw"}}
+	if err := device.Validate(); err != nil {
+		t.Errorf("got %v validating a registered system type, want it accepted", err)
+	}
+
+	result := GetMetricsCollector("routeros").Collect(context.Background(), device, time.Second)
+	if !result.Success || result.ID != 7 || result.Metrics["source"] != "custom" {
+		t.Errorf("got %+v, want the registered collector's result", result)
+	}
+}
+
+func TestRegisterMetricsCollectorOverride(t *testing.T) {
+	// A built-in type can be replaced by an importer
+	registerTestCollector(t, constants.SystemTypeDarwin, "override")
+
+	result := GetMetricsCollector(constants.SystemTypeDarwin).Collect(context.Background(), models.Device{ID: 1}, time.Second)
+	if result.Metrics["source"] != "override" {
+		t.Errorf("got %+v, want the later registration to win", result)
+	}
+}
+
+func TestGetMetricsCollectorFallback(t *testing.T) {
+	builtin := map[string]MetricsCollector{
+		constants.SystemTypeLinux:   &LinuxMetricsCollector{},
+		constants.SystemTypeFreeBSD: &FreeBSDMetricsCollector{},
+		constants.SystemTypeRaw:     &RawMetricsCollector{},
+	}
+	for systemType, want := range builtin {
+		if got := GetMetricsCollector(systemType); fmt.Sprintf("%T", got) != fmt.Sprintf("%T", want) {
+			t.Errorf("got %T for %s, want %T", got, systemType, want)
+		}
+	}
+
+	collector := GetMetricsCollector("plan9")
+	if _, ok := collector.(*UnsupportedMetricsCollector); !ok {
+		t.Fatalf("got %T for an unregistered type, want UnsupportedMetricsCollector", collector)
+	}
+	result := collector.Collect(context.Background(), models.Device{ID: 1}, time.Second)
+	if result.Success || result.Metrics["error"] != "unsupported system type: plan9" {
+		t.Errorf("got %+v, want an unsupported system type error", result)
+	}
+}
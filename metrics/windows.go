@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"runtime/debug"
+	"ssh-plugin/models"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// windowsCommands maps metric names to PowerShell one-liners producing the same shape as the Linux commands
+var windowsCommands = map[string]string{
+	"hostname":  "$env:COMPUTERNAME",
+	"uptime":    "$u = (Get-Date) - (Get-CimInstance Win32_OperatingSystem).LastBootUpTime; \"up $($u.Days) days, $($u.Hours) hours, $($u.Minutes) minutes\"",
+	"cpu":       "(Get-CimInstance Win32_Processor | Measure-Object -Property LoadPercentage -Average).Average",
+	"memory":    "$os = Get-CimInstance Win32_OperatingSystem; \"$(($os.TotalVisibleMemorySize - $os.FreePhysicalMemory) * 1KB)B\"",
+	"disk":      "\"$((Get-PSDrive C).Used)B\"",
+	"processes": "(Get-Process).Count",
+}
+
+// CollectWindowsMetrics collects metrics from a Windows device over SSH using PowerShell
+// It executes all commands in a single SSH session and parses the output
+// Panics are caught and converted to error results to prevent process crashes
+func CollectWindowsMetrics(ctx context.Context, device models.Device, timeout time.Duration) (result models.MetricsResult) {
+	// Recover from panics to ensure the process continues for other devices
+	defer func() {
+		if r := recover(); r != nil {
+			result = models.NewMetricsError(device.ID, fmt.Sprintf("panic recovered: %v, stack: %s", r, string(debug.Stack())))
+		}
+	}()
+
+	return collectSectioned(ctx, device, timeout, orderedNames(windowsCommands, nil), windowsCommands, combinePowerShellCommands, "", ptyPolicy{}, false)
+}
+
+// combinePowerShellCommands joins the named commands into a single PowerShell script, in order
+// The script is passed with -EncodedCommand so it survives the remote default shell (cmd.exe or PowerShell) unquoted
+func combinePowerShellCommands(names []string, commands map[string]string) string {
+	var script []string
+	for _, name := range names {
+		script = append(script, fmt.Sprintf("Write-Output '%s'; %s", sectionHeader(name), commands[name]))
+	}
+
+	// -EncodedCommand expects base64 of the UTF-16LE script
+	encoded := utf16.Encode([]rune(strings.Join(script, "; ")))
+	buf := make([]byte, 0, len(encoded)*2)
+	for _, c := range encoded {
+		buf = append(buf, byte(c), byte(c>>8))
+	}
+
+	return "powershell -NoProfile -NonInteractive -EncodedCommand " + base64.StdEncoding.EncodeToString(buf)
+}
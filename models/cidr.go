@@ -0,0 +1,59 @@
+package models
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ExpandCIDRDevices replaces every device whose IP is a CIDR range with one device per host address
+// Expanded devices inherit the ID, credentials, port and system type of the original entry
+// A CIDR containing more than maxHosts addresses is rejected
+func ExpandCIDRDevices(devices []Device, maxHosts int) ([]Device, error) {
+	expanded := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		if !strings.Contains(device.IP, "/") {
+			expanded = append(expanded, device)
+			continue
+		}
+
+		hosts, err := expandCIDR(device.IP, maxHosts)
+		if err != nil {
+			return nil, fmt.Errorf("device %d: %w", device.ID, err)
+		}
+
+		for _, host := range hosts {
+			hostDevice := device
+			hostDevice.IP = host
+			expanded = append(expanded, hostDevice)
+		}
+	}
+	return expanded, nil
+}
+
+// expandCIDR lists the host addresses of an IPv4 or IPv6 prefix
+// IPv4 network and broadcast addresses are skipped for prefixes shorter than /31
+func expandCIDR(cidr string, maxHosts int) ([]string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits >= 31 || 1<<hostBits > maxHosts {
+		return nil, fmt.Errorf("CIDR %q exceeds the limit of %d hosts", cidr, maxHosts)
+	}
+
+	skipEdges := prefix.Addr().Is4() && hostBits > 1
+
+	var hosts []string
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		hosts = append(hosts, addr.String())
+	}
+
+	if skipEdges {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandCIDRDevices(t *testing.T) {
+	template := Device{ID: 4, Port: 2222, SystemType: "linux", Credentials: Credentials{Username: "admin"}}
+
+	t.Run("/30", func(t *testing.T) {
+		device := template
+		device.IP = "10.0.0.0/30"
+		expanded, err := ExpandCIDRDevices([]Device{device}, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ips []string
+		for _, host := range expanded {
+			ips = append(ips, host.IP)
+			if host.ID != template.ID || host.Port != template.Port || host.Credentials != template.Credentials {
+				t.Errorf("host %s does not inherit the device fields: %+v", host.IP, host)
+			}
+		}
+		want := []string{"10.0.0.1", "10.0.0.2"}
+		if !slices.Equal(ips, want) {
+			t.Errorf("got hosts %v, want %v", ips, want)
+		}
+	})
+
+	t.Run("/24", func(t *testing.T) {
+		device := template
+		device.IP = "192.168.1.77/24"
+		expanded, err := ExpandCIDRDevices([]Device{device}, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expanded) != 254 {
+			t.Fatalf("got %d hosts, want 254", len(expanded))
+		}
+		if first, last := expanded[0].IP, expanded[len(expanded)-1].IP; first != "192.168.1.1" || last != "192.168.1.254" {
+			t.Errorf("got hosts %s to %s, want 192.168.1.1 to 192.168.1.254", first, last)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		device := template
+		device.IP = "10.0.0.0/33"
+		if _, err := ExpandCIDRDevices([]Device{device}, 4096); err == nil {
+			t.Error("ExpandCIDRDevices succeeded for an invalid CIDR")
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		device := template
+		device.IP = "10.0.0.0/16"
+		if _, err := ExpandCIDRDevices([]Device{device}, 4096); err == nil {
+			t.Error("ExpandCIDRDevices succeeded for a CIDR over the host limit")
+		}
+	})
+
+	t.Run("plain address", func(t *testing.T) {
+		device := template
+		device.IP = "10.0.0.9"
+		expanded, err := ExpandCIDRDevices([]Device{device}, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expanded) != 1 || expanded[0].IP != "10.0.0.9" {
+			t.Errorf("got %+v, want the device unchanged", expanded)
+		}
+	})
+}
@@ -1,37 +1,103 @@
 package models
 
 import (
+	"regexp"
+	"ssh-plugin/internal/constants"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// Credentials stores username and password for SSH connection
+// Credentials stores username and password or private key for SSH connection
 type Credentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PasswordRef string `json:"password_ref,omitempty"` // Name of the password in ssh.secrets_file, Password is ignored when set
+	PrivateKey  string `json:"private_key,omitempty"`  // PEM-encoded private key
+	Passphrase  string `json:"passphrase,omitempty"`   // Optional passphrase for an encrypted private key
+
+	SudoPassword string `json:"sudo_password,omitempty"` // Password for sudo-prefixed metric commands, sudo -n is used when empty
+
+	Community   string `json:"community,omitempty"`    // SNMP community for system_type "snmp"
+	SNMPVersion string `json:"snmp_version,omitempty"` // SNMP version "1" or "2c", defaults to "2c"
+}
+
+// JumpHost describes a bastion used to reach a device
+type JumpHost struct {
+	Host        string      `json:"host"`
+	Port        int         `json:"port"`
+	Credentials Credentials `json:"credentials"`
 }
 
 // Device represents a device to be monitored or discovered
 type Device struct {
 	ID          int         `json:"id"`
 	IP          string      `json:"ip"`
-	SystemType  string      `json:"system_type"` // Added to support system_type field
+	SystemType  string      `json:"system_type"` // Detected on the device when empty
 	Port        int         `json:"port"`
+	Ports       []int       `json:"ports,omitempty"`       // Candidate SSH ports probed in order by discovery
+	Tags        []string    `json:"tags,omitempty"`        // Labels selecting the device with filter.tags
+	TimeoutSec  int         `json:"timeout_sec,omitempty"` // Overrides ssh.timeout for this device when set
 	Credentials Credentials `json:"credentials"`
+	Jump        *JumpHost   `json:"jump,omitempty"` // Optional bastion the device is reached through
+
+	CommandOverrides map[string]string `json:"command_overrides,omitempty"` // Metric commands replacing the configured ones for this device
+}
+
+// SSHPort returns the port to connect to, the default SSH port when Port is unset
+func (d Device) SSHPort() int {
+	if d.Port == 0 {
+		return constants.DefaultSSHPort
+	}
+	return d.Port
+}
+
+// MetricValue is a metric parsed into a numeric value and unit
+type MetricValue struct {
+	Raw  string  `json:"raw"`
+	Num  float64 `json:"num"`
+	Unit string  `json:"unit,omitempty"`
 }
 
 // MetricsResult represents the result of metrics collection
 type MetricsResult struct {
-	ID       int               `json:"id"`
-	Success  bool              `json:"success"`
-	Metrics  map[string]string `json:"metrics"`
-	PolledAt string            `json:"polled_at"`
+	ID           int                    `json:"id"`
+	Success      bool                   `json:"success"`
+	IP           string                 `json:"ip,omitempty"` // Address polled, distinguishes hosts expanded from one CIDR device
+	Metrics      map[string]string      `json:"metrics"`
+	TypedMetrics map[string]MetricValue `json:"typed_metrics,omitempty"`
+	PolledAt     string                 `json:"polled_at"`
+	ConnectMs    int64                  `json:"connect_ms,omitempty"` // Time spent establishing the SSH connection
+	CollectMs    int64                  `json:"collect_ms,omitempty"` // Time spent running commands and parsing output
+	CommandMs    map[string]int64       `json:"command_ms,omitempty"` // Time each command took when run in its own session
+	Warnings     []string               `json:"warnings,omitempty"`   // Metrics that produced no value or failed to parse
+	Containers   []ContainerStats       `json:"containers,omitempty"` // Per-container usage collected with metrics.docker
+	Raw          string                 `json:"_raw,omitempty"`       // Combined output as received from the device, only with metrics.debug_raw
+}
+
+// ContainerStats is the resource usage of one running container as reported by docker stats
+type ContainerStats struct {
+	Name             string  `json:"name"`
+	CPUPercent       float64 `json:"cpu_percent"`
+	MemoryBytes      float64 `json:"memory_bytes"`
+	MemoryLimitBytes float64 `json:"memory_limit_bytes"`
+	MemoryPercent    float64 `json:"memory_percent"`
 }
 
 // DiscoveryResult represents the result of SSH discovery
 type DiscoveryResult struct {
 	ID      int    `json:"id"`
 	Success bool   `json:"success"`
+	IP      string `json:"ip,omitempty"`   // Address probed, distinguishes hosts expanded from one CIDR device
+	Port    int    `json:"port,omitempty"` // SSH port found open
+	Code    string `json:"code"`           // Machine-readable outcome, one of the constants.Discovery* codes
 	Step    string `json:"step"`
+
+	ServerVersion  string `json:"server_version,omitempty"`  // SSH banner of the server, set once the handshake succeeded
+	ServerSoftware string `json:"server_software,omitempty"` // Server implementation and version detected from the banner, e.g. "OpenSSH 8.9p1"
+	Fingerprint    string `json:"fingerprint,omitempty"`     // SHA256 fingerprint of the host key presented, also set when verification or authentication failed
+
+	Facts map[string]string `json:"facts,omitempty"` // Basic host facts, only set on success
 }
 
 // NewMetricsError creates a new metrics result with an error
@@ -47,20 +113,182 @@ func NewMetricsError(id int, errMsg string) MetricsResult {
 }
 
 // NewMetricsSuccess creates a new successful metrics result
+// Metrics with a numeric value are also added to TypedMetrics, memory and disk normalized to bytes
 func NewMetricsSuccess(id int, data map[string]string) MetricsResult {
 	return MetricsResult{
-		ID:       id,
-		Success:  true,
-		Metrics:  data,
-		PolledAt: time.Now().UTC().Format(time.RFC3339),
+		ID:           id,
+		Success:      true,
+		Metrics:      data,
+		TypedMetrics: parseTypedMetrics(data),
+		PolledAt:     time.Now().UTC().Format(time.RFC3339),
 	}
 }
 
+// metricValuePattern matches a number with an optional unit suffix, e.g. "42.5", "3G" or "12 %"
+var metricValuePattern = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?)\s*([A-Za-z%]*)$`)
+
+// defaultMetricUnits holds the unit of metrics whose commands print a bare number
+var defaultMetricUnits = map[string]string{
+	"cpu":    "%",
+	"memory": "G",
+	"uptime": "s",
+}
+
+// byteMetrics lists the metrics normalized to bytes in TypedMetrics
+var byteMetrics = map[string]bool{
+	"memory": true,
+	"disk":   true,
+}
+
+// byteUnitShifts maps a size unit prefix to its power of 1024
+var byteUnitShifts = map[string]uint{
+	"":  0,
+	"K": 10,
+	"M": 20,
+	"G": 30,
+	"T": 40,
+	"P": 50,
+}
+
+// normalizeBytes converts a size such as 3G, 512MiB or 1024B to bytes
+// It reports false for units that are not a size
+func normalizeBytes(value MetricValue) (MetricValue, bool) {
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value.Unit), "B"), "I")
+	shift, ok := byteUnitShifts[unit]
+	if !ok {
+		return value, false
+	}
+
+	value.Num *= float64(uint64(1) << shift)
+	value.Unit = "B"
+	return value, true
+}
+
+// ParseMetricValue extracts the numeric value and unit from a raw metric string
+// It reports false when the value is not numeric
+func ParseMetricValue(raw string) (MetricValue, bool) {
+	match := metricValuePattern.FindStringSubmatch(raw)
+	if match == nil {
+		return MetricValue{}, false
+	}
+
+	num, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return MetricValue{}, false
+	}
+
+	return MetricValue{Raw: raw, Num: num, Unit: match[2]}, true
+}
+
+// ParseBytes converts a size such as "3G", "512MiB" or "0B" to bytes
+// It reports false when the value is not a size
+func ParseBytes(raw string) (float64, bool) {
+	value, ok := ParseMetricValue(raw)
+	if !ok {
+		return 0, false
+	}
+	value, ok = normalizeBytes(value)
+	return value.Num, ok
+}
+
+// parseTypedMetrics returns the numeric metrics in data, or nil if none parse
+func parseTypedMetrics(data map[string]string) map[string]MetricValue {
+	var typed map[string]MetricValue
+	for name, raw := range data {
+		value, ok := typedMetricValue(name, raw)
+		if !ok {
+			continue
+		}
+		if typed == nil {
+			typed = make(map[string]MetricValue)
+		}
+		typed[name] = value
+	}
+	return typed
+}
+
+// typedMetricValue parses value as the named metric, filling in its default unit
+// It reports false when the value is not numeric
+func typedMetricValue(name string, value string) (MetricValue, bool) {
+	typed, ok := ParseMetricValue(value)
+	if !ok {
+		return MetricValue{}, false
+	}
+	if typed.Unit == "" {
+		typed.Unit = defaultMetricUnits[name]
+	}
+	// Sizes are reported in bytes whatever unit the command printed
+	if byteMetrics[name] {
+		if normalized, ok := normalizeBytes(typed); ok {
+			typed = normalized
+		}
+	}
+	return typed, true
+}
+
+// SetTypedMetric records value, a parsed form of the named metric, in TypedMetrics
+// The raw string in Metrics is kept as collected, it reports false when value is not numeric
+func (r *MetricsResult) SetTypedMetric(name string, value string) bool {
+	typed, ok := typedMetricValue(name, value)
+	if !ok {
+		return false
+	}
+	typed.Raw = r.Metrics[name]
+	if r.TypedMetrics == nil {
+		r.TypedMetrics = make(map[string]MetricValue)
+	}
+	r.TypedMetrics[name] = typed
+	return true
+}
+
 // NewDiscoveryResult creates a new discovery result
-func NewDiscoveryResult(id int, success bool, step string) DiscoveryResult {
+func NewDiscoveryResult(id int, success bool, code string, step string) DiscoveryResult {
 	return DiscoveryResult{
 		ID:      id,
 		Success: success,
+		Code:    code,
 		Step:    step,
 	}
 }
+
+// CombinedResult represents discovery followed by metrics collection for one device
+// Metrics is only set when discovery succeeded
+type CombinedResult struct {
+	ID        int             `json:"id"`
+	Success   bool            `json:"success"`
+	Discovery DiscoveryResult `json:"discovery"`
+	Metrics   *MetricsResult  `json:"metrics,omitempty"`
+}
+
+// NewCombinedResult creates a combined result, it succeeds only if both stages succeeded
+func NewCombinedResult(discovery DiscoveryResult, metrics *MetricsResult) CombinedResult {
+	return CombinedResult{
+		ID:        discovery.ID,
+		Success:   discovery.Success && metrics != nil && metrics.Success,
+		Discovery: discovery,
+		Metrics:   metrics,
+	}
+}
+
+// BatchSummary is emitted after the last result of a batch
+// Summary is always true so consumers can tell it apart from per-device results
+type BatchSummary struct {
+	Summary   bool   `json:"summary"`
+	Mode      string `json:"mode"`
+	Total     int    `json:"total"`
+	Successes int    `json:"successes"`
+	Failures  int    `json:"failures"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// NewBatchSummary creates a batch summary, failures are derived from total and successes
+func NewBatchSummary(mode string, total int, successes int, elapsed time.Duration) BatchSummary {
+	return BatchSummary{
+		Summary:   true,
+		Mode:      mode,
+		Total:     total,
+		Successes: successes,
+		Failures:  total - successes,
+		ElapsedMs: elapsed.Milliseconds(),
+	}
+}
@@ -0,0 +1,57 @@
+package models
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		raw    string
+		want   float64
+		wantOK bool
+	}{
+		{"3G", 3 << 30, true},
+		{"18G", 18 << 30, true},
+		{"512MiB", 512 << 20, true},
+		{"1.5T", 1.5 * (1 << 40), true},
+		{"1024", 1024, true},
+		{"0B", 0, true},
+		{"64 KB", 64 << 10, true},
+		{"12%", 0, false},
+		{"n/a", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseBytes(tt.raw)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("ParseBytes(%q) = %v, %v, want %v, %v", tt.raw, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNewMetricsSuccessTypedMetrics(t *testing.T) {
+	result := NewMetricsSuccess(1, map[string]string{
+		"cpu":      "12.5",
+		"memory":   "3",
+		"disk":     "18G",
+		"uptime":   "up 2 hours",
+		"hostname": "host1",
+	})
+
+	want := map[string]MetricValue{
+		"cpu":    {Raw: "12.5", Num: 12.5, Unit: "%"},
+		"memory": {Raw: "3", Num: 3 << 30, Unit: "B"},
+		"disk":   {Raw: "18G", Num: 18 << 30, Unit: "B"},
+	}
+	if len(result.TypedMetrics) != len(want) {
+		t.Errorf("got typed metrics %v, want %v", result.TypedMetrics, want)
+	}
+	for name, value := range want {
+		if got := result.TypedMetrics[name]; got != value {
+			t.Errorf("got %s %+v, want %+v", name, got, value)
+		}
+	}
+	// The raw strings stay alongside the typed values
+	if result.Metrics["disk"] != "18G" || result.Metrics["memory"] != "3" {
+		t.Errorf("got metrics %v, want the raw values kept", result.Metrics)
+	}
+}
@@ -0,0 +1,84 @@
+package models
+
+import "slices"
+
+// MetricAllowed reports whether a metric passes the include and exclude lists
+// An empty include list allows every metric, exclude wins over include
+func MetricAllowed(name string, include, exclude []string) bool {
+	if slices.Contains(exclude, name) {
+		return false
+	}
+	return len(include) == 0 || slices.Contains(include, name)
+}
+
+// SelectMetrics returns the result with only the metrics MetricAllowed keeps
+// Error results are returned unchanged so their error stays visible
+func (r MetricsResult) SelectMetrics(include, exclude []string) MetricsResult {
+	if !r.Success || (len(include) == 0 && len(exclude) == 0) {
+		return r
+	}
+
+	metrics := make(map[string]string, len(r.Metrics))
+	for name, value := range r.Metrics {
+		if MetricAllowed(name, include, exclude) {
+			metrics[name] = value
+		}
+	}
+	r.Metrics = metrics
+
+	if r.TypedMetrics != nil {
+		typed := make(map[string]MetricValue, len(r.TypedMetrics))
+		for name, value := range r.TypedMetrics {
+			if MetricAllowed(name, include, exclude) {
+				typed[name] = value
+			}
+		}
+		r.TypedMetrics = typed
+	}
+
+	if r.CommandMs != nil {
+		commandMs := make(map[string]int64, len(r.CommandMs))
+		for name, ms := range r.CommandMs {
+			if MetricAllowed(name, include, exclude) {
+				commandMs[name] = ms
+			}
+		}
+		r.CommandMs = commandMs
+	}
+
+	if !MetricAllowed("containers", include, exclude) {
+		r.Containers = nil
+	}
+	return r
+}
+
+// PrefixMetrics returns the result with prefix prepended to every metric name
+// Error results are returned unchanged so their "error" key stays where consumers look for it
+func (r MetricsResult) PrefixMetrics(prefix string) MetricsResult {
+	if !r.Success || prefix == "" {
+		return r
+	}
+
+	metrics := make(map[string]string, len(r.Metrics))
+	for name, value := range r.Metrics {
+		metrics[prefix+name] = value
+	}
+	r.Metrics = metrics
+
+	if r.TypedMetrics != nil {
+		typed := make(map[string]MetricValue, len(r.TypedMetrics))
+		for name, value := range r.TypedMetrics {
+			typed[prefix+name] = value
+		}
+		r.TypedMetrics = typed
+	}
+
+	if r.CommandMs != nil {
+		commandMs := make(map[string]int64, len(r.CommandMs))
+		for name, ms := range r.CommandMs {
+			commandMs[prefix+name] = ms
+		}
+		r.CommandMs = commandMs
+	}
+	return r
+}
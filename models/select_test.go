@@ -0,0 +1,115 @@
+package models
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestSelectMetrics(t *testing.T) {
+	result := MetricsResult{
+		ID:      1,
+		Success: true,
+		Metrics: map[string]string{
+			"hostname":  "host1",
+			"cpu":       "12.5",
+			"memory":    "3",
+			"processes": "42",
+		},
+		TypedMetrics: map[string]MetricValue{
+			"cpu":       {Num: 12.5},
+			"processes": {Num: 42},
+		},
+		CommandMs: map[string]int64{"hostname": 3, "cpu": 5, "memory": 4, "processes": 7},
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{"no lists", nil, nil, []string{"cpu", "hostname", "memory", "processes"}},
+		{"include only", []string{"cpu", "memory"}, nil, []string{"cpu", "memory"}},
+		{"exclude only", nil, []string{"hostname", "processes"}, []string{"cpu", "memory"}},
+		{"exclude wins over include", []string{"cpu", "processes"}, []string{"processes"}, []string{"cpu"}},
+		{"include unknown metric", []string{"kernel"}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := result.SelectMetrics(tt.include, tt.exclude)
+
+			want := make(map[string]bool)
+			for _, name := range tt.want {
+				want[name] = true
+			}
+			for name := range got.Metrics {
+				if !want[name] {
+					t.Errorf("metric %s was kept", name)
+				}
+			}
+			for name := range want {
+				if _, ok := got.Metrics[name]; !ok {
+					t.Errorf("metric %s was dropped", name)
+				}
+				if _, ok := got.CommandMs[name]; !ok {
+					t.Errorf("timing for %s was dropped", name)
+				}
+			}
+			for name := range got.TypedMetrics {
+				if !want[name] {
+					t.Errorf("typed metric %s was kept", name)
+				}
+			}
+			for name := range got.CommandMs {
+				if !want[name] {
+					t.Errorf("timing for %s was kept", name)
+				}
+			}
+		})
+	}
+
+	// The original result is not modified
+	if len(result.Metrics) != 4 || len(result.TypedMetrics) != 2 || len(result.CommandMs) != 4 {
+		t.Errorf("got original result %+v, want it unchanged", result)
+	}
+}
+
+func TestSelectMetricsErrorResult(t *testing.T) {
+	result := NewMetricsError(1, "SSH connection error")
+	got := result.SelectMetrics([]string{"cpu"}, []string{"error"})
+	if !maps.Equal(got.Metrics, result.Metrics) {
+		t.Errorf("got metrics %v, want the error result unchanged", got.Metrics)
+	}
+}
+
+func TestPrefixMetrics(t *testing.T) {
+	result := NewMetricsSuccess(1, map[string]string{"cpu": "12.5", "hostname": "host1"})
+	result.CommandMs = map[string]int64{"cpu": 5}
+
+	got := result.PrefixMetrics("ssh_")
+	if want := map[string]string{"ssh_cpu": "12.5", "ssh_hostname": "host1"}; !maps.Equal(got.Metrics, want) {
+		t.Errorf("got metrics %v, want %v", got.Metrics, want)
+	}
+	for name := range got.TypedMetrics {
+		if name != "ssh_cpu" {
+			t.Errorf("got typed metric %s, want every name prefixed", name)
+		}
+	}
+	if _, ok := got.TypedMetrics["ssh_cpu"]; !ok {
+		t.Errorf("got typed metrics %v, want ssh_cpu", got.TypedMetrics)
+	}
+	if want := map[string]int64{"ssh_cpu": 5}; !maps.Equal(got.CommandMs, want) {
+		t.Errorf("got timings %v, want %v", got.CommandMs, want)
+	}
+
+	if unchanged := result.PrefixMetrics(""); !maps.Equal(unchanged.Metrics, result.Metrics) {
+		t.Errorf("got metrics %v with an empty prefix, want them unchanged", unchanged.Metrics)
+	}
+
+	// Consumers find the error of a failed result under "error" whatever the prefix
+	failed := NewMetricsError(2, "SSH connection error").PrefixMetrics("ssh_")
+	if want := map[string]string{"error": "SSH connection error"}; !maps.Equal(failed.Metrics, want) {
+		t.Errorf("got error metrics %v, want %v", failed.Metrics, want)
+	}
+}
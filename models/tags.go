@@ -0,0 +1,40 @@
+package models
+
+// HasTags reports whether the device carries the given tags,
+// all of them when matchAll is set, otherwise at least one
+// An empty tag list matches every device
+func (d Device) HasTags(tags []string, matchAll bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+
+	own := make(map[string]bool, len(d.Tags))
+	for _, tag := range d.Tags {
+		own[tag] = true
+	}
+
+	for _, tag := range tags {
+		if own[tag] && !matchAll {
+			return true
+		}
+		if !own[tag] && matchAll {
+			return false
+		}
+	}
+	return matchAll
+}
+
+// FilterByTags returns the devices matching the tags as HasTags does, preserving their order
+func FilterByTags(devices []Device, tags []string, matchAll bool) []Device {
+	if len(tags) == 0 {
+		return devices
+	}
+
+	var matched []Device
+	for _, device := range devices {
+		if device.HasTags(tags, matchAll) {
+			matched = append(matched, device)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFilterByTags(t *testing.T) {
+	devices := []Device{
+		{ID: 1, Tags: []string{"prod", "web"}},
+		{ID: 2, Tags: []string{"prod", "db"}},
+		{ID: 3, Tags: []string{"staging", "web"}},
+		{ID: 4},
+	}
+
+	tests := []struct {
+		name     string
+		tags     []string
+		matchAll bool
+		want     []int
+	}{
+		{"no filter", nil, false, []int{1, 2, 3, 4}},
+		{"any of one tag", []string{"web"}, false, []int{1, 3}},
+		{"any of two tags", []string{"db", "staging"}, false, []int{2, 3}},
+		{"all of two tags", []string{"prod", "web"}, true, []int{1}},
+		{"all of one tag", []string{"prod"}, true, []int{1, 2}},
+		{"any of unknown tag", []string{"dev"}, false, nil},
+		{"all with unknown tag", []string{"prod", "dev"}, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, device := range FilterByTags(devices, tt.tags, tt.matchAll) {
+				got = append(got, device.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got devices %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"ssh-plugin/internal/constants"
+	"sync"
+)
+
+// hostnamePattern matches an RFC 1123 hostname
+var hostnamePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// supportedSystemTypes lists the system_type values the plugin can handle
+var (
+	systemTypesMu        sync.RWMutex
+	supportedSystemTypes = map[string]bool{
+		constants.SystemTypeLinux:   true,
+		constants.SystemTypeWindows: true,
+		constants.SystemTypeDarwin:  true,
+		constants.SystemTypeSNMP:    true,
+		constants.SystemTypeFreeBSD: true,
+		constants.SystemTypeRaw:     true,
+	}
+)
+
+// RegisterSystemType makes systemType valid for devices, for types added by registering a collector or performer
+func RegisterSystemType(systemType string) {
+	systemTypesMu.Lock()
+	defer systemTypesMu.Unlock()
+	supportedSystemTypes[systemType] = true
+}
+
+// isSupportedSystemType reports whether devices may use systemType
+func isSupportedSystemType(systemType string) bool {
+	systemTypesMu.RLock()
+	defer systemTypesMu.RUnlock()
+	return supportedSystemTypes[systemType]
+}
+
+// Validate checks that the device can be connected to before any dial is attempted
+func (d Device) Validate() error {
+	if d.IP == "" {
+		return fmt.Errorf("%s: ip is empty", constants.ErrInvalidParameters)
+	}
+	if net.ParseIP(d.IP) == nil && (len(d.IP) > 253 || !hostnamePattern.MatchString(d.IP)) {
+		return fmt.Errorf("%s: ip %q is not a valid address or hostname", constants.ErrInvalidParameters, d.IP)
+	}
+	// Port 0 means the default SSH port
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("%s: port %d is out of range", constants.ErrInvalidParameters, d.Port)
+	}
+	for _, port := range d.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("%s: candidate port %d is out of range", constants.ErrInvalidParameters, port)
+		}
+	}
+	if d.TimeoutSec < 0 {
+		return fmt.Errorf("%s: timeout_sec %d is negative", constants.ErrInvalidParameters, d.TimeoutSec)
+	}
+	// SNMP devices authenticate with a community instead of a username
+	if d.SystemType == constants.SystemTypeSNMP {
+		if d.Credentials.Community == "" {
+			return fmt.Errorf("%s: community is empty", constants.ErrInvalidParameters)
+		}
+	} else if d.Credentials.Username == "" {
+		return fmt.Errorf("%s: username is empty", constants.ErrInvalidParameters)
+	}
+	if !isSupportedSystemType(d.SystemType) {
+		return fmt.Errorf("%s: unsupported system type %q", constants.ErrInvalidParameters, d.SystemType)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"ssh-plugin/internal/constants"
+	"strings"
+	"testing"
+)
+
+func TestDeviceValidate(t *testing.T) {
+	valid := Device{ID: 1, IP: "10.0.0.1", Port: 22, SystemType: "linux", Credentials: Credentials{Username: "admin"}}
+
+	tests := []struct {
+		name    string
+		modify  func(d *Device)
+		wantErr string
+	}{
+		{"valid", func(d *Device) {}, ""},
+		{"hostname", func(d *Device) { d.IP = "server-1.example.com" }, ""},
+		{"ipv6", func(d *Device) { d.IP = "::1" }, ""},
+		{"default port", func(d *Device) { d.Port = 0 }, ""},
+		{"empty ip", func(d *Device) { d.IP = "" }, "ip is empty"},
+		{"invalid ip", func(d *Device) { d.IP = "not a host!" }, "not a valid address"},
+		{"negative port", func(d *Device) { d.Port = -1 }, "port -1 is out of range"},
+		{"port too large", func(d *Device) { d.Port = 65536 }, "port 65536 is out of range"},
+		{"zero candidate port", func(d *Device) { d.Ports = []int{22, 0} }, "candidate port 0 is out of range"},
+		{"negative timeout", func(d *Device) { d.TimeoutSec = -5 }, "timeout_sec -5 is negative"},
+		{"empty username", func(d *Device) { d.Credentials.Username = "" }, "username is empty"},
+		{"unsupported system type", func(d *Device) { d.SystemType = "plan9" }, `unsupported system type "plan9"`},
+		{"snmp without community", func(d *Device) { d.SystemType = constants.SystemTypeSNMP }, "community is empty"},
+		{"snmp with community", func(d *Device) {
+			d.SystemType = constants.SystemTypeSNMP
+			d.Credentials = Credentials{Community: "public"}
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := valid
+			tt.modify(&device)
+			err := device.Validate()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate succeeded, want an error containing %q", tt.wantErr)
+			}
+			if !strings.HasPrefix(err.Error(), constants.ErrInvalidParameters) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want %q after %q", err, tt.wantErr, constants.ErrInvalidParameters)
+			}
+		})
+	}
+}
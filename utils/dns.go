@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"ssh-plugin/internal/constants"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// dnsEntry is a cached resolution of a hostname
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsCache remembers resolved hostnames for ttl so a batch does not look up the same host for every connection
+// Failed lookups are not cached and are retried on the next call
+// Concurrent misses for the same host share a single lookup
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsEntry
+	lookups singleflight.Group
+}
+
+// newDNSCache creates a cache keeping resolutions for ttl
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+// resolver caches the hostname resolutions of the process
+var resolver = newDNSCache(constants.DNSCacheTTL * time.Second)
+
+// ResolveHost returns the address host resolves to, IP addresses are returned unchanged
+// Errors start with constants.ErrDNSFailed
+func ResolveHost(ctx context.Context, host string) (string, error) {
+	addrs, err := resolver.Resolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// ResolveHostAddrs returns every address host resolves to in resolver order, like ResolveHost
+func ResolveHostAddrs(ctx context.Context, host string) ([]string, error) {
+	return resolver.Resolve(ctx, host)
+}
+
+// Resolve returns the cached addresses of host, looking them up when missing or expired
+func (c *dnsCache) Resolve(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	// The shared lookup is not tied to one caller's context, a caller giving up still stops waiting
+	result := c.lookups.DoChan(host, func() (any, error) {
+		lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), constants.DNSLookupTimeout*time.Second)
+		defer cancel()
+		return c.lookup(lookupCtx, host)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %v", constants.ErrDNSFailed, ctx.Err())
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]string), nil
+	}
+}
+
+// lookup resolves host and caches the result
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", constants.ErrDNSFailed, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s: no addresses for %s", constants.ErrDNSFailed, host)
+	}
+
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"context"
+	"slices"
+	"ssh-plugin/internal/constants"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheHit(t *testing.T) {
+	cache := newDNSCache(time.Minute)
+	// A cached entry is returned without a lookup, the name itself does not resolve
+	cache.entries["cached.invalid"] = dnsEntry{addrs: []string{"192.0.2.7"}, expires: time.Now().Add(time.Minute)}
+
+	addrs, err := cache.Resolve(context.Background(), "cached.invalid")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if !slices.Equal(addrs, []string{"192.0.2.7"}) {
+		t.Errorf("got %q, want the cached address", addrs)
+	}
+}
+
+func TestDNSCacheMiss(t *testing.T) {
+	cache := newDNSCache(time.Minute)
+	// An expired entry is looked up again and replaced
+	cache.entries["localhost"] = dnsEntry{addrs: []string{"192.0.2.7"}, expires: time.Now().Add(-time.Second)}
+
+	addrs, err := cache.Resolve(context.Background(), "localhost")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if slices.Contains(addrs, "192.0.2.7") {
+		t.Errorf("got %q, want the expired entry replaced", addrs)
+	}
+	entry, ok := cache.entries["localhost"]
+	if !ok || !slices.Equal(entry.addrs, addrs) || !entry.expires.After(time.Now()) {
+		t.Errorf("got cache entry %+v, want the fresh lookup cached", entry)
+	}
+
+	// IP addresses are returned as is and never cached
+	addrs, err = cache.Resolve(context.Background(), "192.0.2.9")
+	if err != nil || !slices.Equal(addrs, []string{"192.0.2.9"}) {
+		t.Errorf("got %q, %v, want the address unchanged", addrs, err)
+	}
+	if _, ok := cache.entries["192.0.2.9"]; ok {
+		t.Error("IP address was cached")
+	}
+}
+
+func TestDNSCacheFailure(t *testing.T) {
+	cache := newDNSCache(time.Minute)
+
+	_, err := cache.Resolve(context.Background(), "no-such-host.invalid")
+	if err == nil || !strings.HasPrefix(err.Error(), constants.ErrDNSFailed) {
+		t.Fatalf("got error %v, want %s", err, constants.ErrDNSFailed)
+	}
+	if _, ok := cache.entries["no-such-host.invalid"]; ok {
+		t.Error("failed lookup was cached")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.Resolve(ctx, "another-host.invalid")
+	if err == nil || !strings.HasPrefix(err.Error(), constants.ErrDNSFailed) {
+		t.Errorf("got error %v for a cancelled lookup, want %s", err, constants.ErrDNSFailed)
+	}
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// applyEnv sets env on the session and returns command adjusted for the variables the server refused
+// Many sshd configurations only accept a few names through AcceptEnv, the others are exported
+// by a POSIX shell prefix on the command instead
+func applyEnv(session *ssh.Session, command string, env map[string]string) string {
+	var exports []string
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		if err := session.Setenv(name, env[name]); err != nil {
+			exports = append(exports, fmt.Sprintf("%s='%s'", name, strings.ReplaceAll(env[name], "'", `'\''`)))
+		}
+	}
+
+	if len(exports) == 0 {
+		return command
+	}
+	return "export " + strings.Join(exports, " ") + "; " + command
+}
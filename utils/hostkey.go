@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyRecorderKey keys the HostKeyRecorder carried by a context
+type hostKeyRecorderKey struct{}
+
+// HostKeyRecorder keeps the host key a device presented while CreateSSHClient connected to it
+type HostKeyRecorder struct {
+	mu  sync.Mutex
+	key ssh.PublicKey
+}
+
+// WithHostKeyRecorder returns a copy of ctx whose connections record the device's host key in the returned recorder
+// The key is recorded before it is verified, so it is also available when verification or authentication fails
+func WithHostKeyRecorder(ctx context.Context) (context.Context, *HostKeyRecorder) {
+	recorder := &HostKeyRecorder{}
+	return context.WithValue(ctx, hostKeyRecorderKey{}, recorder), recorder
+}
+
+// Fingerprint returns the SHA256 fingerprint of the recorded host key, e.g. "SHA256:...", empty if none was presented
+func (r *HostKeyRecorder) Fingerprint() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.key == nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(r.key)
+}
+
+// recordHostKey wraps callback to record the key presented by addr in the recorder carried by ctx, if any
+// Keys of jump hosts are passed through without being recorded
+func recordHostKey(ctx context.Context, addr string, callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	recorder, ok := ctx.Value(hostKeyRecorderKey{}).(*HostKeyRecorder)
+	if !ok {
+		return callback
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if hostname == addr {
+			recorder.mu.Lock()
+			recorder.key = key
+			recorder.mu.Unlock()
+		}
+		return callback(hostname, remote, key)
+	}
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"ssh-plugin/models"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ClientPool caches SSH clients keyed by IP:port:user and a hash of the credentials and jump host for reuse within a batch
+// Clients idle longer than the idle timeout are closed on the next Get or Put
+type ClientPool struct {
+	mu          sync.Mutex
+	clients     map[string]*pooledClient
+	idleTimeout time.Duration
+	generation  uint64 // Incremented by Close, a client dialled across it is not cached
+}
+
+// pooledClient tracks how a cached client is being used
+type pooledClient struct {
+	client   *ssh.Client
+	inUse    int
+	lastUsed time.Time
+}
+
+// NewClientPool creates an empty pool evicting clients idle longer than idleTimeout
+func NewClientPool(idleTimeout time.Duration) *ClientPool {
+	return &ClientPool{
+		clients:     make(map[string]*pooledClient),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// clientKey identifies the connection a device needs
+// Device entries for the same address that authenticate differently or go through another bastion
+// get their own client, the hash keeps the secrets out of the key
+func clientKey(device models.Device) string {
+	route, _ := json.Marshal(struct {
+		Credentials models.Credentials
+		Jump        *models.JumpHost
+	}{device.Credentials, device.Jump})
+	sum := sha256.Sum256(route)
+	return fmt.Sprintf("%s:%d:%s:%x", device.IP, device.SSHPort(), device.Credentials.Username, sum[:16])
+}
+
+// Get returns a cached client for the device, or creates one with CreateSSHClient
+// A cached client that no longer answers a keepalive request is discarded and recreated
+// Every successful Get must be followed by Put or Discard
+func (p *ClientPool) Get(ctx context.Context, device models.Device, timeout time.Duration) (*ssh.Client, error) {
+	key := clientKey(device)
+
+	p.mu.Lock()
+	p.evictIdle()
+	generation := p.generation
+	entry, ok := p.clients[key]
+	if ok {
+		entry.inUse++
+	}
+	p.mu.Unlock()
+
+	if ok {
+		if _, _, err := entry.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return entry.client, nil
+		}
+		p.Discard(device, entry.client)
+	}
+
+	client, err := CreateSSHClient(ctx, device, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The pool was closed while dialling, e.g. on a config reload, the client is used once and closed by Put
+	if p.generation != generation {
+		return client, nil
+	}
+	// Another goroutine may have connected the same device meanwhile, keep the first one cached
+	if existing, ok := p.clients[key]; ok {
+		existing.inUse++
+		client.Close()
+		return existing.client, nil
+	}
+	p.clients[key] = &pooledClient{client: client, inUse: 1, lastUsed: time.Now()}
+	return client, nil
+}
+
+// Put returns a client obtained from Get to the pool
+// A client no longer tracked by the pool, e.g. after Close, is closed instead
+func (p *ClientPool) Put(device models.Device, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.clients[clientKey(device)]
+	if !ok || entry.client != client {
+		client.Close()
+		return
+	}
+
+	entry.inUse--
+	entry.lastUsed = time.Now()
+	p.evictIdle()
+}
+
+// Discard removes a broken client from the pool and closes it
+func (p *ClientPool) Discard(device models.Device, client *ssh.Client) {
+	p.mu.Lock()
+	key := clientKey(device)
+	if entry, ok := p.clients[key]; ok && entry.client == client {
+		delete(p.clients, key)
+	}
+	p.mu.Unlock()
+
+	client.Close()
+}
+
+// Close empties the pool, closing idle clients now and in-use clients when they are Put back
+func (p *ClientPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.generation++
+	for key, entry := range p.clients {
+		if entry.inUse == 0 {
+			entry.client.Close()
+		}
+		delete(p.clients, key)
+	}
+}
+
+// Release removes the clients cached for devices, closing idle ones now and in-use ones when they are Put back
+// Unlike Close it leaves the clients of other devices cached
+func (p *ClientPool) Release(devices ...models.Device) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, device := range devices {
+		key := clientKey(device)
+		entry, ok := p.clients[key]
+		if !ok {
+			continue
+		}
+		if entry.inUse == 0 {
+			entry.client.Close()
+		}
+		delete(p.clients, key)
+	}
+}
+
+// evictIdle closes unused clients past the idle timeout, p.mu must be held
+func (p *ClientPool) evictIdle() {
+	for key, entry := range p.clients {
+		if entry.inUse == 0 && time.Since(entry.lastUsed) > p.idleTimeout {
+			entry.client.Close()
+			delete(p.clients, key)
+		}
+	}
+}
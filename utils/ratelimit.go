@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing rate events per second with bursts of up to one second's worth
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing perSec events per second, starting with a full bucket
+func newRateLimiter(perSec int) *rateLimiter {
+	return &rateLimiter{rate: float64(perSec), tokens: float64(perSec), last: time.Now()}
+}
+
+// Wait blocks until an event is allowed or ctx is done
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// connectLimiter throttles new SSH dials across the process, nil when unlimited
+var (
+	connectLimiterMu   sync.Mutex
+	connectLimiter     *rateLimiter
+	connectLimiterRate int
+)
+
+// waitConnectSlot blocks until a new connection may be opened under perSec dials per second
+// A perSec of zero or less disables the limit
+func waitConnectSlot(ctx context.Context, perSec int) error {
+	if perSec <= 0 {
+		return nil
+	}
+
+	connectLimiterMu.Lock()
+	if connectLimiter == nil || connectLimiterRate != perSec {
+		connectLimiter = newRateLimiter(perSec)
+		connectLimiterRate = perSec
+	}
+	limiter := connectLimiter
+	connectLimiterMu.Unlock()
+
+	return limiter.Wait(ctx)
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(10)
+	ctx := context.Background()
+
+	// A full bucket lets a second's worth through at once, the rest follow at the rate
+	start := time.Now()
+	for range 10 {
+		if err := limiter.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("burst took %s, want no wait", elapsed)
+	}
+
+	start = time.Now()
+	for range 5 {
+		if err := limiter.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond || elapsed > time.Second {
+		t.Errorf("5 events after the burst took %s, want about 500ms at 10 per second", elapsed)
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	limiter := newRateLimiter(1)
+	limiter.Wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx); err == nil {
+		t.Error("Wait returned without a token or error after the context ended")
+	}
+}
+
+func TestCreateSSHClientConnectRate(t *testing.T) {
+	const dials = 25
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	device := testDevice(srv, models.Credentials{Username: "test", Password: "pw"})
+
+	tests := []struct {
+		name       string
+		config     string
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		// 10 dials from the full bucket, 15 more at 10 per second
+		{"limited", `{"ssh": {"connect_rate_per_sec": 10}}`, 1400 * time.Millisecond, 3 * time.Second},
+		{"unlimited", `{}`, 0, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := sshtest.Context(t, tt.config)
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for range dials {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					client, err := CreateSSHClient(ctx, device, 10*time.Second)
+					if err != nil {
+						t.Errorf("CreateSSHClient: %v", err)
+						return
+					}
+					client.Close()
+				}()
+			}
+			wg.Wait()
+
+			if elapsed := time.Since(start); elapsed < tt.minElapsed || elapsed > tt.maxElapsed {
+				t.Errorf("%d dials took %s, want between %s and %s", dials, elapsed, tt.minElapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
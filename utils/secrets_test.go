@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"ssh-plugin/internal/constants"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateSSHClientPasswordRef(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{Password: "s3cret"})
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(path, []byte(`{"core-router": "s3cret"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := sshtest.Context(t, `{"ssh": {"retries": 2, "retry_backoff_ms": 10, "secrets_file": `+strconv.Quote(path)+`}}`)
+
+	// The ref wins over a stale inline password
+	client, err := CreateSSHClient(ctx, testDevice(srv, models.Credentials{Username: "test", Password: "old", PasswordRef: "core-router"}), 5*time.Second)
+	if err != nil {
+		t.Fatalf("CreateSSHClient: %v", err)
+	}
+	client.Close()
+
+	_, err = CreateSSHClient(ctx, testDevice(srv, models.Credentials{Username: "test", PasswordRef: "edge-router"}), 5*time.Second)
+	if err == nil || !strings.HasPrefix(err.Error(), constants.ErrAuthFailed) {
+		t.Fatalf("got error %v, want it to start with %q", err, constants.ErrAuthFailed)
+	}
+	if got := srv.Connections(); got != 1 {
+		t.Errorf("got %d connections, an unknown ref must fail before dialing and not be retried", got)
+	}
+}
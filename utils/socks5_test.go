@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"ssh-plugin/internal/sshtest"
+	"ssh-plugin/models"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socksServer is a minimal in-process SOCKS5 proxy supporting CONNECT
+// Hosts maps names only the proxy can resolve to addresses
+type socksServer struct {
+	Addr     string
+	Username string // Required with Password when set
+	Password string
+	Hosts    map[string]string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+// newSOCKSServer starts a proxy on a loopback port, it is stopped when the test ends
+func newSOCKSServer(t *testing.T, username, password string, hosts map[string]string) *socksServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &socksServer{Addr: listener.Addr().String(), Username: username, Password: password, Hosts: hosts}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+// Targets returns the addresses clients asked the proxy to connect to, in order
+func (s *socksServer) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.targets)
+}
+
+// handle serves the greeting, authentication and CONNECT request of one client
+func (s *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, method count, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(0x00)
+	if s.Username != "" {
+		method = 0x02
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, method})
+
+	// Username and password subnegotiation, RFC 1929
+	if method == 0x02 {
+		user, pass, err := readCredentials(conn)
+		if err != nil {
+			return
+		}
+		if user != s.Username || pass != s.Password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make(net.IP, map[byte]int{1: 4, 4: 16}[request[3]])
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	dialAddr := target
+	if mapped, ok := s.Hosts[host]; ok {
+		dialAddr = mapped
+	}
+	upstream, err := net.DialTimeout("tcp", dialAddr, 5*time.Second)
+	if err != nil {
+		// Connection refused or host unreachable
+		code := byte(4)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			code = 5
+		}
+		conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+}
+
+// readCredentials reads a username and password subnegotiation request
+func readCredentials(conn net.Conn) (string, string, error) {
+	readField := func() (string, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(conn, field)
+		return string(field), err
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil || version[0] != 1 {
+		return "", "", fmt.Errorf("unsupported subnegotiation version")
+	}
+	user, err := readField()
+	if err != nil {
+		return "", "", err
+	}
+	pass, err := readField()
+	return user, pass, err
+}
+
+// socksConfig returns a config dialing through the proxy at addr
+func socksConfig(addr, username, password string) string {
+	return fmt.Sprintf(`{"ssh": {"socks5": {"address": %q, "username": %q, "password": %q}}}`, addr, username, password)
+}
+
+func TestCreateSSHClientSOCKS5(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	creds := models.Credentials{Username: "test", Password: "pw"}
+
+	t.Run("no auth", func(t *testing.T) {
+		proxy := newSOCKSServer(t, "", "", nil)
+		ctx := sshtest.Context(t, socksConfig(proxy.Addr, "", ""))
+
+		client, err := CreateSSHClient(ctx, testDevice(srv, creds), 5*time.Second)
+		if err != nil {
+			t.Fatalf("CreateSSHClient: %v", err)
+		}
+		defer client.Close()
+		runEcho(t, client)
+
+		if targets := proxy.Targets(); !slices.Equal(targets, []string{srv.Addr}) {
+			t.Errorf("got proxy targets %q, want only %s", targets, srv.Addr)
+		}
+	})
+
+	t.Run("credentials", func(t *testing.T) {
+		proxy := newSOCKSServer(t, "monitor", "secret", nil)
+
+		ctx := sshtest.Context(t, socksConfig(proxy.Addr, "monitor", "secret"))
+		client, err := CreateSSHClient(ctx, testDevice(srv, creds), 5*time.Second)
+		if err != nil {
+			t.Fatalf("CreateSSHClient: %v", err)
+		}
+		client.Close()
+
+		ctx = sshtest.Context(t, socksConfig(proxy.Addr, "monitor", "wrong"))
+		if client, err := CreateSSHClient(ctx, testDevice(srv, creds), 5*time.Second); err == nil {
+			client.Close()
+			t.Error("CreateSSHClient succeeded with wrong proxy credentials")
+		}
+	})
+
+	t.Run("name resolved by the proxy", func(t *testing.T) {
+		proxy := newSOCKSServer(t, "", "", map[string]string{"device.segment.invalid": srv.Addr})
+		ctx := sshtest.Context(t, socksConfig(proxy.Addr, "", ""))
+
+		device := testDevice(srv, creds)
+		device.IP = "device.segment.invalid"
+		client, err := CreateSSHClient(ctx, device, 5*time.Second)
+		if err != nil {
+			t.Fatalf("CreateSSHClient: %v", err)
+		}
+		defer client.Close()
+		runEcho(t, client)
+
+		if targets := proxy.Targets(); len(targets) != 1 || !strings.HasPrefix(targets[0], "device.segment.invalid:") {
+			t.Errorf("got proxy targets %q, want the name passed unresolved", targets)
+		}
+	})
+}
+
+func TestProbePortSOCKS5(t *testing.T) {
+	srv := sshtest.NewServer(t, sshtest.Options{})
+	proxy := newSOCKSServer(t, "", "", nil)
+	ctx := sshtest.Context(t, socksConfig(proxy.Addr, "", ""))
+
+	if state := ProbePort(ctx, srv.Host(), srv.Port(), 2*time.Second); state != PortOpen {
+		t.Errorf("got state %v for the server port, want open", state)
+	}
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	if state := ProbePort(ctx, "127.0.0.1", port, 2*time.Second); state != PortClosed {
+		t.Errorf("got state %v for a refused port, want closed", state)
+	}
+	if len(proxy.Targets()) != 2 {
+		t.Errorf("got proxy targets %q, want both probes through the proxy", proxy.Targets())
+	}
+}
@@ -1,20 +1,33 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"runtime/debug"
-	"ssh-plugin/constants"
+	"ssh-plugin/config"
+	"ssh-plugin/internal/constants"
 	"ssh-plugin/models"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
 )
 
 // CreateSSHClient creates a new SSH client for the given device
+// Connection and timeout failures are retried with exponential backoff as configured,
+// authentication and host key failures are returned immediately
+// New connections are throttled to ssh.connect_rate_per_sec when set
+// Cancelling ctx aborts the connection attempt and any pending retry
 // Panics are caught and converted to errors to prevent process crashes
-func CreateSSHClient(device models.Device, timeout time.Duration) (client *ssh.Client, err error) {
+func CreateSSHClient(ctx context.Context, device models.Device, timeout time.Duration) (client *ssh.Client, err error) {
 	// Recover from panics
 	defer func() {
 		if r := recover(); r != nil {
@@ -23,43 +36,436 @@ func CreateSSHClient(device models.Device, timeout time.Duration) (client *ssh.C
 		}
 	}()
 
-	// Use default SSH port if not specified
-	port := device.Port
-	if port == 0 {
-		port = constants.DefaultSSHPort
+	cfg, err := config.FromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("config load error: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Every attempt opens a new connection and counts against the connect rate
+		if err := waitConnectSlot(ctx, cfg.SSH.ConnectRatePerSec); err != nil {
+			return nil, fmt.Errorf("%s: %v", constants.ErrCancelled, err)
+		}
+
+		client, err = dialSSH(ctx, device, timeout, cfg)
+		if err == nil || attempt >= cfg.SSH.Retries || !isRetryable(err) {
+			return client, err
+		}
+
+		select {
+		case <-time.After(retryDelay(cfg.GetRetryBackoff(), attempt)):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s: %v", constants.ErrCancelled, ctx.Err())
+		}
+	}
+}
+
+// isRetryable reports whether a CreateSSHClient error is transient
+func isRetryable(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, constants.ErrConnectionFailed) || strings.HasPrefix(msg, constants.ErrTimeout)
+}
+
+// retryDelay returns the exponential backoff for the given attempt with up to 50% random jitter
+// The doubling stops at MaxRetryBackoff so large ssh.retries neither overflow nor wait for hours
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := time.Duration(constants.MaxRetryBackoff) * time.Second
+	if shift := min(attempt, 16); base > 0 && base <= delay>>shift {
+		delay = base << shift
+	}
+	return delay + rand.N(delay/2+1)
+}
+
+// dialSSH makes a single attempt to connect to the device
+func dialSSH(ctx context.Context, device models.Device, timeout time.Duration, cfg *config.Config) (*ssh.Client, error) {
+	// Build the authentication methods from the device credentials
+	creds, err := resolvePassword(device.Credentials, cfg)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := buildAuthMethods(creds, cfg.SSH.AuthMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := HostKeyCallback(cfg.SSH.KnownHosts)
+	if err != nil {
+		return nil, err
 	}
+	addr := net.JoinHostPort(device.IP, strconv.Itoa(device.SSHPort()))
 
 	// Set up SSH client configuration
-	config := &ssh.ClientConfig{
-		User: device.Credentials.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(device.Credentials.Password),
+	clientConfig := &ssh.ClientConfig{
+		User:            device.Credentials.Username,
+		Auth:            auth,
+		HostKeyCallback: recordHostKey(ctx, addr, hostKeyCallback),
+		Timeout:         cfg.ConnectTimeout(timeout),
+		Config: ssh.Config{
+			Ciphers:      cfg.SSH.Ciphers,
+			KeyExchanges: cfg.SSH.KeyExchanges,
+			MACs:         cfg.SSH.MACs,
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         timeout,
 	}
 
-	// Connect to the SSH server
-	addr := fmt.Sprintf("%s:%d", device.IP, port)
-	client, err = ssh.Dial("tcp", addr, config)
+	// Connect to the SSH server, through the jump host if one is configured
+	keepalive := cfg.GetKeepaliveInterval()
+	handshakeTimeout := cfg.HandshakeTimeout(timeout)
+	var client *ssh.Client
+	if device.Jump != nil && device.Jump.Host != "" {
+		client, err = dialThroughJumpHost(ctx, *device.Jump, addr, clientConfig, handshakeTimeout, cfg)
+	} else {
+		client, err = dialContext(ctx, addr, clientConfig, handshakeTimeout, cfg)
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %s", constants.ErrCancelled, err.Error())
+		}
+		// Resolution failures already carry their error prefix
+		if strings.HasPrefix(err.Error(), constants.ErrDNSFailed) {
+			return nil, err
+		}
+		// Host key verification failures are reported before any other classification
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) > 0 {
+				return nil, fmt.Errorf("%s: %s", constants.ErrHostKeyChanged, err.Error())
+			}
+			return nil, fmt.Errorf("%s: %s", constants.ErrHostKeyUnknown, err.Error())
+		}
 		// Log the error before returning it
 		if strings.Contains(err.Error(), "timeout") {
 			return nil, fmt.Errorf("%s: %s", constants.ErrTimeout, err.Error())
 		}
-		if strings.Contains(err.Error(), "authentication") {
+		// The client reports a rejected login as "unable to authenticate"
+		if strings.Contains(err.Error(), "authentication") || strings.Contains(err.Error(), "unable to authenticate") {
 			return nil, fmt.Errorf("%s: %s", constants.ErrAuthFailed, err.Error())
 		}
 		// General connection failure
 		return nil, fmt.Errorf("%s: %s", constants.ErrConnectionFailed, err.Error())
 	}
 
+	go sendKeepalives(client, keepalive)
+
 	return client, nil
 }
 
+// sendKeepalives sends an SSH keepalive request every interval until the client is closed
+// so idle connections are not dropped by firewalls during slow commands
+// A keepalive failing or left unanswered for an interval closes the client, so a dead peer is detected
+func sendKeepalives(client *ssh.Client, interval time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			replied := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replied <- err
+			}()
+			select {
+			case err := <-replied:
+				if err != nil {
+					client.Close()
+					return
+				}
+			case <-time.After(interval):
+				client.Close()
+				return
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// dialThroughJumpHost connects to the bastion and tunnels a new SSH connection to addr over it
+// The bastion connection is closed once the returned client is closed
+func dialThroughJumpHost(ctx context.Context, jump models.JumpHost, addr string, clientConfig *ssh.ClientConfig, handshakeTimeout time.Duration, cfg *config.Config) (*ssh.Client, error) {
+	jumpPort := jump.Port
+	if jumpPort == 0 {
+		jumpPort = constants.DefaultSSHPort
+	}
+
+	jumpCreds, err := resolvePassword(jump.Credentials, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("jump host: %w", err)
+	}
+	jumpAuth, err := buildAuthMethods(jumpCreds, cfg.SSH.AuthMethods)
+	if err != nil {
+		return nil, fmt.Errorf("jump host: %w", err)
+	}
+
+	jumpConfig := &ssh.ClientConfig{
+		User:            jump.Credentials.Username,
+		Auth:            jumpAuth,
+		HostKeyCallback: clientConfig.HostKeyCallback,
+		Timeout:         clientConfig.Timeout,
+		Config:          clientConfig.Config,
+	}
+
+	bastion, err := dialContext(ctx, net.JoinHostPort(jump.Host, strconv.Itoa(jumpPort)), jumpConfig, handshakeTimeout, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("jump host: %w", err)
+	}
+	go sendKeepalives(bastion, cfg.GetKeepaliveInterval())
+
+	conn, err := bastion.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		bastion.Close()
+		return nil, fmt.Errorf("jump host: %w", err)
+	}
+
+	client, err := newClientContext(ctx, conn, addr, clientConfig, handshakeTimeout)
+	if err != nil {
+		bastion.Close()
+		return nil, err
+	}
+
+	go func() {
+		client.Wait()
+		bastion.Close()
+	}()
+
+	return client, nil
+}
+
+// dialContext is ssh.Dial honoring ctx for both the TCP connect and the SSH handshake
+// clientConfig.Timeout bounds the TCP connect and handshakeTimeout the handshake that follows
+// The TCP connection goes through the configured SOCKS5 proxy, if any
+func dialContext(ctx context.Context, addr string, clientConfig *ssh.ClientConfig, handshakeTimeout time.Duration, cfg *config.Config) (*ssh.Client, error) {
+	conn, err := dialTCP(ctx, cfg, addr, clientConfig.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClientContext(ctx, conn, addr, clientConfig, handshakeTimeout)
+}
+
+// dialTCP opens a TCP connection to addr with the dialer from newDialer
+// Without a proxy the host is resolved through the DNS cache and each of its addresses is tried,
+// a proxy resolves it itself
+func dialTCP(ctx context.Context, cfg *config.Config, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer, err := newDialer(cfg, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SSH.SOCKS5.Address != "" {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := ResolveHostAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Addresses are tried in resolver order, the error of the first one is reported
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// newDialer returns the dialer TCP connections are opened with
+// TCP keepalive probes are sent every keepalive interval, to the proxy when ssh.socks5 is set
+func newDialer(cfg *config.Config, timeout time.Duration) (proxy.ContextDialer, error) {
+	direct := &net.Dialer{Timeout: timeout, KeepAlive: cfg.GetKeepaliveInterval()}
+	if cfg.SSH.SOCKS5.Address == "" {
+		return direct, nil
+	}
+
+	var auth *proxy.Auth
+	if cfg.SSH.SOCKS5.Username != "" {
+		auth = &proxy.Auth{User: cfg.SSH.SOCKS5.Username, Password: cfg.SSH.SOCKS5.Password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", cfg.SSH.SOCKS5.Address, auth, direct)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy: %w", err)
+	}
+	// The SOCKS5 dialer always supports contexts, the assertion only guards against library changes
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("socks5 proxy: dialer does not support contexts")
+	}
+	return contextDialer, nil
+}
+
+// newClientContext runs the SSH handshake over conn, closing conn if ctx is cancelled meanwhile
+// A server that has not finished the banner, key exchange and authentication within timeout is given up on
+// with a timeout error, zero leaves the handshake bounded by ctx alone
+func newClientContext(ctx context.Context, conn net.Conn, addr string, clientConfig *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	// A timer closes the connection rather than a deadline, which connections tunnelled through a jump host do not support
+	handshakeCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	stop := context.AfterFunc(handshakeCtx, func() {
+		conn.Close()
+	})
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if !stop() {
+		// ctx fired and closed the connection under the handshake
+		if err == nil {
+			clientConn.Close()
+		}
+		if ctx.Err() == nil {
+			return nil, fmt.Errorf("ssh handshake timeout after %s", timeout)
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// HostKeyCallback returns the host key callback for the given known_hosts path
+// An empty path keeps the insecure behavior of accepting any host key
+func HostKeyCallback(knownHostsPath string) (ssh.HostKeyCallback, error) {
+	if knownHostsPath == "" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	return callback, nil
+}
+
+// resolvePassword replaces the password of credentials carrying a password_ref with the secret it names
+func resolvePassword(creds models.Credentials, cfg *config.Config) (models.Credentials, error) {
+	if creds.PasswordRef == "" {
+		return creds, nil
+	}
+	password, err := cfg.Secret(creds.PasswordRef)
+	if err != nil {
+		return creds, fmt.Errorf("%s: %s", constants.ErrAuthFailed, err.Error())
+	}
+	creds.Password = password
+	return creds, nil
+}
+
+// buildAuthMethods returns the SSH auth methods available for the given credentials
+// Without a configured order public-key auth is offered first when a private key is present,
+// followed by password auth, methods left out of a configured order are never offered
+func buildAuthMethods(creds models.Credentials, order []string) ([]ssh.AuthMethod, error) {
+	if len(order) == 0 {
+		order = []string{"publickey", "password", "keyboard-interactive"}
+	}
+
+	var auth []ssh.AuthMethod
+	for _, method := range order {
+		switch method {
+		case "publickey":
+			if creds.PrivateKey == "" {
+				continue
+			}
+			var signer ssh.Signer
+			var err error
+			if creds.Passphrase != "" {
+				signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(creds.PrivateKey), []byte(creds.Passphrase))
+			} else {
+				signer, err = ssh.ParsePrivateKey([]byte(creds.PrivateKey))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid private key: %s", constants.ErrAuthFailed, err.Error())
+			}
+			auth = append(auth, ssh.PublicKeys(signer))
+		case "password":
+			// Keep password auth when a password is set or no key is available
+			if creds.Password != "" || creds.PrivateKey == "" {
+				auth = append(auth, ssh.Password(creds.Password))
+			}
+		case "keyboard-interactive":
+			// Fallback for servers that only offer keyboard-interactive
+			if creds.Password != "" || creds.PrivateKey == "" {
+				auth = append(auth, ssh.KeyboardInteractive(passwordChallenge(creds.Password)))
+			}
+		}
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("%s: no configured auth method is usable with the given credentials", constants.ErrAuthFailed)
+	}
+	return auth, nil
+}
+
+// passwordChallenge answers a keyboard-interactive challenge with the password
+// Only single-prompt challenges are answered, rounds without prompts are acknowledged
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		switch len(questions) {
+		case 0:
+			return nil, nil
+		case 1:
+			return []string{password}, nil
+		default:
+			return nil, fmt.Errorf("unsupported keyboard-interactive challenge with %d prompts", len(questions))
+		}
+	}
+}
+
 // ExecuteCommand executes a command on the SSH client
+// The command is killed and constants.ErrTimeout (or ErrCancelled) returned when ctx expires
+// or after constants.CommandTimeout, whichever comes first
 // Panics are caught and converted to errors to prevent process crashes
-func ExecuteCommand(client *ssh.Client, command string) (output string, err error) {
+func ExecuteCommand(ctx context.Context, client *ssh.Client, command string) (output string, err error) {
+	return ExecuteCommandWithOptions(ctx, client, command, ExecOptions{})
+}
+
+// ExecOptions adjusts how ExecuteCommandWithOptions runs a command
+type ExecOptions struct {
+	Stdin          string            // Fed to the remote command, nothing when empty
+	PTY            bool              // Request a pseudo-terminal for commands that need one
+	Timeout        time.Duration     // Replaces constants.CommandTimeout when longer, for slow devices
+	MaxOutputBytes int64             // Output allowed before the command is stopped, zero uses constants.MaxOutputBytes
+	Env            map[string]string // Environment set on the session, exported by the command when the server refuses it
+}
+
+// ptyModes are the terminal modes requested with a PTY
+// Echo is off so input such as a sudo password never shows up in the output
+var ptyModes = ssh.TerminalModes{
+	ssh.ECHO:          0,
+	ssh.TTY_OP_ISPEED: 14400,
+	ssh.TTY_OP_OSPEED: 14400,
+}
+
+// ExecuteCommandWithOptions is ExecuteCommand with stdin and PTY allocation controlled by opts
+// On a nonzero exit the output is returned along with an error wrapping the *ssh.ExitError,
+// so callers can decide whether the exit status matters
+func ExecuteCommandWithOptions(ctx context.Context, client *ssh.Client, command string, opts ExecOptions) (output string, err error) {
 	// Recover from panics
 	defer func() {
 		if r := recover(); r != nil {
@@ -68,26 +474,167 @@ func ExecuteCommand(client *ssh.Client, command string) (output string, err erro
 		}
 	}()
 
-	session, err := client.NewSession()
+	stream, err := StreamCommand(ctx, client, command, opts)
 	if err != nil {
-		return "", fmt.Errorf("failed to create session: %v", err)
+		return "", err
 	}
-	defer session.Close()
+	defer stream.Close()
 
-	outputBytes, err := session.CombinedOutput(command)
+	data, err := io.ReadAll(stream)
 	if err != nil {
-		return "", fmt.Errorf("%s: %v", constants.ErrExecutionFailed, err)
+		// A nonzero exit still produced meaningful output, e.g. grep without matches
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return strings.TrimSpace(string(data)), err
+		}
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// StreamCommand starts a command and returns a reader over its combined stdout and stderr as they are produced,
+// so large outputs can be consumed without holding them in memory
+// After the last output the reader returns the command's error, constants.ErrExecutionFailed on a nonzero exit
+// and constants.ErrTimeout (or ErrCancelled) when ctx expires or after constants.CommandTimeout, or opts.Timeout if longer,
+// whichever comes first
+// Output beyond opts.MaxOutputBytes is not returned, the reader fails with constants.ErrOutputTooLarge instead
+// Close must always be called, it kills a command still running and releases the session
+func StreamCommand(ctx context.Context, client *ssh.Client, command string, opts ExecOptions) (io.ReadCloser, error) {
+	// Bound every command, a caller's deadline such as the batch deadline may be much further away
+	ctx, cancel := context.WithTimeout(ctx, max(constants.CommandTimeout*time.Second, opts.Timeout))
+
+	session, err := client.NewSession()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	// Stdout and stderr share the pipe like CombinedOutput, pipe writes are serialized
+	reader, writer := io.Pipe()
+	session.Stdout = writer
+	session.Stderr = writer
+	if opts.Stdin != "" {
+		session.Stdin = strings.NewReader(opts.Stdin)
+	}
+
+	// A wide terminal keeps long output lines from wrapping
+	if opts.PTY {
+		if err := session.RequestPty("xterm", 40, 512, ptyModes); err != nil {
+			session.Close()
+			cancel()
+			return nil, fmt.Errorf("%s: failed to request pty: %v", constants.ErrExecutionFailed, err)
+		}
+	}
+
+	if len(opts.Env) > 0 {
+		command = applyEnv(session, command, opts.Env)
+	}
+
+	if err := session.Start(command); err != nil {
+		session.Close()
+		cancel()
+		return nil, fmt.Errorf("%s: %v", constants.ErrExecutionFailed, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGKILL)
+		session.Close()
+	})
+
+	go func() {
+		err := session.Wait()
+		stop()
+		switch {
+		case errors.Is(ctx.Err(), context.Canceled):
+			err = fmt.Errorf("%s: %v", constants.ErrCancelled, ctx.Err())
+		case ctx.Err() != nil:
+			err = fmt.Errorf("%s: %v", constants.ErrTimeout, ctx.Err())
+		case err != nil:
+			// Wrapped so callers can inspect an *ssh.ExitError
+			err = fmt.Errorf("%s: %w", constants.ErrExecutionFailed, err)
+		}
+		// A nil error ends the stream with io.EOF
+		writer.CloseWithError(err)
+	}()
+
+	limit := opts.MaxOutputBytes
+	if limit <= 0 {
+		limit = constants.MaxOutputBytes
 	}
 
-	return strings.TrimSpace(string(outputBytes)), nil
+	return &commandStream{PipeReader: reader, session: session, cancel: cancel, limit: limit}, nil
+}
+
+// commandStream is the reader returned by StreamCommand
+type commandStream struct {
+	*io.PipeReader
+	session *ssh.Session
+	cancel  context.CancelFunc
+	limit   int64 // Output bytes allowed
+	read    int64 // Output bytes read so far
 }
 
+// Read reads output up to the limit, then fails with constants.ErrOutputTooLarge
+// Close stops the command once the caller gives up on it
+func (s *commandStream) Read(p []byte) (int, error) {
+	if s.read >= s.limit {
+		// Probe for one more byte so output of exactly the limit still ends normally
+		var probe [1]byte
+		n, err := s.PipeReader.Read(probe[:])
+		if n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%s: more than %d bytes", constants.ErrOutputTooLarge, s.limit)
+	}
+
+	if remaining := s.limit - s.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := s.PipeReader.Read(p)
+	s.read += int64(n)
+	return n, err
+}
+
+// Close stops the command if it is still running and releases the session
+func (s *commandStream) Close() error {
+	s.session.Close()
+	s.cancel()
+	return s.PipeReader.Close()
+}
+
+// PortState is the outcome of probing a TCP port
+type PortState int
+
+const (
+	PortOpen        PortState = iota // The connection was accepted
+	PortClosed                       // The host refused the connection, it is up but nothing listens on the port
+	PortUnreachable                  // No answer before the timeout, or no route to the host
+)
+
 // IsPortOpen checks if a port is open on a host
-func IsPortOpen(host string, port int, timeout time.Duration) bool {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), timeout)
+// The check goes through the SOCKS5 proxy when one is configured
+func IsPortOpen(ctx context.Context, host string, port int, timeout time.Duration) bool {
+	return ProbePort(ctx, host, port, timeout) == PortOpen
+}
+
+// ProbePort reports whether a port on a host is open, closed or unreachable
+// The check goes through the SOCKS5 proxy of the configuration in ctx when one is set, which reports refusals in its reply
+func ProbePort(ctx context.Context, host string, port int, timeout time.Duration) PortState {
+	cfg, err := config.FromContext(ctx)
 	if err != nil {
-		return false
+		return PortUnreachable
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dialTCP(ctx, cfg, net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(err.Error(), "connection refused") {
+			return PortClosed
+		}
+		return PortUnreachable
 	}
 	conn.Close()
-	return true
+	return PortOpen
 }